@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+type accessLogEntry struct {
+	Time       time.Time
+	Service    string
+	Method     string
+	Path       string
+	Query      string
+	Proto      string
+	Host       string
+	RemoteAddr string
+	ClientIP   string
+	Target     string
+	Status     int
+	Bytes      int64
+	Latency    time.Duration
+	Header     http.Header
+	Conn       *connInfo
+	RequestID  string
+}
+
+func parseAccessLogFormat(name, format string) (*template.Template, error) {
+	if format == "" {
+		return nil, nil
+	}
+	return template.New(name).Option("missingkey=zero").Parse(format)
+}
+
+func writeAccessLog(tmpl *template.Template, entry *accessLogEntry, lc logContext) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, entry); err != nil {
+		log.Printf("[%s] access log template error: %v", entry.Service, err)
+		return
+	}
+	log.Printf("%s%s", buf.Bytes(), lc)
+}
+
+// responseRecorder captures the status and size of a response while
+// passing everything through, including flushes and hijacks (via Unwrap).
+// beforeHeader, if set, runs once just before the final header is written.
+type responseRecorder struct {
+	http.ResponseWriter
+	status       int
+	bytes        int64
+	wroteHeader  bool
+	beforeHeader func(h http.Header)
+}
+
+func (rr *responseRecorder) WriteHeader(code int) {
+	if !rr.wroteHeader {
+		rr.status = code
+		rr.wroteHeader = code >= 200 || code == http.StatusSwitchingProtocols
+		if rr.wroteHeader && rr.beforeHeader != nil {
+			rr.beforeHeader(rr.ResponseWriter.Header())
+		}
+	}
+	rr.ResponseWriter.WriteHeader(code)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if !rr.wroteHeader {
+		rr.WriteHeader(http.StatusOK)
+	}
+	n, err := rr.ResponseWriter.Write(b)
+	rr.bytes += int64(n)
+	return n, err
+}
+
+func (rr *responseRecorder) Flush() {
+	if !rr.wroteHeader {
+		rr.WriteHeader(http.StatusOK)
+	}
+	if f, ok := rr.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rr *responseRecorder) Unwrap() http.ResponseWriter {
+	return rr.ResponseWriter
+}
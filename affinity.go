@@ -0,0 +1,195 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Cookie affinity pins a browser to a target with a cookie set by the
+// gateway. The cookie is sealed with AES-GCM, so clients can neither read
+// the backend addresses nor forge a target of their own choosing.
+
+func newAffinityCipher(key string) (cipher.AEAD, error) {
+	if len(key) < 16 {
+		return nil, errors.New("cookie_key must be at least 16 characters")
+	}
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// sealAffinity encodes a target and the time the pin expires.
+func (lb *LoadBalanceConfig) sealAffinity(target string, expires time.Time) string {
+	plain := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	plain = append(plain, target...)
+	nonce := make([]byte, lb.aead.NonceSize(), lb.aead.NonceSize()+len(plain)+lb.aead.Overhead())
+	rand.Read(nonce)
+	return base64.RawURLEncoding.EncodeToString(lb.aead.Seal(nonce, nonce, plain, []byte(lb.CookieName)))
+}
+
+// openAffinity decodes a cookie value, failing for anything the gateway
+// didn't seal or that has expired.
+func (lb *LoadBalanceConfig) openAffinity(value string, now time.Time) (target string, expires time.Time, ok bool) {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(sealed) < lb.aead.NonceSize() {
+		return "", time.Time{}, false
+	}
+	nonce, sealed := sealed[:lb.aead.NonceSize()], sealed[lb.aead.NonceSize():]
+	plain, err := lb.aead.Open(nil, nonce, sealed, []byte(lb.CookieName))
+	if err != nil || len(plain) < 8 {
+		return "", time.Time{}, false
+	}
+	expires = time.Unix(int64(binary.BigEndian.Uint64(plain)), 0)
+	if !now.Before(expires) {
+		return "", time.Time{}, false
+	}
+	return string(plain[8:]), expires, true
+}
+
+// affinity returns the target a request's cookie pins it to, if the cookie
+// is valid, along with when the pin expires.
+func (svc *Service) affinity(r *http.Request, now time.Time) (*upstream, time.Time) {
+	if r == nil || svc.LoadBalance == nil || svc.LoadBalance.aead == nil {
+		return nil, time.Time{}
+	}
+	cookie, err := r.Cookie(svc.LoadBalance.CookieName)
+	if err != nil {
+		return nil, time.Time{}
+	}
+	target, expires, ok := svc.LoadBalance.openAffinity(cookie.Value, now)
+	if !ok {
+		return nil, time.Time{}
+	}
+	for _, up := range svc.upstreams {
+		if up.url.String() == target {
+			return up, expires
+		}
+	}
+	return nil, time.Time{}
+}
+
+// affinityTarget picks the target named by the request's affinity cookie,
+// unless it is unavailable.
+func (svc *Service) affinityTarget(r *http.Request, now time.Time) (*upstream, bool) {
+	up, _ := svc.affinity(r, now)
+	if up == nil || !up.available(now) {
+		return nil, false
+	}
+	return up, true
+}
+
+// setAffinityCookie pins the client to the target that served it. The
+// cookie is renewed once half its ttl has passed, so active sessions stay
+// pinned.
+func (svc *Service) setAffinityCookie(resp *http.Response) {
+	lb := svc.LoadBalance
+	if lb == nil || lb.aead == nil {
+		return
+	}
+	up := upstreamFrom(resp.Request.Context())
+	if up == nil || (svc.Canary != nil && up == svc.Canary.upstream) {
+		// Canary traffic follows the canary percentage, never a pin
+		return
+	}
+
+	now := time.Now()
+	if pinned, expires := svc.affinity(resp.Request, now); pinned == up && expires.Sub(now) > lb.TTL/2 {
+		return
+	}
+	expires := now.Add(lb.TTL)
+	cookie := &http.Cookie{
+		Name:     lb.CookieName,
+		Value:    lb.sealAffinity(up.url.String(), expires),
+		Path:     "/",
+		MaxAge:   int(lb.TTL.Seconds()),
+		HttpOnly: true,
+		Secure:   resp.Request.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	}
+	resp.Header.Add("Set-Cookie", cookie.String())
+}
+
+// AffinityOverride pins the clients presenting a token, or sending a header
+// value, to one of the service's targets, whatever the load balancer would
+// pick; e.g. to reproduce a client's problem against a known backend.
+type AffinityOverride struct {
+	Token    string `yaml:"token,omitempty"` // bearer token or X-API-Key
+	Header   string `yaml:"header,omitempty"`
+	Value    string `yaml:"value,omitempty"`
+	Target   string `yaml:"target"`
+	upstream *upstream
+}
+
+func (svc *Service) compileAffinityOverrides() error {
+	for i := range svc.AffinityOverrides {
+		ao := &svc.AffinityOverrides[i]
+		ao.Token = os.ExpandEnv(ao.Token)
+		if (ao.Token == "") == (ao.Header == "") {
+			return fmt.Errorf("override %d: exactly one of token or header is required", i)
+		}
+		if ao.Header != "" && ao.Value == "" {
+			return fmt.Errorf("override %d: header requires value", i)
+		}
+		want, err := url.Parse(ao.Target)
+		if err != nil {
+			return fmt.Errorf("override %d: %w", i, err)
+		}
+		for _, up := range svc.upstreams {
+			if up.url.String() == want.String() {
+				ao.upstream = up
+			}
+		}
+		if ao.upstream == nil {
+			return fmt.Errorf("override %d: target %q is not one of the service's targets", i, ao.Target)
+		}
+	}
+	return nil
+}
+
+func (ao *AffinityOverride) matches(r *http.Request) bool {
+	if ao.Header != "" {
+		return r.Header.Get(ao.Header) == ao.Value
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if key := r.Header.Get("X-API-Key"); key != "" && token == "" {
+		token = key
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(ao.Token)) == 1
+}
+
+// overrideTarget picks the target the first matching affinity override pins
+// the request to, unless it is unavailable.
+func (svc *Service) overrideTarget(r *http.Request, now time.Time) (*upstream, bool) {
+	if r == nil {
+		return nil, false
+	}
+	for i := range svc.AffinityOverrides {
+		ao := &svc.AffinityOverrides[i]
+		if !ao.matches(r) {
+			continue
+		}
+		if !ao.upstream.available(now) {
+			log.Printf("[%s] affinity override %d matched but %s is unavailable; balancing as usual", svc.name, i, ao.upstream.url)
+			return nil, false
+		}
+		log.Printf("[%s] affinity override %d sent %s %q from %s to %s", svc.name, i, r.Method, r.URL.Path, remoteIP(r), ao.upstream.url)
+		return ao.upstream, true
+	}
+	return nil, false
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// AuthRule gives the paths matching a pattern their own auth, replacing the
+// service's: "none" to make them public, or an auth config of their own.
+type AuthRule struct {
+	Path    string
+	Auth    *AuthConfig // nil for none
+	pattern pathPattern
+}
+
+func (ar *AuthRule) UnmarshalYAML(node *yaml.Node) error {
+	var raw struct {
+		Path string    `yaml:"path"`
+		Auth yaml.Node `yaml:"auth"`
+	}
+	if err := node.Decode(&raw); err != nil {
+		return err
+	}
+	ar.Path, ar.Auth = raw.Path, nil
+	switch {
+	case raw.Auth.Kind == yaml.ScalarNode && raw.Auth.Value == "none":
+	case raw.Auth.Kind == yaml.MappingNode:
+		ar.Auth = new(AuthConfig)
+		return raw.Auth.Decode(ar.Auth)
+	default:
+		return fmt.Errorf("auth rule for %q: auth must be none or an auth config", raw.Path)
+	}
+	return nil
+}
+
+func (svc *Service) compileAuthRules() error {
+	for i := range svc.AuthRules {
+		ar := &svc.AuthRules[i]
+		if ar.Path == "" {
+			return fmt.Errorf("rule %d: path is required", i)
+		}
+		var err error
+		if ar.pattern, err = compilePathPattern(ar.Path); err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		if ar.Auth != nil {
+			if err := ar.Auth.setup(); err != nil {
+				return fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+	}
+	// Most specific first: the pattern with the most literal characters wins,
+	// the first listed among equals
+	slices.SortStableFunc(svc.AuthRules, func(a, b AuthRule) int {
+		return literalLen(b.Path) - literalLen(a.Path)
+	})
+	return nil
+}
+
+func literalLen(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// authFor returns the auth a (prefix-stripped) path requires: that of the
+// most specific matching rule, or the service's. nil means none.
+func (svc *Service) authFor(p string) *AuthConfig {
+	for i := range svc.AuthRules {
+		if svc.AuthRules[i].pattern.match(p) {
+			return svc.AuthRules[i].Auth
+		}
+	}
+	return svc.Auth
+}
+
+// grantsScopes reports whether a token carries every required scope. Scopes
+// come from the introspection response or, failing that, the token's own
+// "scope" or "scp" claim; tokens that carry neither grant none.
+func (ac *AuthConfig) grantsScopes(token, introspected string) bool {
+	if len(ac.RequiredScopes) == 0 {
+		return true
+	}
+	granted := strings.Fields(introspected)
+	if len(granted) == 0 {
+		claims := jwtClaims(token)
+		switch scp := claims["scp"].(type) {
+		case string:
+			granted = strings.Fields(scp)
+		case []any:
+			for _, s := range scp {
+				if s, ok := s.(string); ok {
+					granted = append(granted, s)
+				}
+			}
+		}
+		if scope, ok := claims["scope"].(string); ok {
+			granted = append(granted, strings.Fields(scope)...)
+		}
+	}
+	for _, want := range ac.RequiredScopes {
+		if !slices.Contains(granted, want) {
+			return false
+		}
+	}
+	return true
+}
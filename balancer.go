@@ -0,0 +1,103 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type upstream struct {
+	url      *url.URL
+	director func(*http.Request)
+
+	mu             sync.Mutex
+	warming        bool // until it passes the startup probe
+	unhealthy      bool
+	probeSuccesses int
+	probeFailures  int
+	requests       int
+	failures       int
+	consecutive5xx int
+	ejections      int
+	ejectedUntil   time.Time
+}
+
+func newUpstream(target *url.URL) *upstream {
+	return &upstream{
+		url:      target,
+		director: httputil.NewSingleHostReverseProxy(target).Director,
+	}
+}
+
+// inherit carries a target's health and ejection state over from the
+// config before a reload, so a reload neither skips a target's startup probe
+// nor puts a failing target back into rotation.
+func (u *upstream) inherit(old *upstream) {
+	old.mu.Lock()
+	defer old.mu.Unlock()
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.warming = u.warming && old.warming
+	u.unhealthy = old.unhealthy
+	u.probeSuccesses, u.probeFailures = old.probeSuccesses, old.probeFailures
+	u.consecutive5xx = old.consecutive5xx
+	u.ejections, u.ejectedUntil = old.ejections, old.ejectedUntil
+}
+
+func (u *upstream) ejected(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return u.ejectedUntil.After(now)
+}
+
+func (u *upstream) available(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return !u.warming && !u.unhealthy && !u.ejectedUntil.After(now)
+}
+
+// pickUpstream sends clients with an affinity override to their target, the
+// canary share of traffic to the canary target, and round-robins the rest
+// over the service's targets (or picks by hash of a header, or by affinity
+// cookie), skipping any that are failing health checks or have been ejected
+// by outlier detection.
+func (svc *Service) pickUpstream(r *http.Request) *upstream {
+	now := time.Now()
+	if up, ok := svc.overrideTarget(r, now); ok {
+		return up
+	}
+	if cc := svc.Canary; cc != nil && cc.route(svc.splitPoint(r)) && cc.upstream.available(now) {
+		return cc.upstream
+	}
+	if up, ok := svc.hashTarget(r, now); ok {
+		return up
+	}
+	if up, ok := svc.affinityTarget(r, now); ok {
+		return up
+	}
+
+	n := uint64(len(svc.upstreams))
+	start := atomic.AddUint64(&svc.next, 1)
+
+	for i := uint64(0); i < n; i++ {
+		up := svc.upstreams[(start+i)%n]
+		if up.available(now) {
+			return up
+		}
+	}
+
+	// Every target is down; keep spreading load rather than failing outright
+	return svc.upstreams[start%n]
+}
+
+// pickUpstreamExcept picks a target other than prev where possible.
+func (svc *Service) pickUpstreamExcept(prev *upstream, r *http.Request) *upstream {
+	up := svc.pickUpstream(r)
+	for i := 0; up == prev && i < len(svc.upstreams); i++ {
+		up = svc.pickUpstream(nil)
+	}
+	return up
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// byteRate is a bandwidth in bytes per second, written like a byteSize with
+// an optional "/s" suffix ("1MB/s").
+type byteRate int64
+
+func (br *byteRate) UnmarshalYAML(node *yaml.Node) error {
+	s := strings.TrimSpace(node.Value)
+	if strings.HasSuffix(strings.ToLower(s), "/s") {
+		s = s[:len(s)-2]
+	}
+	n, err := parseByteSize(s)
+	if err != nil {
+		return fmt.Errorf("invalid rate %q", node.Value)
+	}
+	*br = byteRate(n)
+	return nil
+}
+
+// tokenBucket paces bytes at a fixed rate, allowing bursts of up to one
+// second's worth after an idle period.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate byteRate) *tokenBucket {
+	return &tokenBucket{rate: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+// reserve takes n tokens, going into debt if there aren't enough, and
+// returns how long the caller must wait before sending them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// idle reports whether the bucket has refilled completely, making it
+// indistinguishable from a new one.
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.rate
+}
+
+// clientBuckets gives every client IP its own bucket.
+type clientBuckets struct {
+	rate    byteRate
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+func newClientBuckets(rate byteRate) *clientBuckets {
+	return &clientBuckets{rate: rate, buckets: make(map[string]*tokenBucket)}
+}
+
+func (cb *clientBuckets) get(client string) *tokenBucket {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	b, ok := cb.buckets[client]
+	if !ok {
+		// Full buckets carry no state, so they are dropped as the map grows
+		if len(cb.buckets) >= 1024 {
+			now := time.Now()
+			for k, old := range cb.buckets {
+				if old.idle(now) {
+					delete(cb.buckets, k)
+				}
+			}
+		}
+		b = newTokenBucket(cb.rate)
+		cb.buckets[client] = b
+	}
+	return b
+}
+
+// throttle paces the response to the service's bandwidth_limit and
+// client_bandwidth_limit. Upgraded (WebSocket) connections are not paced.
+func (svc *Service) throttle(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	var buckets []*tokenBucket
+	if svc.bandwidth != nil {
+		buckets = append(buckets, svc.bandwidth)
+	}
+	if svc.clientBandwidth != nil {
+		buckets = append(buckets, svc.clientBandwidth.get(remoteIP(r)))
+	}
+	if len(buckets) == 0 {
+		return w
+	}
+
+	// Pace in slices of about 50ms so streamed responses keep flowing
+	rate := svc.BandwidthLimit
+	if rate == 0 || svc.ClientBandwidthLimit > 0 && svc.ClientBandwidthLimit < rate {
+		rate = svc.ClientBandwidthLimit
+	}
+	chunk := min(max(int(rate/20), 512), 32<<10)
+
+	return &throttledWriter{ResponseWriter: w, ctx: r.Context(), buckets: buckets, chunk: chunk}
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	ctx     context.Context
+	buckets []*tokenBucket
+	chunk   int
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		n := min(len(p), tw.chunk)
+
+		var wait time.Duration
+		for _, b := range tw.buckets {
+			wait = max(wait, b.reserve(n))
+		}
+		if wait > 0 {
+			t := time.NewTimer(wait)
+			select {
+			case <-t.C:
+			case <-tw.ctx.Done():
+				t.Stop()
+				return written, tw.ctx.Err()
+			}
+		}
+
+		m, err := tw.ResponseWriter.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Responses larger than a service's max_buffered_response (by default this)
+// are streamed through untouched by the features that inspect bodies
+const defaultMaxBufferedResponse = 10 << 20
+
+// Copy buffer for the proxy. Each response in flight holds one, and a slow
+// client blocks the copy, and with it the upstream, rather than letting the
+// gateway read ahead.
+const proxyBufferSize = 32 << 10
+
+type proxyBufferPool struct{ sync.Pool }
+
+func (p *proxyBufferPool) Get() []byte {
+	if b, ok := p.Pool.Get().(*[]byte); ok {
+		return *b
+	}
+	return make([]byte, proxyBufferSize)
+}
+
+func (p *proxyBufferPool) Put(b []byte) {
+	p.Pool.Put(&b)
+}
+
+var proxyBuffers = &proxyBufferPool{}
+
+// Unread request body the gateway will read past an early rejection, as net/http does after a handler returns
+const defaultRejectedBodyDrain = 256 << 10
+
+// settleRequestBody deals with whatever the client has yet to send of a
+// request the gateway is about to reject. Up to limit bytes are read and
+// discarded, so that a client which sends its whole request before reading
+// the response gets it, and the connection can be reused; a longer body
+// closes the connection after the response instead. It must be called
+// before the response header is written.
+func settleRequestBody(w http.ResponseWriter, r *http.Request, limit int64) {
+	if r.ProtoMajor != 1 || r.ContentLength == 0 || r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	// Reading would send 100 Continue, inviting the upload just to throw it
+	// away; net/http closes such connections itself
+	if strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		return
+	}
+
+	_, err := io.CopyN(io.Discard, r.Body, limit+1)
+	if err != io.EOF && !errors.Is(err, http.ErrBodyReadAfterClose) {
+		w.Header().Set("Connection", "close")
+	}
+}
+
+// peekRequestBody reads up to n bytes of the request body for inspection and
+// puts them back, so the upstream still receives the complete body.
+func peekRequestBody(r *http.Request, n int64) ([]byte, error) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil, nil
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, n))
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+	return body, err
+}
+
+// readResponseBody buffers an upstream response body for inspection,
+// decoding gzip within dc's limits if needed. It returns ok=false, leaving
+// the response streamable, when the body is too large or uses an
+// unsupported encoding.
+func readResponseBody(resp *http.Response, limit int64, dc *DecompressionConfig) (body []byte, ok bool, err error) {
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		return nil, false, nil
+	}
+
+	raw, ok, err := bufferResponseBody(resp, limit)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	if encoding != "gzip" {
+		return raw, true, nil
+	}
+
+	body, err = dc.gunzip(raw, limit)
+	if errors.Is(err, errDecodedTooLarge) {
+		// Decompressed too large to rewrite; pass the original bytes on
+		resp.Body = io.NopCloser(bytes.NewReader(raw))
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	resp.Header.Del("Content-Encoding")
+	return body, true, nil
+}
+
+// bufferResponseBody reads the raw response body into memory. It returns
+// ok=false, with the body still readable in full, if it exceeds the limit;
+// a body declared larger than that isn't read at all.
+func bufferResponseBody(resp *http.Response, limit int64) ([]byte, bool, error) {
+	if resp.ContentLength > limit {
+		return nil, false, nil
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(raw)) > limit {
+		resp.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body}
+		return nil, false, nil
+	}
+	resp.Body.Close()
+	return raw, true, nil
+}
+
+// setResponseBody replaces the response body, fixing up its length headers.
+func setResponseBody(resp *http.Response, body []byte) {
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	resp.TransferEncoding = nil
+}
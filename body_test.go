@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const slowClientConfig = `
+services:
+  stream:
+    target: "{{target}}"
+    max_buffered_response: 1MB
+    rewrite_urls: {from: "http://backend:8080", to: "https://api.example.com"}
+`
+
+// A client that stops reading holds up the backend instead of the gateway
+// reading ahead into memory, even for a body a feature would like to buffer.
+func TestSlowClientBackpressure(t *testing.T) {
+	const total = 256 << 20
+	var written atomic.Int64
+	chunk := bytes.Repeat([]byte("x"), 32<<10)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		for written.Load() < total {
+			n, err := w.Write(chunk)
+			written.Add(int64(n))
+			if err != nil {
+				return
+			}
+		}
+	}))
+	defer backend.Close()
+	cfg := loadTestConfig(t, slowClientConfig, map[string]string{"target": backend.URL})
+	gw := httptest.NewServer(cfg.handler())
+	defer gw.Close()
+
+	heapBefore := liveHeap()
+	resp, err := http.Get(gw.URL + "/stream/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	// Let the backend run until the kernel buffers between it and the
+	// stalled client are full
+	var stalled int64
+	for prev := int64(-1); stalled != prev; time.Sleep(100 * time.Millisecond) {
+		prev, stalled = stalled, written.Load()
+	}
+	if stalled >= total {
+		t.Fatal("backend wrote the whole response to a client that wasn't reading")
+	}
+	if stalled > 64<<20 {
+		t.Fatalf("backend got %dMB ahead of the client", stalled>>20)
+	}
+	if grew := liveHeap() - heapBefore; grew > 8<<20 {
+		t.Fatalf("heap grew %dMB while the client stalled", grew>>20)
+	}
+
+	n, err := io.Copy(io.Discard, resp.Body)
+	if err != nil || n != total {
+		t.Fatalf("client read %d bytes (%v), want %d", n, err, total)
+	}
+}
+
+func liveHeap() int64 {
+	runtime.GC()
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	return int64(ms.HeapAlloc)
+}
+
+func TestBufferResponseBodyCap(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	tests := []struct {
+		name          string
+		contentLength int64
+		limit         int64
+		wantOK        bool
+		wantRead      bool // whether buffering read from the body
+	}{
+		{"under the cap", 100, 100, true, true},
+		{"declared over the cap", 100, 99, false, false},
+		{"unknown length over the cap", -1, 99, false, true},
+		{"unknown length under the cap", -1, 100, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &countingReader{ReadCloser: io.NopCloser(strings.NewReader(body))}
+			resp := &http.Response{ContentLength: tt.contentLength, Body: cr}
+			got, ok, err := bufferResponseBody(resp, tt.limit)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != tt.wantOK || (cr.n > 0) != tt.wantRead {
+				t.Fatalf("ok %t after reading %d bytes, want ok %t, read %t", ok, cr.n, tt.wantOK, tt.wantRead)
+			}
+			if ok {
+				if string(got) != body {
+					t.Fatalf("buffered %d bytes, want %d", len(got), len(body))
+				}
+				return
+			}
+			// Left streamable, in full
+			rest, err := io.ReadAll(resp.Body)
+			if err != nil || string(rest) != body {
+				t.Fatalf("body after buffering gave up: %d bytes (%v), want %d", len(rest), err, len(body))
+			}
+		})
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// BodyTransformConfig converts request bodies between JSON and form
+// encoding, for backends that expect the other one from what clients send.
+// Nested JSON maps to bracketed form keys: {"a":{"b":[1,2]}} is
+// a[b][0]=1&a[b][1]=2.
+type BodyTransformConfig struct {
+	From         string   `yaml:"from"` // json, form
+	To           string   `yaml:"to"`
+	MaxBodyBytes byteSize `yaml:"max_body_bytes,omitempty"`
+}
+
+const formContentType = "application/x-www-form-urlencoded"
+
+func (bt *BodyTransformConfig) setDefaults() {
+	if bt.MaxBodyBytes == 0 {
+		bt.MaxBodyBytes = 1 << 20
+	}
+}
+
+func (bt *BodyTransformConfig) validate() error {
+	for _, enc := range []string{bt.From, bt.To} {
+		if enc != "json" && enc != "form" {
+			return fmt.Errorf("unknown encoding %q (json, form)", enc)
+		}
+	}
+	if bt.From == bt.To {
+		return fmt.Errorf("from and to must differ")
+	}
+	return nil
+}
+
+// matches reports whether a request body is in the encoding to convert from.
+func (bt *BodyTransformConfig) matches(r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	if bt.From == "json" {
+		return isJSONContentType(contentType)
+	}
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	return mediaType == formContentType
+}
+
+// transformRequestBody re-encodes a request body in the backend's encoding.
+// Bodies in any other encoding are passed on as they are.
+func (svc *Service) transformRequestBody(r *http.Request) *gatewayError {
+	bt := svc.BodyTransform
+	if r.Body == nil || r.Body == http.NoBody || r.ContentLength == 0 || !bt.matches(r) {
+		return nil
+	}
+	if r.ContentLength > int64(bt.MaxBodyBytes) {
+		return errBodyTooLarge
+	}
+	body, err := io.ReadAll(io.LimitReader(r.Body, int64(bt.MaxBodyBytes)+1))
+	r.Body.Close()
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || int64(len(body)) > int64(bt.MaxBodyBytes) {
+		return errBodyTooLarge
+	}
+	if err != nil {
+		return errBadBody
+	}
+
+	var out []byte
+	var contentType string
+	if bt.To == "form" {
+		doc, err := decodeJSONBody(body)
+		if _, ok := doc.(map[string]any); err != nil || !ok {
+			// Only an object has names to give the form fields
+			return errBadBody
+		}
+		values := make(url.Values)
+		flattenForm(values, "", doc)
+		out, contentType = []byte(values.Encode()), formContentType
+	} else {
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return errBadBody
+		}
+		doc, err := nestForm(values)
+		if err != nil {
+			return errBadBody
+		}
+		if out, err = json.Marshal(doc); err != nil {
+			return errBadBody
+		}
+		contentType = "application/json"
+	}
+
+	r.Body = io.NopCloser(strings.NewReader(string(out)))
+	r.ContentLength = int64(len(out))
+	r.GetBody = nil
+	r.Header.Set("Content-Type", contentType)
+	r.Header.Del("Content-Length")
+	return nil
+}
+
+// flattenForm adds a JSON value to values under bracketed keys. Nulls become
+// empty values.
+func flattenForm(values url.Values, key string, v any) {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			if key != "" {
+				k = key + "[" + k + "]"
+			}
+			flattenForm(values, k, child)
+		}
+	case []any:
+		for i, child := range v {
+			flattenForm(values, key+"["+strconv.Itoa(i)+"]", child)
+		}
+	case nil:
+		values.Add(key, "")
+	default:
+		values.Add(key, fmt.Sprint(v))
+	}
+}
+
+// nestForm builds a JSON document from bracketed form keys, the reverse of
+// flattenForm. Repeated keys and "a[]" become arrays, as do objects whose
+// keys are exactly 0 to n-1. Values stay strings: a form has no types.
+func nestForm(values url.Values) (map[string]any, error) {
+	root := make(map[string]any)
+	for k, vals := range values {
+		path, list, err := formKeyPath(k)
+		if err != nil {
+			return nil, err
+		}
+		node := root
+		for _, seg := range path[:len(path)-1] {
+			child, ok := node[seg].(map[string]any)
+			if !ok {
+				if _, exists := node[seg]; exists {
+					return nil, fmt.Errorf("key %q conflicts with another", k)
+				}
+				child = make(map[string]any)
+				node[seg] = child
+			}
+			node = child
+		}
+
+		leaf := path[len(path)-1]
+		if _, exists := node[leaf]; exists {
+			return nil, fmt.Errorf("key %q conflicts with another", k)
+		}
+		if list || len(vals) > 1 {
+			items := make([]any, len(vals))
+			for i, v := range vals {
+				items[i] = v
+			}
+			node[leaf] = items
+		} else {
+			node[leaf] = vals[0]
+		}
+	}
+	for k, child := range root {
+		root[k] = arraysFromIndexes(child)
+	}
+	return root, nil
+}
+
+// formKeyPath splits "a[b][c]" into a, b, c. A trailing "[]" marks the
+// values as a list.
+func formKeyPath(key string) (path []string, list bool, err error) {
+	rest, list := strings.CutSuffix(key, "[]")
+	name, rest, _ := strings.Cut(rest, "[")
+	if name == "" {
+		return nil, false, fmt.Errorf("key %q has no name", key)
+	}
+	path = []string{name}
+	for rest != "" {
+		seg, after, ok := strings.Cut(rest, "]")
+		if !ok || seg == "" || (after != "" && after[0] != '[') {
+			return nil, false, fmt.Errorf("malformed key %q", key)
+		}
+		path = append(path, seg)
+		rest = strings.TrimPrefix(after, "[")
+	}
+	return path, list, nil
+}
+
+// arraysFromIndexes turns objects keyed 0 to n-1 back into arrays.
+func arraysFromIndexes(v any) any {
+	obj, ok := v.(map[string]any)
+	if !ok {
+		return v
+	}
+	for k, child := range obj {
+		obj[k] = arraysFromIndexes(child)
+	}
+	if len(obj) == 0 {
+		return obj
+	}
+	list := make([]any, len(obj))
+	for k, child := range obj {
+		i, err := strconv.Atoi(k)
+		if err != nil || i < 0 || i >= len(list) || strconv.Itoa(i) != k {
+			return obj
+		}
+		list[i] = child
+	}
+	return list
+}
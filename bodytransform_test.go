@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFlattenForm(t *testing.T) {
+	tests := []struct {
+		json string
+		form string // unescaped
+	}{
+		{`{"a": "x"}`, "a=x"},
+		{`{"a": {"b": [1, 2]}}`, "a[b][0]=1&a[b][1]=2"},
+		{`{"a": [{"n": 1}, {"n": 2}]}`, "a[0][n]=1&a[1][n]=2"},
+		{`{"a": null, "b": true, "c": 12345678901}`, "a=&b=true&c=12345678901"},
+		{`{"a": 1.5, "b": {"c": {"d": "e"}}}`, "a=1.5&b[c][d]=e"},
+		{`{"a": [], "b": {}}`, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			doc, err := decodeJSONBody([]byte(tt.json))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make(url.Values)
+			flattenForm(got, "", doc)
+			want, err := url.ParseQuery(tt.form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestNestForm(t *testing.T) {
+	tests := []struct {
+		form string // unescaped
+		json string // empty if the form can't be nested
+	}{
+		{"a=x", `{"a": "x"}`},
+		{"a=1&a=2", `{"a": ["1", "2"]}`},
+		{"a[]=1", `{"a": ["1"]}`},
+		{"a[b][c]=1", `{"a": {"b": {"c": "1"}}}`},
+		{"a[0]=x&a[1]=y", `{"a": ["x", "y"]}`},
+		{"a[0][n]=1&a[1][n]=2", `{"a": [{"n": "1"}, {"n": "2"}]}`},
+		{"a[1]=x", `{"a": {"1": "x"}}`},
+		{"a[0]=x&a[00]=y", `{"a": {"0": "x", "00": "y"}}`},
+		{"0=x", `{"0": "x"}`},
+		{"a=1&a[b]=2", ""},
+		{"a[b]=1&a[b][c]=2", ""},
+		{"a[b=1", ""},
+		{"a[]b=1", ""},
+		{"[b]=1", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.form, func(t *testing.T) {
+			values, err := url.ParseQuery(tt.form)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := nestForm(values)
+			if tt.json == "" {
+				if err == nil {
+					t.Fatalf("nested to %v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want map[string]any
+			if err := json.Unmarshal([]byte(tt.json), &want); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// Documents with only strings, non-empty arrays and objects survive a trip
+// to form encoding and back unchanged.
+func TestFormRoundTrip(t *testing.T) {
+	docs := []string{
+		`{"a": "x"}`,
+		`{"a": {"b": ["1", "2"]}, "c": "3"}`,
+		`{"items": [{"id": "1", "tags": ["x", "y"]}, {"id": "2", "tags": ["z", "w"]}]}`,
+		`{"a": {"b": {"c": {"d": "deep"}}}}`,
+		`{"q": "a=b&c[d]", "space": "x y"}`,
+	}
+	for _, doc := range docs {
+		t.Run(doc, func(t *testing.T) {
+			in, err := decodeJSONBody([]byte(doc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			values := make(url.Values)
+			flattenForm(values, "", in)
+			parsed, err := url.ParseQuery(values.Encode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, err := nestForm(parsed)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(any(out), in) {
+				t.Fatalf("round trip gave %v", out)
+			}
+		})
+	}
+}
+
+const bodyTransformSchemaConfig = `
+services:
+  api:
+    target: "{{target}}"
+    body_transform: {from: {{from}}, to: {{to}}}
+    schema:
+      request: "{{schema}}"
+`
+
+// The schema is checked against the JSON side of the conversion, whichever
+// way round it goes.
+func TestBodyTransformSchemaOrder(t *testing.T) {
+	var got string
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got = string(body)
+	}))
+	defer backend.Close()
+	schema := filepath.Join(t.TempDir(), "request.json")
+	err := os.WriteFile(schema, []byte(`{"type": "object", "required": ["id"], "properties": {"id": {"type": "string"}}}`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, from, to, contentType, body string
+		want                              int
+		wantBody                          string
+	}{
+		{"form to json", "form", "json", formContentType, "id=7", http.StatusOK, `{"id":"7"}`},
+		{"form to json, invalid", "form", "json", formContentType, "name=x", http.StatusBadRequest, ""},
+		{"json to form", "json", "form", "application/json", `{"id": "7"}`, http.StatusOK, "id=7"},
+		{"json to form, invalid", "json", "form", "application/json", `{"id": 7}`, http.StatusBadRequest, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got = ""
+			cfg := loadTestConfig(t, bodyTransformSchemaConfig, map[string]string{
+				"target": backend.URL, "from": tt.from, "to": tt.to, "schema": schema,
+			})
+			r := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			w := serve(cfg, r)
+			if w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if got != tt.wantBody {
+				t.Fatalf("backend got %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
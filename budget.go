@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// A latency budget bounds the time from the gateway receiving a request to
+// the upstream starting its response, across every retry and hedge. Each
+// attempt only gets what is left of it, and retries the budget can't afford
+// aren't made.
+
+var errLatencyBudget = errors.New("latency budget exhausted")
+
+type budgetKey struct{}
+
+func withBudget(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, budgetKey{}, deadline)
+}
+
+func budgetFrom(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(budgetKey{}).(time.Time)
+	return deadline, ok
+}
+
+// budgetAllows reports whether the budget has more than d left, as it
+// always does for requests without one.
+func budgetAllows(ctx context.Context, d time.Duration) bool {
+	deadline, ok := budgetFrom(ctx)
+	return !ok || time.Until(deadline) > d
+}
+
+// requestDeadline is when the gateway gives up on an outgoing request: its
+// context's deadline or the end of its latency budget, whichever is first.
+func requestDeadline(req *http.Request) (time.Time, bool) {
+	deadline, ok := req.Context().Deadline()
+	if budget, hasBudget := budgetFrom(req.Context()); hasBudget && (!ok || budget.Before(deadline)) {
+		return budget, true
+	}
+	return deadline, ok
+}
+
+// budgetTransport cuts each attempt off when the budget runs out before
+// the upstream has responded. A response that started in time streams on.
+type budgetTransport struct {
+	svc  *Service
+	base http.RoundTripper
+}
+
+func (bt *budgetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	deadline, ok := budgetFrom(req.Context())
+	if !ok {
+		return bt.base.RoundTrip(req)
+	}
+	exhausted := fmt.Errorf("%w after %s: %w", errLatencyBudget, bt.svc.LatencyBudget, context.DeadlineExceeded)
+	remaining := time.Until(deadline)
+	if remaining <= 0 {
+		return nil, exhausted
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(remaining, cancel)
+	resp, err := bt.base.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The budget ran out, perhaps just as the response arrived
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, exhausted
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
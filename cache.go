@@ -0,0 +1,316 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type CacheConfig struct {
+	TTL          time.Duration `yaml:"ttl"`
+	MaxEntries   int           `yaml:"max_entries"`
+	MaxBodyBytes int64         `yaml:"max_body_bytes"`
+	CacheErrors  bool          `yaml:"cache_errors"` // allow caching 4xx; 5xx are never cached
+	StaleIfError time.Duration `yaml:"stale_if_error"`
+	Rules        []CacheRule   `yaml:"rules,omitempty"`
+}
+
+// CacheRule sets cacheability for the paths matching a pattern. The rule
+// with the most specific pattern wins; with rules, unmatched paths are not
+// cached.
+type CacheRule struct {
+	Path    string        `yaml:"path"`
+	TTL     time.Duration `yaml:"ttl,omitempty"` // default: the cache's ttl
+	Enabled *bool         `yaml:"enabled,omitempty"`
+	pattern pathPattern
+}
+
+func (cc *CacheConfig) compile() error {
+	for i := range cc.Rules {
+		rule := &cc.Rules[i]
+		if rule.Path == "" {
+			return fmt.Errorf("rule %d: path is required", i)
+		}
+		var err error
+		if rule.pattern, err = compilePathPattern(rule.Path); err != nil {
+			return fmt.Errorf("rule %s: %w", rule.Path, err)
+		}
+	}
+	return nil
+}
+
+// ttlForPath returns the default TTL for responses to path, or ok=false if
+// they must not be cached.
+func (cc *CacheConfig) ttlForPath(path string) (ttl time.Duration, ok bool) {
+	if len(cc.Rules) == 0 {
+		return cc.TTL, true
+	}
+
+	var best *CacheRule
+	bestSpecificity := -1
+	for i := range cc.Rules {
+		rule := &cc.Rules[i]
+		if !rule.pattern.match(path) {
+			continue
+		}
+		// The more literal characters, the more specific
+		if n := len(rule.Path) - strings.Count(rule.Path, "*") - strings.Count(rule.Path, "?"); n > bestSpecificity {
+			best, bestSpecificity = rule, n
+		}
+	}
+	if best == nil || best.Enabled != nil && !*best.Enabled {
+		return 0, false
+	}
+	if best.TTL > 0 {
+		return best.TTL, true
+	}
+	return cc.TTL, true
+}
+
+func (cc *CacheConfig) setDefaults() {
+	if cc.TTL == 0 {
+		cc.TTL = time.Minute
+	}
+	if cc.MaxEntries == 0 {
+		cc.MaxEntries = 1000
+	}
+	if cc.MaxBodyBytes == 0 {
+		cc.MaxBodyBytes = 1 << 20
+	}
+}
+
+type cacheEntry struct {
+	key     string
+	status  int
+	header  http.Header
+	body    []byte
+	stored  time.Time
+	expires time.Time
+}
+
+// responseCache is a fixed-size LRU of upstream responses.
+type responseCache struct {
+	service     string
+	cfg         *CacheConfig
+	maxBuffered int64
+	mu          sync.Mutex
+	entries     map[string]*list.Element
+	lru         *list.List
+}
+
+func newResponseCache(service string, cfg *CacheConfig, maxBuffered byteSize) *responseCache {
+	cfg.setDefaults()
+	return &responseCache{
+		service:     service,
+		cfg:         cfg,
+		maxBuffered: int64(maxBuffered),
+		entries:     make(map[string]*list.Element),
+		lru:         list.New(),
+	}
+}
+
+type cacheKeyKey struct{}
+
+// cachedRequest is what the response path needs to know about a cacheable
+// request.
+type cachedRequest struct {
+	key string
+	ttl time.Duration
+}
+
+// cacheKey identifies a cacheable request. Credentials are part of the key
+// so one client's response is never served to another.
+func cacheKey(service string, r *http.Request) (string, bool) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return "", false
+	}
+	if cc := r.Header.Get("Cache-Control"); strings.Contains(cc, "no-cache") || strings.Contains(cc, "no-store") {
+		return "", false
+	}
+
+	h := sha256.New()
+	for _, part := range []string{
+		service, r.Method, r.Host, r.URL.RequestURI(),
+		r.Header.Get("Accept-Encoding"),
+		r.Header.Get("Authorization"), r.Header.Get("X-API-Key"),
+		r.Header.Get(clientCertFingerprintHeader),
+	} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+func withCacheKey(ctx context.Context, key string, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, cacheKeyKey{}, cachedRequest{key, ttl})
+}
+
+// get returns the fresh entry for key, if any.
+func (rc *responseCache) get(key string) *cacheEntry {
+	entry := rc.lookup(key)
+	if entry == nil || time.Now().After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+// stale returns the entry for key even if it has expired, as long as it is
+// within the stale_if_error window.
+func (rc *responseCache) stale(key string) *cacheEntry {
+	return rc.lookup(key)
+}
+
+// lookup returns the entry for key, dropping it once it is too old to be
+// served even as stale.
+func (rc *responseCache) lookup(key string) *cacheEntry {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	el, ok := rc.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := el.Value.(*cacheEntry)
+	if time.Now().After(entry.expires.Add(rc.cfg.StaleIfError)) {
+		rc.lru.Remove(el)
+		delete(rc.entries, key)
+		return nil
+	}
+	rc.lru.MoveToFront(el)
+	return entry
+}
+
+func (rc *responseCache) put(entry *cacheEntry) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if el, ok := rc.entries[entry.key]; ok {
+		el.Value = entry
+		rc.lru.MoveToFront(el)
+		return
+	}
+
+	rc.entries[entry.key] = rc.lru.PushFront(entry)
+	for rc.lru.Len() > rc.cfg.MaxEntries {
+		oldest := rc.lru.Back()
+		rc.lru.Remove(oldest)
+		delete(rc.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// ttlFor returns how long a response may be cached, or 0 if it must not be.
+// Server errors are never cached, since serving a stale error would turn a
+// blip into an outage; client errors only with cache_errors.
+func (rc *responseCache) ttlFor(resp *http.Response, ttl time.Duration) time.Duration {
+	if resp.StatusCode >= 500 || (resp.StatusCode >= 400 && !rc.cfg.CacheErrors) {
+		return 0
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode < 400 {
+		return 0
+	}
+	if resp.Header.Get("Set-Cookie") != "" || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return 0
+	}
+
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(strings.ToLower(directive))
+		switch {
+		case directive == "no-store", directive == "private", directive == "no-cache":
+			return 0
+		case strings.HasPrefix(directive, "max-age="):
+			if secs, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age=")); err == nil {
+				ttl = time.Duration(secs) * time.Second
+			}
+		}
+	}
+	return ttl
+}
+
+// store is called from ModifyResponse for requests that carried a cache key.
+func (rc *responseCache) store(resp *http.Response) error {
+	cr, ok := resp.Request.Context().Value(cacheKeyKey{}).(cachedRequest)
+	if !ok {
+		return nil
+	}
+	key := cr.key
+	if resp.StatusCode >= 500 {
+		if entry := rc.stale(key); entry != nil {
+			log.Printf("[%s] upstream returned %d, serving stale cached response", rc.service, resp.StatusCode)
+			entry.replace(resp)
+			return nil
+		}
+	}
+	resp.Header.Set("X-Cache", "MISS")
+
+	ttl := rc.ttlFor(resp, cr.ttl)
+	if ttl <= 0 || resp.ContentLength > rc.cfg.MaxBodyBytes {
+		return nil
+	}
+
+	body, ok, err := bufferResponseBody(resp, min(rc.cfg.MaxBodyBytes, rc.maxBuffered))
+	if err != nil || !ok {
+		return err
+	}
+	setResponseBody(resp, body)
+	if int64(len(body)) > rc.cfg.MaxBodyBytes {
+		return nil
+	}
+
+	now := time.Now()
+	rc.put(&cacheEntry{
+		key:     key,
+		status:  resp.StatusCode,
+		header:  resp.Header.Clone(),
+		body:    body,
+		stored:  now,
+		expires: now.Add(ttl),
+	})
+	return nil
+}
+
+// serveStale answers a request whose upstream attempt failed with its stale
+// cached response, if there is one.
+func (rc *responseCache) serveStale(w http.ResponseWriter, r *http.Request) bool {
+	cr, ok := r.Context().Value(cacheKeyKey{}).(cachedRequest)
+	if !ok {
+		return false
+	}
+	entry := rc.stale(cr.key)
+	if entry == nil {
+		return false
+	}
+	log.Printf("[%s] serving stale cached response after upstream failure", rc.service)
+	entry.serve(w, r, "STALE")
+	return true
+}
+
+// replace swaps a failed upstream response for the stale cached one.
+func (entry *cacheEntry) replace(resp *http.Response) {
+	resp.Body.Close()
+	resp.StatusCode = entry.status
+	resp.Status = fmt.Sprintf("%d %s", entry.status, http.StatusText(entry.status))
+	resp.Header = entry.header.Clone()
+	resp.Header.Set("X-Cache", "STALE")
+	resp.Header.Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	setResponseBody(resp, entry.body)
+}
+
+func (entry *cacheEntry) serve(w http.ResponseWriter, r *http.Request, state string) {
+	for k, v := range entry.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("X-Cache", state)
+	w.Header().Set("Age", strconv.Itoa(int(time.Since(entry.stored).Seconds())))
+	w.WriteHeader(entry.status)
+	if r.Method != http.MethodHead {
+		w.Write(entry.body)
+	}
+}
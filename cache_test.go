@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const cacheErrorsConfig = `
+services:
+  api:
+    target: "{{target}}"
+    cache: {ttl: 60s, cache_errors: {{cache_errors}}}
+`
+
+func TestCacheErrorResponses(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		cacheControl string
+		cacheErrors  string
+		wantCached   bool
+	}{
+		{"503 is not cached", http.StatusServiceUnavailable, "", "false", false},
+		{"500 is not cached even with cache_errors", http.StatusInternalServerError, "max-age=60", "true", false},
+		{"404 is not cached by default", http.StatusNotFound, "", "false", false},
+		{"404 is cached with cache_errors", http.StatusNotFound, "", "true", true},
+		{"404 with no-store is not cached", http.StatusNotFound, "no-store", "true", false},
+		{"200 is cached", http.StatusOK, "", "false", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var hits atomic.Int64
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if hits.Add(1) > 1 {
+					// Recovered by the next request
+					w.Write([]byte("fresh"))
+					return
+				}
+				if tt.cacheControl != "" {
+					w.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte("first"))
+			}))
+			defer backend.Close()
+			cfg := loadTestConfig(t, cacheErrorsConfig, map[string]string{"target": backend.URL, "cache_errors": tt.cacheErrors})
+
+			if w := serve(cfg, httptest.NewRequest(http.MethodGet, "/api/item", nil)); w.Code != tt.status {
+				t.Fatalf("first request: status %d, want %d", w.Code, tt.status)
+			}
+			w := serve(cfg, httptest.NewRequest(http.MethodGet, "/api/item", nil))
+			if cached := w.Header().Get("X-Cache") == "HIT"; cached != tt.wantCached {
+				t.Fatalf("second request X-Cache %q, want cached: %t", w.Header().Get("X-Cache"), tt.wantCached)
+			}
+			wantHits, wantCode, wantBody := int64(2), http.StatusOK, "fresh"
+			if tt.wantCached {
+				wantHits, wantCode, wantBody = 1, tt.status, "first"
+			}
+			if hits.Load() != wantHits || w.Code != wantCode || w.Body.String() != wantBody {
+				t.Fatalf("second request: %d %q after %d upstream hits, want %d %q after %d", w.Code, w.Body, hits.Load(), wantCode, wantBody, wantHits)
+			}
+		})
+	}
+}
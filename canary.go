@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type CanaryConfig struct {
+	Target        string              `yaml:"target"`
+	Percent       float64             `yaml:"percent"`
+	PercentSource string              `yaml:"percent_source"` // http(s) URL, file path, or env:VAR
+	Poll          time.Duration       `yaml:"poll"`
+	AutoRollback  *AutoRollbackConfig `yaml:"auto_rollback,omitempty"`
+	upstream      *upstream
+	percent       atomic.Uint64 // math.Float64bits of the current percentage
+	rollback      canaryRollback
+}
+
+// AutoRollbackConfig takes the canary out of rotation once its error rate
+// over the window exceeds error_rate.
+type AutoRollbackConfig struct {
+	ErrorRate   float64       `yaml:"error_rate"`
+	Window      time.Duration `yaml:"window,omitempty"`
+	MinRequests int           `yaml:"min_requests,omitempty"`
+}
+
+// The rollback window slides in this many steps
+const rollbackSlots = 10
+
+type canaryRollback struct {
+	mu         sync.Mutex
+	requests   [rollbackSlots]int
+	failures   [rollbackSlots]int
+	slot       int
+	slotStart  time.Time
+	rolledBack bool
+	source     float64 // percent_source value when rolled back
+}
+
+func (cc *CanaryConfig) setDefaults() {
+	if cc.Poll == 0 {
+		cc.Poll = 10 * time.Second
+	}
+	cc.setPercent(cc.Percent)
+	if ar := cc.AutoRollback; ar != nil {
+		if ar.Window == 0 {
+			ar.Window = time.Minute
+		}
+		if ar.MinRequests == 0 {
+			ar.MinRequests = 20
+		}
+	}
+}
+
+func (cc *CanaryConfig) validate() error {
+	if math.IsNaN(cc.Percent) || math.IsInf(cc.Percent, 0) {
+		return fmt.Errorf("percent must be a number")
+	}
+	if ar := cc.AutoRollback; ar != nil && (ar.ErrorRate <= 0 || ar.ErrorRate >= 1) {
+		return fmt.Errorf("auto_rollback.error_rate must be between 0 and 1")
+	}
+	return nil
+}
+
+// recordResult counts a canary response towards auto_rollback, rolling the
+// canary back to 0% if its error rate over the window is too high.
+func (cc *CanaryConfig) recordResult(service string, failed bool) {
+	ar := cc.AutoRollback
+	if ar == nil {
+		return
+	}
+	rb := &cc.rollback
+
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.rolledBack {
+		return
+	}
+
+	now := time.Now()
+	step := ar.Window / rollbackSlots
+	for n := 0; now.Sub(rb.slotStart) >= step && n < rollbackSlots; n++ {
+		rb.slot = (rb.slot + 1) % rollbackSlots
+		rb.requests[rb.slot], rb.failures[rb.slot] = 0, 0
+		rb.slotStart = rb.slotStart.Add(step)
+	}
+	if now.Sub(rb.slotStart) >= step {
+		rb.slotStart = now
+	}
+	rb.requests[rb.slot]++
+	if failed {
+		rb.failures[rb.slot]++
+	}
+
+	var requests, failures int
+	for i := range rb.requests {
+		requests += rb.requests[i]
+		failures += rb.failures[i]
+	}
+	rate := float64(failures) / float64(requests)
+	if requests < ar.MinRequests || rate <= ar.ErrorRate {
+		return
+	}
+
+	rb.rolledBack = true
+	rb.source = cc.Percent
+	rb.requests, rb.failures = [rollbackSlots]int{}, [rollbackSlots]int{}
+	old := cc.currentPercent()
+	cc.setPercent(0)
+	log.Printf("[%s] canary: rolling back %s from %g%% to 0%%: error rate %.1f%% over %s (%d of %d requests) exceeds %g%%",
+		service, cc.Target, old, 100*rate, ar.Window, failures, requests, 100*ar.ErrorRate)
+}
+
+func (cc *CanaryConfig) currentPercent() float64 {
+	return math.Float64frombits(cc.percent.Load())
+}
+
+func (cc *CanaryConfig) setPercent(p float64) {
+	cc.percent.Store(math.Float64bits(math.Max(0, math.Min(100, p))))
+}
+
+// route decides whether a request at the given split point (0-100) goes to
+// the canary target.
+func (cc *CanaryConfig) route(point float64) bool {
+	return point < cc.currentPercent()
+}
+
+// pollPercent refreshes the canary percentage from percent_source. On fetch
+// failure the last known value stays in effect.
+func (cc *CanaryConfig) pollPercent(ctx context.Context, service string) {
+	ticker := time.NewTicker(cc.Poll)
+	defer ticker.Stop()
+
+	for ; ctx.Err() == nil; tick(ctx, ticker) {
+		p, err := readPercentSource(cc.PercentSource)
+		if err != nil {
+			log.Printf("[%s] canary: reading percent from %s: %v", service, cc.PercentSource, err)
+			continue
+		}
+
+		// A rollback holds until the controller asks for a different
+		// percentage, such as after a fixed canary is deployed
+		cc.rollback.mu.Lock()
+		if cc.rollback.rolledBack && p == cc.rollback.source {
+			cc.rollback.mu.Unlock()
+			continue
+		}
+		// Set under the lock, so a rollback can't land in between and be
+		// overwritten
+		cc.rollback.rolledBack = false
+		cc.Percent = p
+		old := cc.currentPercent()
+		cc.setPercent(p)
+		current := cc.currentPercent()
+		cc.rollback.mu.Unlock()
+
+		if current != old {
+			log.Printf("[%s] canary: traffic to %s changed from %g%% to %g%%", service, cc.Target, old, current)
+		}
+	}
+}
+
+// inherit carries a canary's state over from the config before a reload:
+// the percentage last read from an unchanged percent_source, and a rollback
+// while the target and configured percentage are the ones rolled back.
+func (cc *CanaryConfig) inherit(old *CanaryConfig) {
+	if cc.PercentSource != "" && cc.PercentSource == old.PercentSource {
+		cc.setPercent(old.currentPercent())
+	}
+
+	old.rollback.mu.Lock()
+	defer old.rollback.mu.Unlock()
+	if old.rollback.rolledBack && cc.Target == old.Target && cc.Percent == old.rollback.source {
+		cc.rollback.rolledBack = true
+		cc.rollback.source = old.rollback.source
+		cc.setPercent(0)
+	}
+}
+
+func readPercentSource(source string) (float64, error) {
+	var raw string
+	switch {
+	case strings.HasPrefix(source, "http://"), strings.HasPrefix(source, "https://"):
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Get(source)
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return 0, fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		body, err := io.ReadAll(io.LimitReader(resp.Body, 64))
+		if err != nil {
+			return 0, err
+		}
+		raw = string(body)
+
+	case strings.HasPrefix(source, "env:"):
+		name := strings.TrimPrefix(source, "env:")
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return 0, fmt.Errorf("%s is not set", name)
+		}
+		raw = v
+
+	default:
+		data, err := os.ReadFile(strings.TrimPrefix(source, "file://"))
+		if err != nil {
+			return 0, err
+		}
+		raw = string(data)
+	}
+
+	p, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(raw), "%"), 64)
+	if err != nil {
+		return 0, err
+	}
+	// ParseFloat accepts "NaN" and "Inf", which are no percentage to clamp
+	if math.IsNaN(p) || math.IsInf(p, 0) {
+		return 0, fmt.Errorf("%q is not a percentage", strings.TrimSpace(raw))
+	}
+	return p, nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const canaryReloadConfig = `
+services:
+  api:
+    target: "{{primary}}"
+    load_balance:
+      deterministic_seed: 7
+    canary:
+      target: "{{canary}}"
+      percent: {{percent}}
+      auto_rollback:
+        error_rate: 0.5
+        min_requests: 10
+`
+
+type canaryFixture struct {
+	path            string
+	primary, canary *testBackend
+	g               *gateway
+	gw              *httptest.Server
+	vars            map[string]string
+}
+
+func newCanaryFixture(t *testing.T, percent float64) *canaryFixture {
+	t.Helper()
+	f := &canaryFixture{
+		path:    filepath.Join(t.TempDir(), "gateway.yaml"),
+		primary: newTestBackend(t, http.StatusOK),
+		canary:  newTestBackend(t, http.StatusOK),
+	}
+	f.vars = map[string]string{"primary": f.primary.URL, "canary": f.canary.URL}
+	f.write(t, percent)
+	cfg, err := loadConfig(f.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.g = newGateway(f.path, cfg)
+	f.gw = httptest.NewServer(f.g)
+	t.Cleanup(f.gw.Close)
+	return f
+}
+
+func (f *canaryFixture) write(t *testing.T, percent float64) {
+	t.Helper()
+	f.vars["percent"] = strconv.FormatFloat(percent, 'g', -1, 64)
+	writeTestConfig(t, f.path, canaryReloadConfig, f.vars)
+}
+
+// share sends n requests and returns the fraction the canary got.
+func (f *canaryFixture) share(t *testing.T, n int) float64 {
+	t.Helper()
+	before := f.canary.hits.Load()
+	for i := 0; i < n; i++ {
+		resp, err := http.Get(f.gw.URL + "/api/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	return float64(f.canary.hits.Load()-before) / float64(n)
+}
+
+func TestReloadShiftsCanarySplit(t *testing.T) {
+	f := newCanaryFixture(t, 10)
+	if share := f.share(t, 400); share < 0.05 || share > 0.15 {
+		t.Fatalf("canary got %.0f%% at 10%%", share*100)
+	}
+
+	// Keep traffic flowing while the split changes, none of it dropped
+	stop := make(chan struct{})
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				resp, err := http.Get(f.gw.URL + "/api/")
+				if err != nil || resp.StatusCode != http.StatusOK {
+					failed.Add(1)
+				}
+				if err == nil {
+					resp.Body.Close()
+				}
+			}
+		}()
+	}
+
+	f.write(t, 90)
+	if err := f.g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	close(stop)
+	wg.Wait()
+	if n := failed.Load(); n > 0 {
+		t.Fatalf("%d requests failed across the reload", n)
+	}
+
+	if share := f.share(t, 400); share < 0.85 || share > 0.95 {
+		t.Fatalf("canary got %.0f%% after reloading at 90%%", share*100)
+	}
+}
+
+func TestReloadKeepsCanaryRollback(t *testing.T) {
+	f := newCanaryFixture(t, 50)
+	cc := f.g.current.Load().Services["api"].Canary
+	for i := 0; i < 10; i++ {
+		cc.recordResult("api", true)
+	}
+	if p := cc.currentPercent(); p != 0 {
+		t.Fatalf("canary at %g%% after failing, want rolled back", p)
+	}
+
+	// An unrelated reload leaves the bad canary rolled back
+	if err := f.g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if p := f.g.current.Load().Services["api"].Canary.currentPercent(); p != 0 {
+		t.Fatalf("canary back at %g%% after reload", p)
+	}
+
+	// A different percentage is a decision to try the canary again
+	f.write(t, 20)
+	if err := f.g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if p := f.g.current.Load().Services["api"].Canary.currentPercent(); p != 20 {
+		t.Fatalf("canary at %g%% after reloading at 20%%", p)
+	}
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionConfig compresses responses for clients that accept it.
+// Algorithms are in the operator's order of preference, which breaks ties
+// between encodings the client rates equally.
+type CompressionConfig struct {
+	Algorithms []string `yaml:"algorithms,omitempty"` // gzip, deflate
+	Level      int      `yaml:"level,omitempty"`
+	MinSize    byteSize `yaml:"min_size,omitempty"`
+	Types      []string `yaml:"types,omitempty"`
+	pools      map[string]*sync.Pool
+}
+
+var defaultCompressibleTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/x-ndjson",
+	"image/svg+xml",
+}
+
+func (cc *CompressionConfig) setDefaults() {
+	if len(cc.Algorithms) == 0 {
+		cc.Algorithms = []string{"gzip"}
+	}
+	if cc.Level == 0 {
+		cc.Level = gzip.DefaultCompression
+	}
+	if cc.MinSize == 0 {
+		cc.MinSize = 1 << 10
+	}
+	if len(cc.Types) == 0 {
+		cc.Types = defaultCompressibleTypes
+	}
+}
+
+func (cc *CompressionConfig) compile() error {
+	if cc.Level != gzip.DefaultCompression && (cc.Level < gzip.BestSpeed || cc.Level > gzip.BestCompression) {
+		return fmt.Errorf("level must be between 1 and 9")
+	}
+
+	cc.pools = make(map[string]*sync.Pool, len(cc.Algorithms))
+	for i, alg := range cc.Algorithms {
+		alg = strings.ToLower(alg)
+		cc.Algorithms[i] = alg
+		level := cc.Level
+		switch alg {
+		case "gzip":
+			cc.pools[alg] = &sync.Pool{New: func() any {
+				zw, _ := gzip.NewWriterLevel(nil, level)
+				return zw
+			}}
+		case "deflate":
+			cc.pools[alg] = &sync.Pool{New: func() any {
+				zw, _ := zlib.NewWriterLevel(nil, level)
+				return zw
+			}}
+		default:
+			return fmt.Errorf("unknown algorithm %q (gzip, deflate)", alg)
+		}
+	}
+	return nil
+}
+
+// negotiate picks the encoding for a request's Accept-Encoding: the
+// configured algorithm with the highest q-value, or "" for none.
+func (cc *CompressionConfig) negotiate(acceptEncoding string) string {
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[strings.ToLower(strings.TrimSpace(name))] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, alg := range cc.Algorithms {
+		q, ok := accepted[alg]
+		if !ok {
+			q = accepted["*"]
+		}
+		if q > bestQ {
+			best, bestQ = alg, q
+		}
+	}
+	return best
+}
+
+func (cc *CompressionConfig) compressible(contentType string) bool {
+	contentType = strings.ToLower(contentType)
+	for _, t := range cc.Types {
+		if strings.HasPrefix(contentType, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// compress wraps w to compress the response if the client accepts one of
+// the service's algorithms. The returned func finishes the stream and must
+// be called once the response is written.
+func (svc *Service) compress(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	cc := svc.Compression
+	if cc == nil || r.Method == http.MethodHead || r.Header.Get("Upgrade") != "" {
+		return w, func() {}
+	}
+	encoding := cc.negotiate(r.Header.Get("Accept-Encoding"))
+	if encoding == "" {
+		return w, func() {}
+	}
+
+	cw := &compressWriter{ResponseWriter: w, cfg: cc, encoding: encoding}
+	return cw, cw.close
+}
+
+type resetWriteCloser interface {
+	io.WriteCloser
+	Flush() error
+	Reset(io.Writer)
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	cfg         *CompressionConfig
+	encoding    string
+	zw          resetWriteCloser
+	wroteHeader bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader || code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	cw.wroteHeader = true
+
+	h := cw.Header()
+	if cw.shouldCompress(code, h) {
+		h.Set("Content-Encoding", cw.encoding)
+		h.Del("Content-Length")
+		// A strong validator names one exact representation
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		cw.zw = cw.cfg.pools[cw.encoding].Get().(resetWriteCloser)
+		cw.zw.Reset(cw.ResponseWriter)
+	}
+	if code != http.StatusNotModified && code != http.StatusNoContent {
+		h.Add("Vary", "Accept-Encoding")
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *compressWriter) shouldCompress(code int, h http.Header) bool {
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		return false
+	}
+	if h.Get("Content-Encoding") != "" || h.Get("Content-Range") != "" {
+		return false
+	}
+	if strings.Contains(h.Get("Cache-Control"), "no-transform") {
+		return false
+	}
+	if n, err := strconv.ParseInt(h.Get("Content-Length"), 10, 64); err == nil && n < int64(cw.cfg.MinSize) {
+		return false
+	}
+	return cw.cfg.compressible(h.Get("Content-Type"))
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.zw == nil {
+		return cw.ResponseWriter.Write(p)
+	}
+	return cw.zw.Write(p)
+}
+
+// Flush pushes out what has been compressed so far, so that streamed
+// responses keep flowing.
+func (cw *compressWriter) Flush() {
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) close() {
+	if cw.zw == nil {
+		return
+	}
+	cw.zw.Close()
+	cw.zw.Reset(io.Discard)
+	cw.cfg.pools[cw.encoding].Put(cw.zw)
+	cw.zw = nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestCompressionNegotiate(t *testing.T) {
+	tests := []struct {
+		algorithms     []string
+		acceptEncoding string
+		want           string
+	}{
+		{[]string{"gzip"}, "gzip, deflate, br", "gzip"},
+		{[]string{"gzip", "deflate"}, "deflate, gzip", "gzip"},
+		{[]string{"gzip", "deflate"}, "gzip;q=0.5, deflate", "deflate"},
+		{[]string{"deflate", "gzip"}, "br, gzip", "gzip"},
+		{[]string{"gzip"}, "br", ""},
+		{[]string{"gzip"}, "*", "gzip"},
+		{[]string{"gzip"}, "gzip;q=0, *", ""},
+		{[]string{"gzip"}, "", ""},
+	}
+	for _, tt := range tests {
+		cc := &CompressionConfig{Algorithms: tt.algorithms}
+		if got := cc.negotiate(tt.acceptEncoding); got != tt.want {
+			t.Errorf("%v with Accept-Encoding %q: got %q, want %q", tt.algorithms, tt.acceptEncoding, got, tt.want)
+		}
+	}
+}
+
+func TestCompressionRejectsBrotli(t *testing.T) {
+	cc := &CompressionConfig{Algorithms: []string{"br", "gzip"}}
+	cc.setDefaults()
+	if err := cc.compile(); err == nil {
+		t.Fatal("br accepted with no encoder for it")
+	}
+}
+
+// compressionPayload is a JSON array of about 115KB, like a model listing.
+func compressionPayload(b *testing.B) []byte {
+	type model struct {
+		ID      string   `json:"id"`
+		Owner   string   `json:"owned_by"`
+		Created int      `json:"created"`
+		Tags    []string `json:"tags"`
+		Score   float64  `json:"score"`
+	}
+	models := make([]model, 850)
+	for i := range models {
+		models[i] = model{
+			ID:      fmt.Sprintf("model-%04d-preview", i),
+			Owner:   fmt.Sprintf("org-%d", i%17),
+			Created: 1700000000 + i*3571,
+			Tags:    []string{"chat", "completion", fmt.Sprintf("tier-%d", i%4)},
+			Score:   float64(i%97) / 97,
+		}
+	}
+	data, err := json.Marshal(models)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return data
+}
+
+// BenchmarkCompression trades CPU for ratio across algorithms and levels;
+// MB/s is the uncompressed throughput on one core.
+func BenchmarkCompression(b *testing.B) {
+	payload := compressionPayload(b)
+	for _, alg := range []string{"gzip", "deflate"} {
+		for _, level := range []int{1, 4, 6, 9} {
+			b.Run(fmt.Sprintf("%s/level-%d", alg, level), func(b *testing.B) {
+				cc := &CompressionConfig{Algorithms: []string{alg}, Level: level}
+				cc.setDefaults()
+				if err := cc.compile(); err != nil {
+					b.Fatal(err)
+				}
+				zw := cc.pools[alg].Get().(resetWriteCloser)
+				var out bytes.Buffer
+
+				b.SetBytes(int64(len(payload)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					out.Reset()
+					zw.Reset(&out)
+					zw.Write(payload)
+					zw.Close()
+				}
+				b.ReportMetric(float64(len(payload))/float64(out.Len()), "ratio")
+				zw.Reset(io.Discard)
+			})
+		}
+	}
+}
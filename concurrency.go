@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+type ConcurrencyConfig struct {
+	Max               int           `yaml:"max"`
+	SaturationWarning float64       `yaml:"saturation_warning"` // fraction of max, default 0.8
+	RetryAfter        time.Duration `yaml:"retry_after"`
+	Queue             *QueueConfig  `yaml:"queue,omitempty"`
+}
+
+func (cc *ConcurrencyConfig) setDefaults() {
+	if cc.SaturationWarning == 0 {
+		cc.SaturationWarning = 0.8
+	}
+	if cc.RetryAfter == 0 {
+		cc.RetryAfter = time.Second
+	}
+	if cc.Queue != nil && cc.Queue.Timeout == 0 {
+		cc.Queue.Timeout = time.Second
+	}
+}
+
+func (cc *ConcurrencyConfig) validate() error {
+	if cc.Queue == nil {
+		return nil
+	}
+	if cc.Max <= 0 {
+		return fmt.Errorf("queue requires max")
+	}
+	if cc.Queue.Size < 0 {
+		return fmt.Errorf("queue size must not be negative")
+	}
+	return nil
+}
+
+// Buckets for gateway_concurrency_queue_wait_seconds
+var queueWaitBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// concurrencyLimiter tracks a service's in-flight requests and, with a
+// configured max, rejects requests beyond it, or queues them first if there
+// is a queue. Every service has one so in-flight counts are reported even
+// when unlimited.
+type concurrencyLimiter struct {
+	service  string
+	cfg      *ConcurrencyConfig
+	inFlight atomic.Int64
+	warned   atomic.Bool
+
+	// With a queue: one slot per running request, and waiters blocked on
+	// them in arrival order
+	slots         chan struct{}
+	queued        atomic.Int64
+	queueFull     atomic.Uint64
+	queueTimeouts atomic.Uint64
+	dequeued      atomic.Uint64
+	waited        atomic.Int64 // nanoseconds, summed over dequeued requests
+	waits         *histogramVec
+}
+
+func newConcurrencyLimiter(service string, cfg *ConcurrencyConfig) (*concurrencyLimiter, error) {
+	cl := &concurrencyLimiter{service: service, cfg: cfg}
+	if cfg == nil {
+		return cl, nil
+	}
+	cfg.setDefaults()
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	if cfg.Queue != nil && cfg.Queue.Size > 0 {
+		cl.slots = make(chan struct{}, cfg.Max)
+	}
+	return cl, nil
+}
+
+func (cl *concurrencyLimiter) limited() bool {
+	return cl.cfg != nil && cl.cfg.Max > 0
+}
+
+// acquire admits a request, waiting in the queue if there is one. A
+// rejected request gets the overload to report; success must be paired with
+// release.
+func (cl *concurrencyLimiter) acquire(ctx context.Context) (bool, overload) {
+	if !cl.limited() {
+		cl.inFlight.Add(1)
+		return true, overload{}
+	}
+	if cl.slots == nil {
+		if cl.inFlight.Add(1) > int64(cl.cfg.Max) {
+			cl.inFlight.Add(-1)
+			return false, cl.overload("concurrency")
+		}
+		cl.admitted()
+		return true, overload{}
+	}
+
+	select {
+	case cl.slots <- struct{}{}:
+		cl.inFlight.Add(1)
+		cl.admitted()
+		return true, overload{}
+	default:
+	}
+	if cl.queued.Add(1) > int64(cl.cfg.Queue.Size) {
+		cl.queued.Add(-1)
+		cl.queueFull.Add(1)
+		return false, cl.overload("concurrency")
+	}
+	defer cl.queued.Add(-1)
+
+	start := time.Now()
+	timer := time.NewTimer(cl.cfg.Queue.Timeout)
+	defer timer.Stop()
+	select {
+	case cl.slots <- struct{}{}:
+		cl.inFlight.Add(1)
+		wait := time.Since(start)
+		cl.dequeued.Add(1)
+		cl.waited.Add(int64(wait))
+		if cl.waits != nil {
+			cl.waits.observe(cl.service, wait.Seconds())
+		}
+		cl.admitted()
+		return true, overload{}
+	case <-timer.C:
+		cl.queueTimeouts.Add(1)
+		return false, cl.overload("queue_timeout")
+	case <-ctx.Done():
+		return false, cl.overload("client_gone")
+	}
+}
+
+// admitted warns once when a request takes the service past its
+// saturation_warning.
+func (cl *concurrencyLimiter) admitted() {
+	if cl.saturation() >= cl.cfg.SaturationWarning && cl.warned.CompareAndSwap(false, true) {
+		log.Printf("[%s] warning: saturation %.0f%% (%d/%d in flight)", cl.service, cl.saturation()*100, cl.inFlight.Load(), cl.cfg.Max)
+	}
+}
+
+func (cl *concurrencyLimiter) release() {
+	cl.inFlight.Add(-1)
+	if cl.slots != nil {
+		<-cl.slots
+	}
+	if cl.limited() && cl.saturation() < cl.cfg.SaturationWarning {
+		cl.warned.Store(false)
+	}
+}
+
+// overload describes a rejection by acquire.
+func (cl *concurrencyLimiter) overload(reason string) overload {
+	return overload{reason: reason, retryAfter: cl.cfg.RetryAfter, capacity: int64(cl.cfg.Max), inFlight: cl.inFlight.Load()}
+}
+
+// saturation is the share of the service's capacity currently in use.
+func (cl *concurrencyLimiter) saturation() float64 {
+	if !cl.limited() {
+		return 0
+	}
+	return float64(cl.inFlight.Load()) / float64(cl.cfg.Max)
+}
+
+func (c *Config) inFlightGauges() []collector {
+	inFlight := func() map[string]float64 {
+		values := make(map[string]float64, len(c.Services))
+		for name, svc := range c.Services {
+			values[name] = float64(svc.concurrency.inFlight.Load())
+		}
+		return values
+	}
+	saturation := func() map[string]float64 {
+		values := make(map[string]float64)
+		for name, svc := range c.Services {
+			if svc.concurrency.limited() {
+				values[name] = svc.concurrency.saturation()
+			}
+		}
+		return values
+	}
+	return []collector{
+		&funcMetric{name: "gateway_requests_in_flight", help: "Requests currently being proxied.", label: "service", values: inFlight},
+		&funcMetric{name: "gateway_saturation", help: "In-flight requests as a fraction of concurrency.max.", label: "service", values: saturation},
+	}
+}
+
+// queueMetrics reports the concurrency queues of the services that have
+// one. Time spent waiting is observed into waits.
+func (c *Config) queueMetrics(waits *histogramVec) []collector {
+	metric := func(name, help, typ string, get func(*concurrencyLimiter) float64) collector {
+		return &funcMetric{name: name, help: help, label: "service", typ: typ, values: func() map[string]float64 {
+			values := make(map[string]float64)
+			for svcName, svc := range c.Services {
+				if svc.concurrency.slots != nil {
+					values[svcName] = get(svc.concurrency)
+				}
+			}
+			return values
+		}}
+	}
+	for _, svc := range c.Services {
+		if svc.concurrency.slots != nil {
+			svc.concurrency.waits = waits
+		}
+	}
+	return []collector{
+		waits,
+		metric("gateway_concurrency_queue_depth", "Requests waiting for a concurrency slot.", "", func(cl *concurrencyLimiter) float64 { return float64(cl.queued.Load()) }),
+		metric("gateway_concurrency_queue_full_total", "Requests rejected because the concurrency queue was full.", "counter", func(cl *concurrencyLimiter) float64 { return float64(cl.queueFull.Load()) }),
+		metric("gateway_concurrency_queue_timeouts_total", "Requests rejected after waiting queue.timeout for a slot.", "counter", func(cl *concurrencyLimiter) float64 { return float64(cl.queueTimeouts.Load()) }),
+	}
+}
+
+type serviceStats struct {
+	InFlight      int64       `json:"in_flight"`
+	MaxConcurrent int         `json:"max_concurrent,omitempty"`
+	Saturation    float64     `json:"saturation,omitempty"`
+	Queue         *queueStats `json:"queue,omitempty"`
+}
+
+type queueStats struct {
+	Depth      int64   `json:"depth"`
+	Size       int     `json:"size"`
+	Full       uint64  `json:"rejected_full"`
+	Timeouts   uint64  `json:"rejected_timeout"`
+	Dequeued   uint64  `json:"dequeued"`
+	MeanWaitMS float64 `json:"mean_wait_ms"`
+}
+
+func (cl *concurrencyLimiter) queueStats() *queueStats {
+	if cl.slots == nil {
+		return nil
+	}
+	qs := &queueStats{
+		Depth:    cl.queued.Load(),
+		Size:     cl.cfg.Queue.Size,
+		Full:     cl.queueFull.Load(),
+		Timeouts: cl.queueTimeouts.Load(),
+		Dequeued: cl.dequeued.Load(),
+	}
+	if qs.Dequeued > 0 {
+		qs.MeanWaitMS = float64(cl.waited.Load()) / float64(qs.Dequeued) / float64(time.Millisecond)
+	}
+	return qs
+}
+
+func (c *Config) statsHandler(w http.ResponseWriter, r *http.Request) {
+	stats := make(map[string]serviceStats, len(c.Services))
+	for name, svc := range c.Services {
+		s := serviceStats{InFlight: svc.concurrency.inFlight.Load()}
+		if svc.concurrency.limited() {
+			s.MaxConcurrent = svc.Concurrency.Max
+			s.Saturation = svc.concurrency.saturation()
+			s.Queue = svc.concurrency.queueStats()
+		}
+		stats[name] = s
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"services": stats})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type connInfoKey struct{}
+
+var connCounter atomic.Uint64
+
+// connInfo describes the client connection a request arrived on, so
+// requests can be tied to their connection when debugging TLS negotiation.
+type connInfo struct {
+	ID         uint64
+	RemoteAddr string
+	Accepted   time.Time
+	TLSVersion string
+	TLSCipher  string
+	ALPN       string
+	ServerName string
+	requests   *atomic.Uint64 // shared by all copies for the connection
+}
+
+type KeepaliveConfig struct {
+	MaxRequests uint64 `yaml:"max_requests"`
+}
+
+// limitRequests asks the client to reconnect once its connection has served
+// max_requests, so long-lived connections get spread over gateway instances
+// again. On HTTP/2 this makes the server send GOAWAY.
+func (ck *KeepaliveConfig) limitRequests(w http.ResponseWriter, r *http.Request) {
+	ci, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok || ck.MaxRequests == 0 {
+		return
+	}
+	if ci.requests.Add(1) >= ck.MaxRequests {
+		w.Header().Set("Connection", "close")
+	}
+}
+
+// connContext is the server's ConnContext hook. The handshake hasn't
+// happened yet at this point, so TLS details are added per request.
+func connContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connInfoKey{}, &connInfo{
+		ID:         connCounter.Add(1),
+		RemoteAddr: c.RemoteAddr().String(),
+		Accepted:   time.Now(),
+		requests:   new(atomic.Uint64),
+	})
+}
+
+func requestConnInfo(r *http.Request) *connInfo {
+	var info connInfo
+	if ci, ok := r.Context().Value(connInfoKey{}).(*connInfo); ok {
+		info = *ci
+	}
+	if r.TLS != nil {
+		info.TLSVersion = tls.VersionName(r.TLS.Version)
+		info.TLSCipher = tls.CipherSuiteName(r.TLS.CipherSuite)
+		info.ALPN = r.TLS.NegotiatedProtocol
+		info.ServerName = r.TLS.ServerName
+	}
+	return &info
+}
+
+// String formats the connection as key=value pairs for log lines.
+func (ci *connInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, " conn=%d conn_age=%s", ci.ID, time.Since(ci.Accepted).Round(time.Millisecond))
+	if ci.TLSVersion != "" {
+		fmt.Fprintf(&b, " tls=%s cipher=%s", strings.TrimPrefix(ci.TLSVersion, "TLS "), ci.TLSCipher)
+	}
+	if ci.ALPN != "" {
+		fmt.Fprintf(&b, " alpn=%s", ci.ALPN)
+	}
+	if ci.ServerName != "" {
+		fmt.Fprintf(&b, " sni=%s", ci.ServerName)
+	}
+	return b.String()
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type LimitsConfig struct {
+	NewConnsPerSec float64 `yaml:"new_conns_per_sec"`
+	NewConnsBurst  int     `yaml:"new_conns_burst"`
+	OnConnLimit    string  `yaml:"on_conn_limit"` // delay (default), drop
+
+	DrainRejectedBody byteSize `yaml:"drain_rejected_body,omitempty"` // see settleRequestBody
+
+	MaxConcurrent int          `yaml:"max_concurrent,omitempty"` // across all services
+	Queue         *QueueConfig `yaml:"queue,omitempty"`
+}
+
+// throttledListener limits the rate at which new connections are accepted
+// using a token bucket. Excess connections are either held back (leaving
+// later ones queued in the kernel backlog) or closed immediately.
+type throttledListener struct {
+	net.Listener
+	rate  float64
+	burst float64
+	drop  bool
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+
+	throttled int64
+}
+
+func newThrottledListener(ln net.Listener, lc *LimitsConfig) *throttledListener {
+	burst := float64(lc.NewConnsBurst)
+	if burst == 0 {
+		burst = math.Max(1, lc.NewConnsPerSec)
+	}
+
+	tl := &throttledListener{
+		Listener: ln,
+		rate:     lc.NewConnsPerSec,
+		burst:    burst,
+		drop:     lc.OnConnLimit == "drop",
+		tokens:   burst,
+		last:     time.Now(),
+	}
+	go tl.report()
+	return tl
+}
+
+func (tl *throttledListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := tl.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		wait, ok := tl.reserve()
+		if wait == 0 {
+			return conn, nil
+		}
+		atomic.AddInt64(&tl.throttled, 1)
+
+		if !ok {
+			conn.Close()
+			continue
+		}
+		time.Sleep(wait)
+		return conn, nil
+	}
+}
+
+// reserve takes a token, returning how long the caller must wait for it.
+// In drop mode no debt is taken on and ok is false when no token is free.
+func (tl *throttledListener) reserve() (wait time.Duration, ok bool) {
+	tl.mu.Lock()
+	defer tl.mu.Unlock()
+
+	now := time.Now()
+	tl.tokens = math.Min(tl.burst, tl.tokens+now.Sub(tl.last).Seconds()*tl.rate)
+	tl.last = now
+
+	if tl.tokens >= 1 {
+		tl.tokens--
+		return 0, true
+	}
+	if tl.drop {
+		return -1, false
+	}
+
+	wait = time.Duration((1 - tl.tokens) / tl.rate * float64(time.Second))
+	tl.tokens--
+	return wait, true
+}
+
+// report logs throttling periodically rather than per connection, which
+// would flood the log during exactly the floods this guards against.
+func (tl *throttledListener) report() {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if n := atomic.SwapInt64(&tl.throttled, 0); n > 0 {
+			action := "delayed"
+			if tl.drop {
+				action = "dropped"
+			}
+			log.Printf("[limits] %s %d new connections over the last 10s (limit %g/s)", action, n, tl.rate)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const rejectedBodyConfig = `
+limits:
+  drain_rejected_body: 64KB
+services:
+  api:
+    target: "{{target}}"
+    rate_limit: {requests_per_minute: 0}
+`
+
+// postRaw writes a POST with a body of size bytes on conn, in the
+// background if the gateway may answer before reading it all, and returns
+// the response.
+func postRaw(t *testing.T, conn net.Conn, br *bufio.Reader, size int, header string) *http.Response {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST /api/upload HTTP/1.1\r\nHost: gateway\r\nContent-Length: %d\r\n%s\r\n", size, header)
+	if header == "" {
+		go conn.Write(make([]byte, size))
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestRejectedRequestBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		header    string
+		wantClose bool
+	}{
+		{"small body drained, connection reused", 16 << 10, "", false},
+		{"large body, connection closed", 4 << 20, "", true},
+		{"expect continue, body never sent", 4 << 20, "Expect: 100-continue\r\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := newTestBackend(t, http.StatusOK)
+			gw := httptest.NewServer(loadTestConfig(t, rejectedBodyConfig, map[string]string{"target": backend.URL}).handler())
+			defer gw.Close()
+			conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+
+			resp := postRaw(t, conn, br, tt.size, tt.header)
+			if resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("status %d, want 429", resp.StatusCode)
+			}
+			if resp.Close != tt.wantClose {
+				t.Fatalf("connection closed %t, want %t", resp.Close, tt.wantClose)
+			}
+			if backend.hits.Load() != 0 {
+				t.Fatal("rejected request reached the backend")
+			}
+
+			if tt.wantClose {
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				if _, err := io.Copy(io.Discard, br); err != nil && !strings.Contains(err.Error(), "reset") {
+					t.Fatalf("connection left open: %v", err)
+				}
+				return
+			}
+			if resp := postRaw(t, conn, br, tt.size, ""); resp.StatusCode != http.StatusTooManyRequests {
+				t.Fatalf("second request on the connection: status %d, want 429", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestSettleRequestBody(t *testing.T) {
+	tests := []struct {
+		name      string
+		size      int
+		expect    bool
+		wantRead  int64
+		wantClose bool
+	}{
+		{"under the limit", 1000, false, 1000, false},
+		{"at the limit", 4096, false, 4096, false},
+		{"over the limit", 10000, false, 4097, true},
+		{"expect continue", 1000, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cr := &countingReader{ReadCloser: io.NopCloser(strings.NewReader(strings.Repeat("x", tt.size)))}
+			r := httptest.NewRequest(http.MethodPost, "/api/upload", cr)
+			r.ContentLength = int64(tt.size)
+			if tt.expect {
+				r.Header.Set("Expect", "100-continue")
+			}
+			w := httptest.NewRecorder()
+			settleRequestBody(w, r, 4096)
+			if cr.n != tt.wantRead {
+				t.Fatalf("read %d bytes, want %d", cr.n, tt.wantRead)
+			}
+			if closed := w.Header().Get("Connection") == "close"; closed != tt.wantClose {
+				t.Fatalf("Connection: close %t, want %t", closed, tt.wantClose)
+			}
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type PropagateDeadlineConfig struct {
+	Header string `yaml:"header"`
+}
+
+// setDeadlineHeader tells the upstream how many milliseconds remain before
+// the gateway gives up on the request, so it can abandon doomed work.
+func (pd *PropagateDeadlineConfig) setDeadlineHeader(req *http.Request) {
+	deadline, ok := requestDeadline(req)
+	if !ok {
+		return
+	}
+
+	remaining := time.Until(deadline).Milliseconds()
+	if remaining < 0 {
+		remaining = 0
+	}
+	req.Header.Set(pd.Header, strconv.FormatInt(remaining, 10))
+}
+
+// Headers deadline_headers can set, each in the format its name implies
+var deadlineHeaderFormats = map[string]func(remaining time.Duration, deadline time.Time) string{
+	// gRPC allows at most eight digits, so the unit grows with the timeout
+	"grpc-timeout": func(remaining time.Duration, _ time.Time) string {
+		for _, u := range []struct {
+			unit string
+			d    time.Duration
+		}{{"m", time.Millisecond}, {"S", time.Second}, {"M", time.Minute}} {
+			if n := remaining / u.d; n < 1e8 {
+				return strconv.FormatInt(int64(n), 10) + u.unit
+			}
+		}
+		return strconv.FormatInt(int64(remaining/time.Hour), 10) + "H"
+	},
+	"x-request-timeout": func(remaining time.Duration, _ time.Time) string {
+		return strconv.FormatInt(remaining.Milliseconds(), 10)
+	},
+	"x-envoy-expected-rq-timeout-ms": func(remaining time.Duration, _ time.Time) string {
+		return strconv.FormatInt(remaining.Milliseconds(), 10)
+	},
+	"x-request-deadline-unix": func(_ time.Duration, deadline time.Time) string {
+		return strconv.FormatInt(deadline.UnixMilli(), 10)
+	},
+}
+
+func (svc *Service) compileDeadlineHeaders() error {
+	for i, h := range svc.DeadlineHeaders {
+		h = strings.ToLower(h)
+		if deadlineHeaderFormats[h] == nil {
+			return fmt.Errorf("unknown header %q", h)
+		}
+		svc.DeadlineHeaders[i] = h
+	}
+	return nil
+}
+
+// setDeadlineHeaders sends the remaining deadline in each of the service's
+// deadline_headers, for backends that each understand a different one.
+func (svc *Service) setDeadlineHeaders(req *http.Request) {
+	deadline, ok := requestDeadline(req)
+	if !ok {
+		return
+	}
+	remaining := max(time.Until(deadline), 0)
+	for _, h := range svc.DeadlineHeaders {
+		req.Header.Set(h, deadlineHeaderFormats[h](remaining, deadline))
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DecompressionConfig bounds how far the gateway inflates the upstream
+// bodies it decodes for inspection (rewrite_urls, response schemas, mirror
+// comparisons), so a small compressed payload can't expand to exhaust
+// memory. Either limit may be left out.
+type DecompressionConfig struct {
+	MaxRatio float64  `yaml:"max_ratio,omitempty"` // decoded size over compressed size
+	MaxBytes byteSize `yaml:"max_bytes,omitempty"`
+}
+
+var (
+	errDecompressionBomb = errors.New("decompressed body exceeds decompression limits")
+	errDecodedTooLarge   = errors.New("decompressed body too large to inspect")
+)
+
+func (dc *DecompressionConfig) validate() error {
+	if dc.MaxRatio != 0 && dc.MaxRatio < 1 {
+		return fmt.Errorf("max_ratio must be at least 1")
+	}
+	if dc.MaxBytes < 0 {
+		return fmt.Errorf("max_bytes must not be negative")
+	}
+	return nil
+}
+
+// bound returns the most a body of compressed bytes may decode to, or -1.
+func (dc *DecompressionConfig) bound(compressed int) int64 {
+	if dc == nil {
+		return -1
+	}
+	n := int64(-1)
+	if dc.MaxBytes > 0 {
+		n = int64(dc.MaxBytes)
+	}
+	if dc.MaxRatio > 0 {
+		byRatio := int64(float64(compressed) * dc.MaxRatio)
+		if n < 0 || byRatio < n {
+			n = byRatio
+		}
+	}
+	return n
+}
+
+// gunzip decodes raw, reading at most limit bytes of output. Going past the
+// decompression limits is errDecompressionBomb; going past limit alone is
+// errDecodedTooLarge, and callers pass the original body on. On other read
+// errors, such as a truncated body, what was decoded is returned with the
+// error.
+func (dc *DecompressionConfig) gunzip(raw []byte, limit int64) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	n := limit
+	bound := dc.bound(len(raw))
+	if bound >= 0 && bound < n {
+		n = bound
+	}
+	body, err := io.ReadAll(io.LimitReader(zr, n+1))
+	if int64(len(body)) > n {
+		if n == bound {
+			return nil, fmt.Errorf("%w: %d compressed bytes", errDecompressionBomb, len(raw))
+		}
+		return nil, errDecodedTooLarge
+	}
+	return body, err
+}
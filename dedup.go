@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// DedupConfig answers repeats of an identical request (same caller, method,
+// URL and body) within window with the first one's response, for clients
+// that double-submit without sending an Idempotency-Key.
+type DedupConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	Window       time.Duration `yaml:"window"`
+	MaxBodyBytes byteSize      `yaml:"max_body_bytes"`
+}
+
+func (dc *DedupConfig) setDefaults() {
+	if dc.Window == 0 {
+		dc.Window = 10 * time.Second
+	}
+	if dc.MaxBodyBytes == 0 {
+		dc.MaxBodyBytes = 1 << 20
+	}
+}
+
+// beginDedup runs r through the dedup store. Requests with an
+// Idempotency-Key are left to idempotency when that is enabled.
+func (svc *Service) beginDedup(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	if safeMethod(r.Method) || svc.idempotency != nil && r.Header.Get("Idempotency-Key") != "" {
+		return w, func() {}
+	}
+
+	body, ok := svc.dedup.peekBody(r)
+	if !ok {
+		return w, func() {}
+	}
+	fp := requestFingerprint(r, body)
+	return svc.dedup.begin(w, r, credentialKey(r, string(fp[:])), fp)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultsConfig holds settings that every service inherits unless it sets
+// its own.
+type DefaultsConfig struct {
+	Timeout     TimeoutConfig    `yaml:"timeout,omitempty"`
+	Retry       *RetryConfig     `yaml:"retry,omitempty"`
+	RateLimit   *RateLimitConfig `yaml:"rate_limit,omitempty"`
+	MaxBodySize byteSize         `yaml:"max_body_size,omitempty"`
+	MaxBuffered byteSize         `yaml:"max_buffered_response,omitempty"`
+	Transport   *TransportConfig `yaml:"transport,omitempty"`
+}
+
+// applyTo fills the service's unset fields. Blocks are copied so per-service
+// defaulting doesn't leak between services.
+func (d *DefaultsConfig) applyTo(svc *Service) {
+	svc.Timeout.merge(d.Timeout)
+	if svc.Retry == nil && d.Retry != nil {
+		retry := *d.Retry
+		svc.Retry = &retry
+	}
+	if svc.RateLimit == nil && d.RateLimit != nil {
+		rateLimit := *d.RateLimit
+		svc.RateLimit = &rateLimit
+	}
+	if svc.MaxBodySize == 0 {
+		svc.MaxBodySize = d.MaxBodySize
+	}
+	if svc.MaxBufferedResponse == 0 {
+		svc.MaxBufferedResponse = d.MaxBuffered
+	}
+	if svc.Transport == nil && d.Transport != nil {
+		transport := *d.Transport
+		svc.Transport = &transport
+	}
+}
+
+// byteSize is a size in bytes that can be written as a plain number or with
+// a KB/MB/GB suffix (powers of 1024).
+type byteSize int64
+
+func (b *byteSize) UnmarshalYAML(node *yaml.Node) error {
+	n, err := parseByteSize(node.Value)
+	if err != nil {
+		return fmt.Errorf("invalid size %q", node.Value)
+	}
+	*b = byteSize(n)
+	return nil
+}
+
+func parseByteSize(s string) (int64, error) {
+	s = strings.ToUpper(strings.TrimSpace(s))
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix string
+		size   int64
+	}{{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10}, {"B", 1}} {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.size
+			break
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("negative size")
+	}
+	return n * multiplier, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const defaultsConfig = `
+defaults:
+  timeout: {connect: 2s, total: 30s}
+  max_body_size: 10MB
+  rate_limit: {requests_per_minute: 600}
+  retry: {attempts: 2, backoff: 10ms}
+services:
+  plain:
+    target: "http://localhost:5000"
+  batch:
+    target: "http://localhost:5001"
+    timeout: 5m
+    max_body_size: 1GB
+  streaming:
+    target: "http://localhost:5002"
+    timeout: {response_header: 10s}
+    retry: {attempts: 5}
+    rate_limit: {requests_per_minute: 60}
+`
+
+func TestDefaultsPrecedence(t *testing.T) {
+	cfg := loadTestConfig(t, defaultsConfig, nil)
+	tests := []struct {
+		service     string
+		timeout     TimeoutConfig
+		maxBodySize byteSize
+		attempts    int
+		backoff     time.Duration
+		rpm         int
+	}{
+		// Inherits everything
+		{"plain", TimeoutConfig{Connect: 2 * time.Second, Total: 30 * time.Second}, 10 << 20, 2, 10 * time.Millisecond, 600},
+		// The shorthand sets only total; connect is still inherited
+		{"batch", TimeoutConfig{Connect: 2 * time.Second, Total: 5 * time.Minute}, 1 << 30, 2, 10 * time.Millisecond, 600},
+		// Blocks replace the default as a whole: backoff is retry's own default
+		{"streaming", TimeoutConfig{Connect: 2 * time.Second, ResponseHeader: 10 * time.Second, Total: 30 * time.Second}, 10 << 20, 5, 100 * time.Millisecond, 60},
+	}
+	for _, tt := range tests {
+		svc := cfg.Services[tt.service]
+		if svc.Timeout != tt.timeout {
+			t.Errorf("%s: timeout %+v, want %+v", tt.service, svc.Timeout, tt.timeout)
+		}
+		if svc.MaxBodySize != tt.maxBodySize {
+			t.Errorf("%s: max_body_size %d, want %d", tt.service, svc.MaxBodySize, tt.maxBodySize)
+		}
+		if svc.Retry.Attempts != tt.attempts || svc.Retry.Backoff != tt.backoff {
+			t.Errorf("%s: retry %d attempts, backoff %v, want %d, %v", tt.service, svc.Retry.Attempts, svc.Retry.Backoff, tt.attempts, tt.backoff)
+		}
+		if svc.RateLimit.RequestsPerMinute != tt.rpm {
+			t.Errorf("%s: %d requests per minute, want %d", tt.service, svc.RateLimit.RequestsPerMinute, tt.rpm)
+		}
+	}
+
+	// Services that inherit a block each get their own copy
+	if cfg.Services["plain"].Retry == cfg.Defaults.Retry {
+		t.Error("service shares its retry block with the defaults")
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"512B", 512},
+		{"64KB", 64 << 10},
+		{"10MB", 10 << 20},
+		{" 2 gb ", 2 << 30},
+	}
+	for _, tt := range tests {
+		if got, err := parseByteSize(tt.in); err != nil || got != tt.want {
+			t.Errorf("parseByteSize(%q) = %d, %v, want %d", tt.in, got, err, tt.want)
+		}
+	}
+	for _, in := range []string{"", "MB", "-1KB", "1.5MB", "10 TB"} {
+		if got, err := parseByteSize(in); err == nil {
+			t.Errorf("parseByteSize(%q) = %d, want an error", in, got)
+		}
+	}
+}
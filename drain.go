@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// AdminConfig enables endpoints for orchestrating rolling deploys: an
+// orchestrator puts the replica into drain, waits for its in-flight count to
+// reach zero, then stops it.
+type AdminConfig struct {
+	Path  string `yaml:"path,omitempty"`
+	Token string `yaml:"token"`
+}
+
+func (ac *AdminConfig) setDefaults() {
+	if ac.Path == "" {
+		ac.Path = "/admin"
+	}
+	ac.Path = strings.TrimSuffix(ac.Path, "/")
+	ac.Token = os.ExpandEnv(ac.Token)
+}
+
+func (ac *AdminConfig) validate() error {
+	// Anyone reaching an open drain endpoint could take the replica out
+	if ac.Token == "" {
+		return fmt.Errorf("token is required")
+	}
+	return nil
+}
+
+func (c *Config) registerAdmin() {
+	c.registerReserved(c.Admin.Path+"/inflight", c.adminOnly(c.inFlightHandler))
+	c.registerReserved(c.Admin.Path+"/drain", c.adminOnly(c.drainHandler))
+	c.registerReserved(c.Admin.Path+"/tap", c.adminOnly(c.tapHandler))
+	c.registerReserved(c.Admin.Path+"/maintenance", c.adminOnly(c.maintenanceHandler))
+	c.registerReserved(c.Admin.Path+"/reload", c.adminOnly(c.reloadHandler))
+}
+
+func (c *Config) adminOnly(h http.HandlerFunc) http.Handler {
+	want := []byte("Bearer " + c.Admin.Token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), want) != 1 {
+			c.errors.write(w, r, errUnauthorized)
+			return
+		}
+		h(w, r)
+	})
+}
+
+// enterDrain stops the gateway taking new traffic without cancelling what is
+// in flight: the health endpoint starts failing, and services with
+// shutdown.reject_new turn new requests away.
+func (c *Config) enterDrain(reason string) {
+	if c.draining.CompareAndSwap(false, true) {
+		log.Printf("Draining: %s, %d requests in flight", reason, c.inFlight.Load())
+	}
+}
+
+// inFlightHandler counts requests still running on replaced configs too,
+// since they hold up a shutdown just the same.
+func (c *Config) inFlightHandler(w http.ResponseWriter, r *http.Request) {
+	services := make(map[string]int64, len(c.Services))
+	var inFlight int64
+	for _, live := range c.liveConfigs() {
+		for name, svc := range live.Services {
+			services[name] += svc.concurrency.inFlight.Load()
+		}
+		inFlight += live.inFlight.Load()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(map[string]any{
+		"draining":  c.draining.Load(),
+		"in_flight": inFlight,
+		"services":  services,
+	})
+}
+
+func (c *Config) drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c.enterDrain("requested by " + remoteIP(r))
+	c.inFlightHandler(w, r)
+}
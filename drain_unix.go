@@ -0,0 +1,11 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SIGUSR1 puts the gateway into drain, like POST /admin/drain.
+var drainSignals = []os.Signal{syscall.SIGUSR1}
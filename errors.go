@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// gatewayError is one entry in the taxonomy of errors the gateway itself
+// generates, as opposed to error responses passed through from upstreams.
+// Codes are stable; clients may match on them.
+type gatewayError struct {
+	code    string
+	status  int
+	message string
+}
+
+func (e *gatewayError) Error() string {
+	return e.code + " " + e.message
+}
+
+var (
+	errServiceNotFound     = &gatewayError{"GW001", http.StatusNotFound, "Service not found"}
+	errUnauthorized        = &gatewayError{"GW002", http.StatusUnauthorized, "Unauthorized"}
+	errRateLimited         = &gatewayError{"GW003", http.StatusTooManyRequests, "Rate limit exceeded"}
+	errWAFBlocked          = &gatewayError{"GW004", http.StatusForbidden, "Forbidden"}
+	errPathDenied          = &gatewayError{"GW005", http.StatusForbidden, "Forbidden"}
+	errPathNotAllowed      = &gatewayError{"GW006", http.StatusNotFound, "Not Found"}
+	errBadPath             = &gatewayError{"GW007", http.StatusBadRequest, "Bad Request"}
+	errServiceNotSpecified = &gatewayError{"GW008", http.StatusBadRequest, "Service not specified"}
+	errBodyTooLarge        = &gatewayError{"GW009", http.StatusRequestEntityTooLarge, "Request body too large"}
+	errAtCapacity          = &gatewayError{"GW010", http.StatusServiceUnavailable, "Service at capacity"}
+	errShuttingDown        = &gatewayError{"GW011", http.StatusServiceUnavailable, "Service shutting down"}
+	errUpstreamBusy        = &gatewayError{"GW012", http.StatusServiceUnavailable, "Service Unavailable"}
+	errUpstreamTimeout     = &gatewayError{"GW013", http.StatusGatewayTimeout, "Gateway Timeout"}
+	errBadGateway          = &gatewayError{"GW014", http.StatusBadGateway, "Bad Gateway"}
+
+	errIdempotencyMismatch    = &gatewayError{"GW015", http.StatusUnprocessableEntity, "Idempotency-Key reused for a different request"}
+	errIdempotencyUnavailable = &gatewayError{"GW016", http.StatusConflict, "Idempotent response not available"}
+	errHostNotAllowed         = &gatewayError{"GW017", http.StatusBadRequest, "Host not allowed"}
+	errExtAuthzDenied         = &gatewayError{"GW018", http.StatusForbidden, "Denied by authorization service"}
+	errExtAuthzUnavailable    = &gatewayError{"GW019", http.StatusServiceUnavailable, "Authorization service unavailable"}
+	errSchemaViolation        = &gatewayError{"GW020", http.StatusBadRequest, "Request body does not match schema"}
+	errOriginNotAllowed       = &gatewayError{"GW021", http.StatusForbidden, "Origin not allowed"}
+	errMemoryPressure         = &gatewayError{"GW022", http.StatusServiceUnavailable, "Gateway under memory pressure"}
+	errMaintenance            = &gatewayError{"GW023", http.StatusServiceUnavailable, "Service under maintenance"}
+	errGatewayAtCapacity      = &gatewayError{"GW024", http.StatusServiceUnavailable, "Gateway at capacity"}
+	errInvalidRequestID       = &gatewayError{"GW025", http.StatusBadRequest, "Invalid request ID"}
+	errInsufficientScope      = &gatewayError{"GW026", http.StatusForbidden, "Insufficient scope"}
+	errServiceStarting        = &gatewayError{"GW027", http.StatusServiceUnavailable, "Service starting"}
+	errBadBody                = &gatewayError{"GW028", http.StatusBadRequest, "Request body could not be converted"}
+)
+
+// errorWriter formats gateway errors. Every error response carries its code
+// in X-Gateway-Error, whatever the body format.
+type errorWriter struct {
+	json             bool
+	includeRequestID bool
+	drainBody        int64 // see settleRequestBody
+}
+
+type errorBody struct {
+	Error     string `json:"error"`
+	Code      string `json:"code"`
+	Status    int    `json:"status"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// write logs a request rejected by the gateway and sends the error.
+func (ew *errorWriter) write(w http.ResponseWriter, r *http.Request, e *gatewayError) {
+	var id string
+	if rid := requestIDFrom(r.Context()); rid != "" {
+		id = " request_id=" + rid
+	}
+	log.Printf("[gateway] %s %s %s %q from %s%s", e.code, e.message, r.Method, r.URL.Path, r.RemoteAddr, id)
+	drain := int64(defaultRejectedBodyDrain)
+	if ew != nil {
+		drain = ew.drainBody
+	}
+	settleRequestBody(w, r, drain)
+	ew.send(w, r, e, e.message)
+}
+
+// overload describes why a request was shed, so clients can back off: the
+// standard backpressure headers are set on every overload 503.
+type overload struct {
+	reason     string // concurrency, gateway_concurrency, queue_timeout, client_gone, upstream_connections, shutting_down, memory_pressure
+	retryAfter time.Duration
+	capacity   int64 // 0 if the limit has no fixed size
+	inFlight   int64
+}
+
+func (o overload) setHeaders(h http.Header) {
+	h.Set("X-Overload-Reason", o.reason)
+	h.Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(o.retryAfter.Seconds())))))
+	if o.capacity > 0 {
+		h.Set("X-Overload-Capacity", strconv.FormatInt(o.capacity, 10))
+		h.Set("X-Overload-In-Flight", strconv.FormatInt(o.inFlight, 10))
+	}
+}
+
+// writeOverload logs and sends an error for a request shed under load.
+func (ew *errorWriter) writeOverload(w http.ResponseWriter, r *http.Request, e *gatewayError, o overload) {
+	o.setHeaders(w.Header())
+	ew.write(w, r, e)
+}
+
+// writeStatus reports a proxy failure, which the caller has already logged.
+// Plain-text errors keep their empty body; JSON errors get the standard body.
+// The request body is left alone: the transport may still hold it.
+func (ew *errorWriter) writeStatus(w http.ResponseWriter, r *http.Request, e *gatewayError) {
+	ew.send(w, r, e, "")
+}
+
+func (ew *errorWriter) send(w http.ResponseWriter, r *http.Request, e *gatewayError, text string) {
+	h := w.Header()
+	h.Set("X-Gateway-Error", e.code)
+
+	if ew == nil || !ew.json {
+		if text == "" {
+			w.WriteHeader(e.status)
+		} else {
+			http.Error(w, text, e.status)
+		}
+		return
+	}
+
+	body := errorBody{Error: e.message, Code: e.code, Status: e.status}
+	if ew.includeRequestID {
+		body.RequestID = requestIDFrom(r.Context())
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.status)
+	json.NewEncoder(w).Encode(body)
+}
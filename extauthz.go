@@ -0,0 +1,225 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ExtAuthzConfig delegates the allow/deny decision to an external service,
+// in the manner of Envoy's HTTP ext_authz: the service receives the request
+// line and headers (no body) under its own URL and answers 2xx to allow.
+// 5xx and 429 answers mean the service itself is failing, and are handled
+// by failure_mode; any other response is relayed to the client as the
+// denial.
+type ExtAuthzConfig struct {
+	URL             string        `yaml:"url"`
+	Timeout         time.Duration `yaml:"timeout,omitempty"`
+	FailureMode     string        `yaml:"failure_mode,omitempty"`     // deny (default), allow
+	UpstreamHeaders []string      `yaml:"upstream_headers,omitempty"` // copied from an allow onto the proxied request
+	CacheTTL        time.Duration `yaml:"cache_ttl,omitempty"`
+	cache           *decisionCache
+}
+
+const maxExtAuthzDenyBody = 64 << 10
+
+var extAuthzClient = &http.Client{
+	// Redirects are answers for the client, not for the gateway
+	CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+}
+
+// Headers of a denial worth passing on to the client
+var extAuthzDenyHeaders = []string{"Content-Type", "WWW-Authenticate", "Location", "Retry-After", "Set-Cookie"}
+
+func (ea *ExtAuthzConfig) setDefaults() {
+	if ea.Timeout == 0 {
+		ea.Timeout = 200 * time.Millisecond
+	}
+	if ea.FailureMode == "" {
+		ea.FailureMode = "deny"
+	}
+}
+
+func (ea *ExtAuthzConfig) validate() error {
+	if !strings.HasPrefix(ea.URL, "http://") && !strings.HasPrefix(ea.URL, "https://") {
+		return fmt.Errorf("url must be an http(s) URL")
+	}
+	switch ea.FailureMode {
+	case "deny", "allow":
+	default:
+		return fmt.Errorf("unknown failure_mode %q", ea.FailureMode)
+	}
+	if ea.CacheTTL > 0 {
+		ea.cache = &decisionCache{entries: make(map[[sha256.Size]byte]*authzDecision)}
+	}
+	return nil
+}
+
+type authzDecision struct {
+	allowed bool
+	status  int
+	header  http.Header // injected upstream if allowed, sent to the client if not
+	body    []byte
+	expires time.Time
+}
+
+// checkExtAuthz asks the authorization service about r. On an allow it
+// injects the returned upstream_headers into r and returns true; otherwise
+// it has written the denial.
+func (svc *Service) checkExtAuthz(w http.ResponseWriter, r *http.Request, path string) bool {
+	ea := svc.ExtAuthz
+	// Clients must not be able to pass these off as coming from the authz service
+	for _, h := range ea.UpstreamHeaders {
+		r.Header.Del(h)
+	}
+
+	key := ea.cacheKey(r, path)
+	d := ea.cache.get(key)
+	if d == nil {
+		var err error
+		if d, err = ea.decide(svc.name, r, path); err != nil {
+			log.Printf("[%s] ext_authz failed: %v%s", svc.name, err, logContextFrom(r.Context()))
+			if ea.FailureMode == "allow" {
+				return true
+			}
+			svc.errors.write(w, r, errExtAuthzUnavailable)
+			return false
+		}
+		ea.cache.add(key, d, ea.CacheTTL)
+	}
+
+	if d.allowed {
+		for k, v := range d.header {
+			r.Header[k] = append([]string(nil), v...)
+		}
+		return true
+	}
+
+	log.Printf("[%s] ext_authz denied %s %q with %d%s", svc.name, r.Method, path, d.status, logContextFrom(r.Context()))
+	settleRequestBody(w, r, svc.errors.drainBody)
+	for k, v := range d.header {
+		w.Header()[k] = append([]string(nil), v...)
+	}
+	w.Header().Set("X-Gateway-Error", errExtAuthzDenied.code)
+	w.WriteHeader(d.status)
+	w.Write(d.body)
+	return false
+}
+
+func (ea *ExtAuthzConfig) decide(service string, r *http.Request, path string) (*authzDecision, error) {
+	ctx, cancel := context.WithTimeout(r.Context(), ea.Timeout)
+	defer cancel()
+
+	target := strings.TrimSuffix(ea.URL, "/") + path
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	req, err := http.NewRequestWithContext(ctx, r.Method, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range []string{"Connection", "Keep-Alive", "Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length", "Expect"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("X-Forwarded-For", remoteIP(r))
+	req.Header.Set("X-Forwarded-Host", r.Host)
+	req.Header.Set("X-Gateway-Service", service)
+
+	resp, err := extAuthzClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return nil, fmt.Errorf("authorization service answered %d", resp.StatusCode)
+	}
+
+	d := &authzDecision{status: resp.StatusCode, header: make(http.Header)}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		d.allowed = true
+		for _, h := range ea.UpstreamHeaders {
+			if v := resp.Header.Values(h); len(v) > 0 {
+				d.header[http.CanonicalHeaderKey(h)] = append([]string(nil), v...)
+			}
+		}
+		return d, nil
+	}
+
+	for _, h := range extAuthzDenyHeaders {
+		if v := resp.Header.Values(h); len(v) > 0 {
+			d.header[h] = append([]string(nil), v...)
+		}
+	}
+	if d.body, err = io.ReadAll(io.LimitReader(resp.Body, maxExtAuthzDenyBody)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// cacheKey identifies what a decision is about: the request and the
+// caller's credentials.
+func (ea *ExtAuthzConfig) cacheKey(r *http.Request, path string) [sha256.Size]byte {
+	if ea.cache == nil {
+		return [sha256.Size]byte{}
+	}
+	h := sha256.New()
+	for _, part := range []string{r.Method, path, r.URL.RawQuery, r.Host, r.Header.Get("Authorization"), r.Header.Get("X-API-Key"), r.Header.Get("Cookie"), r.Header.Get(clientCertFingerprintHeader)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	var key [sha256.Size]byte
+	h.Sum(key[:0])
+	return key
+}
+
+// decisionCache keeps recent authorization decisions. All methods are
+// no-ops on a nil cache.
+type decisionCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]*authzDecision
+}
+
+func (c *decisionCache) get(key [sha256.Size]byte) *authzDecision {
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	d, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(d.expires) {
+		delete(c.entries, key)
+		return nil
+	}
+	return d
+}
+
+func (c *decisionCache) add(key [sha256.Size]byte, d *authzDecision, ttl time.Duration) {
+	if c == nil {
+		return
+	}
+	d.expires = time.Now().Add(ttl)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxAuthCacheEntries {
+		now := time.Now()
+		for k, e := range c.entries {
+			if now.After(e.expires) || len(c.entries) >= maxAuthCacheEntries*9/10 {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = d
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+const extAuthzConfig = `
+services:
+  api:
+    target: "{{target}}"
+    ext_authz:
+      url: "{{authz}}"
+      failure_mode: {{failure_mode}}
+      cache_ttl: 1m
+`
+
+// An authz service that is failing or overloaded triggers failure_mode, and
+// its answers aren't cached as denials.
+func TestExtAuthzServerErrors(t *testing.T) {
+	tests := []struct {
+		name        string
+		authzStatus int
+		failureMode string
+		want        int
+		wantCode    string
+	}{
+		{"503 with failure_mode allow", http.StatusServiceUnavailable, "allow", http.StatusOK, ""},
+		{"500 with failure_mode allow", http.StatusInternalServerError, "allow", http.StatusOK, ""},
+		{"429 with failure_mode allow", http.StatusTooManyRequests, "allow", http.StatusOK, ""},
+		{"503 with failure_mode deny", http.StatusServiceUnavailable, "deny", http.StatusServiceUnavailable, errExtAuthzUnavailable.code},
+		{"403 is a denial", http.StatusForbidden, "allow", http.StatusForbidden, errExtAuthzDenied.code},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status, calls atomic.Int64
+			status.Store(int64(tt.authzStatus))
+			authz := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				w.WriteHeader(int(status.Load()))
+			}))
+			defer authz.Close()
+			backend := newTestBackend(t, http.StatusOK)
+			cfg := loadTestConfig(t, extAuthzConfig, map[string]string{
+				"target": backend.URL, "authz": authz.URL, "failure_mode": tt.failureMode,
+			})
+
+			w := serve(cfg, httptest.NewRequest(http.MethodGet, "/api/items", nil))
+			if w.Code != tt.want || w.Header().Get("X-Gateway-Error") != tt.wantCode {
+				t.Fatalf("status %d %q, want %d %q", w.Code, w.Header().Get("X-Gateway-Error"), tt.want, tt.wantCode)
+			}
+
+			// Once the authz service recovers, the next request is decided
+			// afresh unless the first answer was a real decision
+			status.Store(http.StatusNoContent)
+			w = serve(cfg, httptest.NewRequest(http.MethodGet, "/api/items", nil))
+			wantCalls := int64(2)
+			if tt.authzStatus < 429 {
+				wantCalls = 1
+			}
+			if calls.Load() != wantCalls {
+				t.Fatalf("authz called %d times, want %d", calls.Load(), wantCalls)
+			}
+			if tt.authzStatus >= 429 && w.Code != http.StatusOK {
+				t.Fatalf("after recovery: status %d, want 200", w.Code)
+			}
+		})
+	}
+}
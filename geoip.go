@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// GeoIPConfig points at a MaxMind DB (.mmdb) country or city database, such
+// as GeoLite2-Country. It is only read when configured.
+type GeoIPConfig struct {
+	Database string `yaml:"database"`
+	db       *geoipDB
+}
+
+// geoRoute sends a request for a service with geo_routes to the service
+// mapped to the client's country, or failing that its continent, or the
+// "default" entry. Without any match the original service handles it.
+func (c *Config) geoRoute(name string, svc *Service, r *http.Request) (string, *Service) {
+	target, ok := "", false
+	if region, found := c.GeoIP.db.region(net.ParseIP(remoteIP(r))); found {
+		if target, ok = svc.GeoRoutes[region.country]; !ok {
+			target, ok = svc.GeoRoutes[region.continent]
+		}
+	}
+	if !ok {
+		target, ok = svc.GeoRoutes["DEFAULT"]
+	}
+	if !ok {
+		return name, svc
+	}
+	return target, c.Services[target]
+}
+
+func (c *Config) validateGeoRoutes() error {
+	for name, svc := range c.Services {
+		if len(svc.GeoRoutes) == 0 {
+			continue
+		}
+		if c.GeoIP == nil {
+			return fmt.Errorf("geo_routes for %s requires geoip", name)
+		}
+		routes := make(map[string]string, len(svc.GeoRoutes))
+		for region, service := range svc.GeoRoutes {
+			target, ok := c.Services[service]
+			if !ok {
+				return fmt.Errorf("geo_routes for %s: %s: unknown service %q", name, region, service)
+			}
+			if len(target.GeoRoutes) > 0 {
+				return fmt.Errorf("geo_routes for %s: %s: service %q has geo_routes itself", name, region, service)
+			}
+			routes[strings.ToUpper(region)] = service
+		}
+		svc.GeoRoutes = routes
+	}
+	return nil
+}
+
+type geoRegion struct {
+	country   string
+	continent string
+}
+
+var errMMDBCorrupt = errors.New("corrupt maxmind database")
+
+var mmdbMetadataMarker = []byte("\xab\xcd\xefMaxMind.com")
+
+// geoipDB is a minimal reader for the MaxMind DB format: a binary search
+// tree over address bits whose leaves point into a data section of
+// self-describing records.
+type geoipDB struct {
+	tree       []byte
+	data       mmdbDecoder
+	nodeCount  uint
+	recordSize uint
+	ipVersion  uint
+	ipv4Start  uint
+
+	// Records are shared by many networks; country databases only have a
+	// few hundred, so decoded regions are kept by data offset
+	regions sync.Map
+}
+
+func openGeoIPDB(path string) (*geoipDB, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	i := bytes.LastIndex(buf, mmdbMetadataMarker)
+	if i < 0 {
+		return nil, fmt.Errorf("%s: no maxmind metadata", path)
+	}
+	meta, _, err := mmdbDecoder{buf[i+len(mmdbMetadataMarker):]}.decode(0)
+	if err != nil {
+		return nil, err
+	}
+	m, ok := meta.(map[string]any)
+	if !ok {
+		return nil, errMMDBCorrupt
+	}
+	nodeCount, _ := m["node_count"].(uint64)
+	recordSize, _ := m["record_size"].(uint64)
+	ipVersion, _ := m["ip_version"].(uint64)
+
+	switch recordSize {
+	case 24, 28, 32:
+	default:
+		return nil, fmt.Errorf("%s: unsupported record size %d", path, recordSize)
+	}
+	treeSize := nodeCount * recordSize / 4
+	if treeSize+16 > uint64(i) {
+		return nil, errMMDBCorrupt
+	}
+
+	db := &geoipDB{
+		tree:       buf[:treeSize],
+		data:       mmdbDecoder{buf[treeSize+16 : i]},
+		nodeCount:  uint(nodeCount),
+		recordSize: uint(recordSize),
+		ipVersion:  uint(ipVersion),
+	}
+	// IPv4 addresses live under ::/96 in IPv6 databases
+	if db.ipVersion == 6 {
+		for n := 0; n < 96 && db.ipv4Start < db.nodeCount; n++ {
+			db.ipv4Start = db.record(db.ipv4Start, 0)
+		}
+	}
+	return db, nil
+}
+
+func (db *geoipDB) record(node uint, bit byte) uint {
+	switch db.recordSize {
+	case 24:
+		b := db.tree[node*6:]
+		if bit == 0 {
+			return uint(beUint(b[0:3]))
+		}
+		return uint(beUint(b[3:6]))
+	case 28:
+		b := db.tree[node*7:]
+		if bit == 0 {
+			return uint(b[3]&0xf0)<<20 | uint(beUint(b[0:3]))
+		}
+		return uint(b[3]&0x0f)<<24 | uint(beUint(b[4:7]))
+	default:
+		b := db.tree[node*8:]
+		if bit == 0 {
+			return uint(beUint(b[0:4]))
+		}
+		return uint(beUint(b[4:8]))
+	}
+}
+
+// region returns the country and continent codes recorded for ip.
+func (db *geoipDB) region(ip net.IP) (geoRegion, bool) {
+	if ip == nil {
+		return geoRegion{}, false
+	}
+
+	var node uint
+	bits := ip.To4()
+	switch {
+	case bits != nil && db.ipVersion == 6:
+		node = db.ipv4Start
+	case bits == nil && db.ipVersion == 6:
+		bits = ip.To16()
+	case bits == nil:
+		return geoRegion{}, false
+	}
+
+	for i := 0; i < len(bits)*8 && node < db.nodeCount; i++ {
+		node = db.record(node, bits[i/8]>>(7-i%8)&1)
+	}
+	// node_count itself means no data; the 16 after it are the separator
+	// before the data section, which no record may point into
+	if node < db.nodeCount+16 {
+		return geoRegion{}, false
+	}
+	offset := int(node - db.nodeCount - 16)
+
+	if region, ok := db.regions.Load(offset); ok {
+		return region.(geoRegion), true
+	}
+	v, _, err := db.data.decode(offset)
+	if err != nil {
+		return geoRegion{}, false
+	}
+	record, _ := v.(map[string]any)
+	region := geoRegion{
+		country:   mmdbCode(record, "country", "iso_code"),
+		continent: mmdbCode(record, "continent", "code"),
+	}
+	if region.country == "" {
+		region.country = mmdbCode(record, "registered_country", "iso_code")
+	}
+	db.regions.Store(offset, region)
+	return region, true
+}
+
+func mmdbCode(record map[string]any, field, key string) string {
+	m, _ := record[field].(map[string]any)
+	code, _ := m[key].(string)
+	return strings.ToUpper(code)
+}
+
+type mmdbDecoder struct {
+	buf []byte
+}
+
+// decode reads the value at off, returning it and the offset just past it.
+// Maps become map[string]any, arrays []any and unsigned integers uint64.
+func (d mmdbDecoder) decode(off int) (any, int, error) {
+	if off < 0 || off >= len(d.buf) {
+		return nil, 0, errMMDBCorrupt
+	}
+	ctrl := d.buf[off]
+	off++
+
+	typ := int(ctrl >> 5)
+	if typ == 1 {
+		ptr, next, err := d.pointer(ctrl, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		// Pointers never point at pointers
+		if ptr >= len(d.buf) || d.buf[ptr]>>5 == 1 {
+			return nil, 0, errMMDBCorrupt
+		}
+		v, _, err := d.decode(ptr)
+		return v, next, err
+	}
+	if typ == 0 {
+		if off >= len(d.buf) {
+			return nil, 0, errMMDBCorrupt
+		}
+		typ = 7 + int(d.buf[off])
+		off++
+	}
+
+	size := int(ctrl & 0x1f)
+	if size >= 29 {
+		n := size - 28
+		if off+n > len(d.buf) {
+			return nil, 0, errMMDBCorrupt
+		}
+		extra := int(beUint(d.buf[off : off+n]))
+		off += n
+		size = [...]int{29, 285, 65821}[n-1] + extra
+	}
+
+	switch typ {
+	case 7: // map
+		m := make(map[string]any, size)
+		for i := 0; i < size; i++ {
+			k, next, err := d.decode(off)
+			if err != nil {
+				return nil, 0, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, 0, errMMDBCorrupt
+			}
+			if m[key], off, err = d.decode(next); err != nil {
+				return nil, 0, err
+			}
+		}
+		return m, off, nil
+	case 11: // array
+		a := make([]any, size)
+		for i := range a {
+			var err error
+			if a[i], off, err = d.decode(off); err != nil {
+				return nil, 0, err
+			}
+		}
+		return a, off, nil
+	case 14: // boolean
+		return size != 0, off, nil
+	}
+
+	if off+size > len(d.buf) {
+		return nil, 0, errMMDBCorrupt
+	}
+	b := d.buf[off : off+size]
+	off += size
+
+	switch typ {
+	case 2: // utf-8 string
+		return string(b), off, nil
+	case 4, 10: // bytes, uint128
+		return b, off, nil
+	case 3: // double
+		if size != 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return math.Float64frombits(beUint(b)), off, nil
+	case 15: // float
+		if size != 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return float64(math.Float32frombits(uint32(beUint(b)))), off, nil
+	case 5, 6, 9: // uint16, uint32, uint64
+		if size > 8 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return beUint(b), off, nil
+	case 8: // int32
+		if size > 4 {
+			return nil, 0, errMMDBCorrupt
+		}
+		return int64(int32(uint32(beUint(b))<<(32-8*size)) >> (32 - 8*size)), off, nil
+	}
+	return nil, 0, fmt.Errorf("unsupported maxmind data type %d", typ)
+}
+
+func (d mmdbDecoder) pointer(ctrl byte, off int) (ptr, next int, err error) {
+	n := int(ctrl>>3&3) + 1
+	if off+n > len(d.buf) {
+		return 0, 0, errMMDBCorrupt
+	}
+	v := int(beUint(d.buf[off : off+n]))
+	if n < 4 {
+		v |= int(ctrl&7) << (8 * n)
+	}
+	return v + [...]int{0, 2048, 526336, 0}[n-1], off + n, nil
+}
+
+func beUint(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
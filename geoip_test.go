@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// mmdbBuilder writes small MaxMind databases with a 24-bit record size.
+type mmdbBuilder struct {
+	ipVersion int
+	root      *mmdbTrieNode
+	data      []byte
+}
+
+type mmdbTrieNode struct {
+	child [2]*mmdbTrieNode
+	leaf  int // data offset + 1 of the record for a network, 0 for none
+}
+
+func newMMDBBuilder(ipVersion int) *mmdbBuilder {
+	return &mmdbBuilder{ipVersion: ipVersion, root: &mmdbTrieNode{}}
+}
+
+// insert records country and continent codes for network, e.g. 1.0.0.0/8.
+func (b *mmdbBuilder) insert(t *testing.T, network, country, continent string) {
+	t.Helper()
+	_, ipnet, err := net.ParseCIDR(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip := []byte(ipnet.IP.To4())
+	ones, _ := ipnet.Mask.Size()
+	if b.ipVersion == 6 {
+		if ip == nil {
+			ip = ipnet.IP.To16()
+		} else {
+			ip, ones = ipnet.IP.To16(), ones+96
+			// To16 maps IPv4 under ::ffff:0:0/96; databases use ::/96
+			ip[10], ip[11] = 0, 0
+		}
+	}
+
+	offset := len(b.data)
+	b.data = append(b.data, mmdbMap(
+		"continent", mmdbMap("code", mmdbString(continent)),
+		"country", mmdbMap("iso_code", mmdbString(country)),
+	)...)
+
+	node := b.root
+	for i := 0; i < ones; i++ {
+		bit := ip[i/8] >> (7 - i%8) & 1
+		if node.child[bit] == nil {
+			node.child[bit] = &mmdbTrieNode{}
+		}
+		node = node.child[bit]
+	}
+	node.leaf = offset + 1
+}
+
+// write lays out the database and returns its path. If corrupt is set, it
+// replaces the value of every record that points at a network's data.
+func (b *mmdbBuilder) write(t *testing.T, corrupt func(nodeCount uint) uint) string {
+	t.Helper()
+	var nodes []*mmdbTrieNode
+	number := map[*mmdbTrieNode]uint{}
+	var walk func(n *mmdbTrieNode)
+	walk = func(n *mmdbTrieNode) {
+		if n == nil || n.leaf != 0 {
+			return
+		}
+		number[n] = uint(len(nodes))
+		nodes = append(nodes, n)
+		walk(n.child[0])
+		walk(n.child[1])
+	}
+	walk(b.root)
+	nodeCount := uint(len(nodes))
+
+	var buf []byte
+	for _, n := range nodes {
+		for _, child := range n.child {
+			var record uint
+			switch {
+			case child == nil:
+				record = nodeCount
+			case child.leaf != 0:
+				record = nodeCount + 16 + uint(child.leaf-1)
+				if corrupt != nil {
+					record = corrupt(nodeCount)
+				}
+			default:
+				record = number[child]
+			}
+			buf = append(buf, byte(record>>16), byte(record>>8), byte(record))
+		}
+	}
+	buf = append(buf, make([]byte, 16)...)
+	buf = append(buf, b.data...)
+	buf = append(buf, mmdbMetadataMarker...)
+	buf = append(buf, mmdbMap(
+		"ip_version", mmdbUint(uint32(b.ipVersion)),
+		"node_count", mmdbUint(uint32(nodeCount)),
+		"record_size", mmdbUint(24),
+	)...)
+
+	path := filepath.Join(t.TempDir(), "test.mmdb")
+	if err := os.WriteFile(path, buf, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func mmdbString(s string) []byte {
+	return append([]byte{2<<5 | byte(len(s))}, s...)
+}
+
+func mmdbUint(v uint32) []byte {
+	return binary.BigEndian.AppendUint32([]byte{6<<5 | 4}, v)
+}
+
+// mmdbMap encodes alternating keys and encoded values.
+func mmdbMap(pairs ...any) []byte {
+	b := []byte{7<<5 | byte(len(pairs)/2)}
+	for i := 0; i < len(pairs); i += 2 {
+		b = append(b, mmdbString(pairs[i].(string))...)
+		b = append(b, pairs[i+1].([]byte)...)
+	}
+	return b
+}
+
+func TestGeoIPRegion(t *testing.T) {
+	for _, ipVersion := range []int{4, 6} {
+		b := newMMDBBuilder(ipVersion)
+		b.insert(t, "1.0.0.0/8", "au", "oc")
+		b.insert(t, "2.128.0.0/9", "FR", "EU")
+		if ipVersion == 6 {
+			b.insert(t, "2001:db8::/32", "DE", "EU")
+		}
+		db, err := openGeoIPDB(b.write(t, nil))
+		if err != nil {
+			t.Fatalf("IPv%d: %v", ipVersion, err)
+		}
+		var v6 geoRegion
+		if ipVersion == 6 {
+			v6 = geoRegion{"DE", "EU"}
+		}
+
+		tests := []struct {
+			ip    string
+			want  geoRegion
+			found bool
+		}{
+			{"1.2.3.4", geoRegion{"AU", "OC"}, true},
+			{"1.255.255.255", geoRegion{"AU", "OC"}, true},
+			{"2.200.0.1", geoRegion{"FR", "EU"}, true},
+			{"2.1.0.1", geoRegion{}, false},
+			{"3.0.0.1", geoRegion{}, false},
+			{"2001:db8::1", v6, ipVersion == 6},
+			{"2001:db9::1", geoRegion{}, false},
+		}
+		for _, tt := range tests {
+			got, found := db.region(net.ParseIP(tt.ip))
+			if got != tt.want || found != tt.found {
+				t.Errorf("IPv%d database: %s: got %v, %t, want %v, %t", ipVersion, tt.ip, got, found, tt.want, tt.found)
+			}
+		}
+	}
+}
+
+// Records pointing between the tree and the data section, or beyond the
+// data, find nothing rather than reading out of bounds.
+func TestGeoIPCorruptRecords(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(nodeCount uint) uint
+	}{
+		{"separator", func(n uint) uint { return n + 1 }},
+		{"last separator byte", func(n uint) uint { return n + 15 }},
+		{"past the data", func(n uint) uint { return n + 16 + 1<<16 }},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newMMDBBuilder(4)
+			b.insert(t, "1.0.0.0/8", "AU", "OC")
+			db, err := openGeoIPDB(b.write(t, tt.corrupt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if region, found := db.region(net.ParseIP("1.2.3.4")); found {
+				t.Fatalf("found %v in a corrupt record", region)
+			}
+		})
+	}
+}
+
+func TestMMDBDecodeBounds(t *testing.T) {
+	d := mmdbDecoder{mmdbString("abc")}
+	for _, off := range []int{-1, -17, len(d.buf)} {
+		if _, _, err := d.decode(off); err == nil {
+			t.Errorf("decode(%d) succeeded", off)
+		}
+	}
+	// A string running past the end of the data
+	if _, _, err := (mmdbDecoder{[]byte{2<<5 | 5, 'a'}}).decode(0); err == nil {
+		t.Error("truncated string decoded")
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// QueueConfig lets requests over a concurrency limit wait for a slot
+// instead of being rejected outright.
+type QueueConfig struct {
+	Size    int           `yaml:"size"`
+	Timeout time.Duration `yaml:"timeout,omitempty"`
+}
+
+// globalLimiter caps requests in flight across all services. When full,
+// requests queue by their service's priority, first come first served
+// within a priority; a full queue makes room for a higher-priority request
+// by turning away the newest of the lowest.
+type globalLimiter struct {
+	max     int
+	size    int
+	timeout time.Duration
+
+	mu       sync.Mutex
+	running  int
+	queue    waiterQueue
+	seq      uint64
+	inFlight atomic.Int64 // running, for reading without the lock
+}
+
+func newGlobalLimiter(lc *LimitsConfig) (*globalLimiter, error) {
+	if lc == nil || lc.MaxConcurrent == 0 {
+		if lc != nil && lc.Queue != nil {
+			return nil, fmt.Errorf("queue requires max_concurrent")
+		}
+		return nil, nil
+	}
+	if lc.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("max_concurrent must be positive")
+	}
+	gl := &globalLimiter{max: lc.MaxConcurrent}
+	if q := lc.Queue; q != nil {
+		if q.Size < 0 {
+			return nil, fmt.Errorf("queue size must not be negative")
+		}
+		gl.size, gl.timeout = q.Size, q.Timeout
+		if gl.timeout == 0 {
+			gl.timeout = time.Second
+		}
+	}
+	return gl, nil
+}
+
+type waiter struct {
+	priority int
+	seq      uint64
+	index    int
+	ready    chan bool // true: the slot is ours; false: evicted from the queue
+}
+
+// waiterQueue is a heap with the next request to run on top.
+type waiterQueue []*waiter
+
+func (q waiterQueue) Len() int { return len(q) }
+func (q waiterQueue) Less(i, j int) bool {
+	if q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+func (q waiterQueue) Swap(i, j int) {
+	q[i], q[j] = q[j], q[i]
+	q[i].index, q[j].index = i, j
+}
+func (q *waiterQueue) Push(x any) {
+	w := x.(*waiter)
+	w.index = len(*q)
+	*q = append(*q, w)
+}
+func (q *waiterQueue) Pop() any {
+	old := *q
+	w := old[len(old)-1]
+	old[len(old)-1] = nil
+	w.index = -1
+	*q = old[:len(old)-1]
+	return w
+}
+
+// acquire takes a slot, waiting in the queue if there is one. A rejected
+// request gets the overload to report; success must be paired with release.
+func (gl *globalLimiter) acquire(ctx context.Context, priority int) (bool, overload) {
+	gl.mu.Lock()
+	if gl.running < gl.max {
+		gl.running++
+		gl.inFlight.Store(int64(gl.running))
+		gl.mu.Unlock()
+		return true, overload{}
+	}
+	if !gl.makeRoom(priority) {
+		gl.mu.Unlock()
+		return false, gl.overload("gateway_concurrency")
+	}
+	gl.seq++
+	w := &waiter{priority: priority, seq: gl.seq, ready: make(chan bool, 1)}
+	heap.Push(&gl.queue, w)
+	gl.mu.Unlock()
+
+	timer := time.NewTimer(gl.timeout)
+	defer timer.Stop()
+	reason := "queue_timeout"
+	select {
+	case ok := <-w.ready:
+		if ok {
+			return true, overload{}
+		}
+		return false, gl.overload("gateway_concurrency")
+	case <-timer.C:
+	case <-ctx.Done():
+		reason = "client_gone"
+	}
+
+	gl.mu.Lock()
+	if w.index >= 0 {
+		heap.Remove(&gl.queue, w.index)
+		gl.mu.Unlock()
+		return false, gl.overload(reason)
+	}
+	gl.mu.Unlock()
+	// Handed a slot (or evicted) just as we gave up
+	if <-w.ready {
+		gl.release()
+	}
+	return false, gl.overload(reason)
+}
+
+// makeRoom reports whether a request of the given priority can join the
+// queue, evicting a lower-priority one if it is full. Called with mu held.
+func (gl *globalLimiter) makeRoom(priority int) bool {
+	if len(gl.queue) < gl.size {
+		return true
+	}
+	var lowest *waiter
+	for _, w := range gl.queue {
+		if lowest == nil || w.priority < lowest.priority || (w.priority == lowest.priority && w.seq > lowest.seq) {
+			lowest = w
+		}
+	}
+	if lowest == nil || lowest.priority >= priority {
+		return false
+	}
+	heap.Remove(&gl.queue, lowest.index)
+	lowest.ready <- false
+	return true
+}
+
+// release frees a slot, handing it straight to the next queued request.
+func (gl *globalLimiter) release() {
+	gl.mu.Lock()
+	defer gl.mu.Unlock()
+	if len(gl.queue) > 0 {
+		heap.Pop(&gl.queue).(*waiter).ready <- true
+		return
+	}
+	gl.running--
+	gl.inFlight.Store(int64(gl.running))
+}
+
+func (gl *globalLimiter) overload(reason string) overload {
+	return overload{reason: reason, retryAfter: max(gl.timeout, time.Second), capacity: int64(gl.max), inFlight: gl.inFlight.Load()}
+}
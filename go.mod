@@ -2,6 +2,6 @@ module github.com/mizrahidaniel/agent-api-gateway
 
 go 1.21
 
-require (
-	gopkg.in/yaml.v3 v3.0.1
-)
+require gopkg.in/yaml.v3 v3.0.1
+
+require golang.org/x/sys v0.20.0
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type HealthCheckConfig struct {
+	Path               string            `yaml:"path"`
+	Interval           time.Duration     `yaml:"interval"`
+	Timeout            time.Duration     `yaml:"timeout"`
+	HealthyThreshold   int               `yaml:"healthy_threshold"`
+	UnhealthyThreshold int               `yaml:"unhealthy_threshold"`
+	Headers            map[string]string `yaml:"headers"`
+	ExpectBodyContains string            `yaml:"expect_body_contains,omitempty"`
+	ExpectJSON         map[string]string `yaml:"expect_json,omitempty"` // dotted field path -> value
+}
+
+func (hc *HealthCheckConfig) setDefaults() {
+	if hc.Path == "" {
+		hc.Path = "/health"
+	}
+	if hc.Interval == 0 {
+		hc.Interval = 10 * time.Second
+	}
+	if hc.Timeout == 0 {
+		hc.Timeout = 2 * time.Second
+	}
+	if hc.HealthyThreshold == 0 {
+		hc.HealthyThreshold = 2
+	}
+	if hc.UnhealthyThreshold == 0 {
+		hc.UnhealthyThreshold = 3
+	}
+
+	// Secrets such as probe tokens are usually kept out of the file
+	for k, v := range hc.Headers {
+		hc.Headers[k] = os.ExpandEnv(v)
+	}
+}
+
+// StartupProbeConfig holds new targets out of rotation until they have
+// passed their health check a number of times in a row, for backends that
+// need to warm up after the gateway starts.
+type StartupProbeConfig struct {
+	SuccessThreshold int           `yaml:"success_threshold"`
+	Interval         time.Duration `yaml:"interval"`
+}
+
+func (sp *StartupProbeConfig) setDefaults() {
+	if sp.SuccessThreshold == 0 {
+		sp.SuccessThreshold = 3
+	}
+	if sp.Interval == 0 {
+		sp.Interval = 2 * time.Second
+	}
+}
+
+func (svc *Service) runHealthChecks(ctx context.Context) {
+	for _, up := range svc.upstreams {
+		go svc.checkHealth(ctx, up)
+	}
+	if svc.Canary != nil {
+		go svc.checkHealth(ctx, svc.Canary.upstream)
+	}
+}
+
+func (svc *Service) checkHealth(ctx context.Context, up *upstream) {
+	if svc.StartupProbe != nil {
+		svc.warmUp(ctx, up)
+	}
+	svc.probeLoop(ctx, up)
+}
+
+// warmUp probes a target until it passes the startup probe, then puts it
+// into rotation.
+func (svc *Service) warmUp(ctx context.Context, up *upstream) {
+	up.mu.Lock()
+	warming := up.warming
+	up.mu.Unlock()
+	if !warming {
+		// Ready before a reload
+		return
+	}
+
+	sp := svc.StartupProbe
+	client := &http.Client{Timeout: svc.HealthCheck.Timeout}
+
+	ticker := time.NewTicker(sp.Interval)
+	defer ticker.Stop()
+
+	successes, failures := 0, 0
+	for ; ctx.Err() == nil; tick(ctx, ticker) {
+		if err := svc.probe(client, up); err != nil {
+			if failures == 0 {
+				log.Printf("[%s] startup probe: %s not ready yet: %v", svc.name, up.url, err)
+			}
+			successes = 0
+			failures++
+			continue
+		}
+		failures = 0
+		if successes++; successes < sp.SuccessThreshold {
+			continue
+		}
+
+		up.mu.Lock()
+		up.warming = false
+		up.mu.Unlock()
+		if svc.Canary == nil || up != svc.Canary.upstream {
+			svc.warming.Add(-1)
+		}
+		log.Printf("[%s] startup probe: %s is ready", svc.name, up.url)
+		return
+	}
+}
+
+// rejectStarting turns requests away while none of a service's targets has
+// passed its startup probe yet.
+func (c *Config) rejectStarting(w http.ResponseWriter, r *http.Request, svc *Service) bool {
+	if svc.StartupProbe == nil || svc.warming.Load() < int32(len(svc.upstreams)) {
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(max(svc.StartupProbe.Interval, time.Second).Seconds())))
+	c.errors.write(w, r, errServiceStarting)
+	return true
+}
+
+func (svc *Service) probeLoop(ctx context.Context, up *upstream) {
+	hc := svc.HealthCheck
+	client := &http.Client{Timeout: hc.Timeout}
+
+	ticker := time.NewTicker(hc.Interval)
+	defer ticker.Stop()
+
+	for ; ctx.Err() == nil; tick(ctx, ticker) {
+		err := svc.probe(client, up)
+		ok := err == nil
+
+		up.mu.Lock()
+		if ok {
+			up.probeFailures = 0
+			up.probeSuccesses++
+		} else {
+			up.probeSuccesses = 0
+			up.probeFailures++
+		}
+		wasHealthy := !up.unhealthy
+		switch {
+		case wasHealthy && up.probeFailures >= hc.UnhealthyThreshold:
+			up.unhealthy = true
+		case !wasHealthy && up.probeSuccesses >= hc.HealthyThreshold:
+			up.unhealthy = false
+		}
+		changed := wasHealthy != !up.unhealthy
+		up.mu.Unlock()
+
+		if changed {
+			if wasHealthy {
+				log.Printf("[%s] health check: %s is unhealthy: %v", svc.name, up.url, err)
+			} else {
+				log.Printf("[%s] health check: %s is healthy again", svc.name, up.url)
+			}
+		}
+	}
+}
+
+// tick waits for the ticker's next tick, or for ctx to be done, which ends
+// a loop of the form: for ; ctx.Err() == nil; tick(ctx, ticker).
+func tick(ctx context.Context, ticker *time.Ticker) {
+	select {
+	case <-ticker.C:
+	case <-ctx.Done():
+	}
+}
+
+func (svc *Service) probe(client *http.Client, up *upstream) error {
+	hc := svc.HealthCheck
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(up.url.String(), "/")+hc.Path, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range hc.Headers {
+		if strings.EqualFold(k, "Host") {
+			req.Host = v
+			continue
+		}
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 400 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	if hc.ExpectBodyContains != "" && !bytes.Contains(body, []byte(hc.ExpectBodyContains)) {
+		return fmt.Errorf("body does not contain %q", hc.ExpectBodyContains)
+	}
+	if len(hc.ExpectJSON) > 0 {
+		return matchJSONFields(body, hc.ExpectJSON)
+	}
+	return nil
+}
+
+// matchJSONFields checks that each dotted path in want ("checks.db") holds
+// the given value. Non-string values are compared in their JSON form.
+func matchJSONFields(body []byte, want map[string]string) error {
+	var doc any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return errors.New("body is not JSON")
+	}
+
+	for path, expected := range want {
+		v := doc
+		for _, key := range strings.Split(path, ".") {
+			m, _ := v.(map[string]any)
+			v = m[key]
+		}
+
+		got, ok := v.(string)
+		if !ok {
+			raw, _ := json.Marshal(v)
+			got = string(raw)
+		}
+		if got != expected {
+			return fmt.Errorf("%s is %s, want %q", path, got, expected)
+		}
+	}
+	return nil
+}
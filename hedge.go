@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HedgingConfig sends another copy of a slow request to a second target and
+// uses whichever answers first, trading a little extra load for a shorter
+// tail. The delay is fixed, or follows a percentile of recent latencies.
+type HedgingConfig struct {
+	Enabled    bool          `yaml:"enabled"`
+	Delay      time.Duration `yaml:"delay,omitempty"`      // also used until a percentile has enough samples
+	Percentile float64       `yaml:"percentile,omitempty"` // e.g. 95
+	MaxHedged  int           `yaml:"max_hedged,omitempty"`
+	latencies  latencyWindow
+	hedged     atomic.Uint64
+	wins       atomic.Uint64
+}
+
+// Latencies kept for the percentile, and how many it needs before it is used
+const (
+	hedgeWindow     = 1024
+	hedgeMinSamples = 100
+)
+
+func (hc *HedgingConfig) setDefaults() {
+	if hc.Delay == 0 {
+		hc.Delay = 100 * time.Millisecond
+	}
+	if hc.MaxHedged == 0 {
+		hc.MaxHedged = 1
+	}
+}
+
+func (hc *HedgingConfig) validate() error {
+	if hc.Percentile < 0 || hc.Percentile >= 100 {
+		return fmt.Errorf("percentile must be between 0 and 100")
+	}
+	if hc.MaxHedged < 0 {
+		return fmt.Errorf("max_hedged must not be negative")
+	}
+	return nil
+}
+
+func (hc *HedgingConfig) delay() time.Duration {
+	if hc.Percentile > 0 {
+		if d, ok := hc.latencies.percentile(hc.Percentile); ok {
+			return d
+		}
+	}
+	return hc.Delay
+}
+
+// hedgeable reports whether a request can safely be sent twice: only safe
+// methods without a body, and never protocol upgrades.
+func hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	return (req.Body == nil || req.Body == http.NoBody) && req.Header.Get("Upgrade") == ""
+}
+
+// latencyWindow holds the most recent response latencies. The percentile is
+// recomputed every so many samples rather than on every request.
+type latencyWindow struct {
+	mu      sync.Mutex
+	samples [hedgeWindow]time.Duration
+	n       int
+	cached  map[float64]time.Duration
+}
+
+func (lw *latencyWindow) observe(d time.Duration) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.samples[lw.n%hedgeWindow] = d
+	lw.n++
+	if lw.n%64 == 0 {
+		lw.cached = nil
+	}
+}
+
+func (lw *latencyWindow) percentile(p float64) (time.Duration, bool) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if lw.n < hedgeMinSamples {
+		return 0, false
+	}
+	if d, ok := lw.cached[p]; ok {
+		return d, true
+	}
+	sorted := slices.Clone(lw.samples[:min(lw.n, hedgeWindow)])
+	slices.Sort(sorted)
+	d := sorted[int(float64(len(sorted)-1)*p/100)]
+	if lw.cached == nil {
+		lw.cached = make(map[float64]time.Duration)
+	}
+	lw.cached[p] = d
+	return d, true
+}
+
+// hedgeTransport races hedged copies of a request against the original. The
+// first response wins; the other attempts are cancelled as soon as it
+// arrives, so only the winner's body is ever streamed to the client.
+type hedgeTransport struct {
+	svc  *Service
+	base http.RoundTripper
+}
+
+type hedgeAttempt struct {
+	req     *http.Request
+	resp    *http.Response
+	err     error
+	started time.Time
+	hedge   bool
+}
+
+func (ht *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	hc := ht.svc.Hedging
+	if !hedgeable(req) {
+		return ht.base.RoundTrip(req)
+	}
+
+	results := make(chan hedgeAttempt, hc.MaxHedged+1)
+	cancels := make(map[*http.Request]context.CancelFunc)
+	launch := func(r *http.Request, hedge bool) {
+		ctx, cancel := context.WithCancel(r.Context())
+		r = r.WithContext(ctx)
+		cancels[r] = cancel
+		started := time.Now()
+		go func() {
+			resp, err := ht.base.RoundTrip(r)
+			results <- hedgeAttempt{req: r, resp: resp, err: err, started: started, hedge: hedge}
+		}()
+	}
+
+	launch(req, false)
+	inFlight, hedges := 1, 0
+	var fallback *hedgeAttempt // a 5xx, used if nothing better arrives
+	last := upstreamFrom(req.Context())
+	timer := time.NewTimer(hc.delay())
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			if hedges == hc.MaxHedged {
+				continue
+			}
+			hedges++
+			hc.hedged.Add(1)
+			last = ht.svc.pickUpstreamExcept(last, req)
+			launch(ht.svc.retarget(req, last), true)
+			inFlight++
+			timer.Reset(hc.delay())
+
+		case a := <-results:
+			inFlight--
+			switch {
+			case a.err != nil:
+				cancels[a.req]()
+				// An error returned as the result is left to the caller to record
+				if !errors.Is(a.err, context.Canceled) && (inFlight > 0 || fallback != nil) {
+					ht.svc.recordResult(upstreamFrom(a.req.Context()), true)
+				}
+			case a.resp.StatusCode >= 500 && inFlight > 0:
+				// Another attempt may yet do better; keep this one in reserve
+				if fallback != nil {
+					ht.svc.recordResult(upstreamFrom(fallback.req.Context()), true)
+					fallback.resp.Body.Close()
+					cancels[fallback.req]()
+				}
+				fallback = &a
+			default:
+				if fallback != nil {
+					ht.svc.recordResult(upstreamFrom(fallback.req.Context()), true)
+					fallback.resp.Body.Close()
+				}
+				return ht.win(a, cancels, results, inFlight), nil
+			}
+			if inFlight == 0 {
+				if fallback != nil {
+					return ht.win(*fallback, cancels, results, 0), nil
+				}
+				return nil, a.err
+			}
+		}
+	}
+}
+
+// win hands the proxy the winning attempt and cancels the rest.
+func (ht *hedgeTransport) win(a hedgeAttempt, cancels map[*http.Request]context.CancelFunc, results <-chan hedgeAttempt, inFlight int) *http.Response {
+	hc := ht.svc.Hedging
+	hc.latencies.observe(time.Since(a.started))
+	if a.hedge {
+		hc.wins.Add(1)
+	}
+	for r, cancel := range cancels {
+		if r != a.req {
+			cancel()
+		}
+	}
+	go discardHedges(results, inFlight)
+	a.resp.Body = &cancelOnClose{ReadCloser: a.resp.Body, cancel: cancels[a.req]}
+	return a.resp
+}
+
+// discardHedges collects the attempts that lost the race.
+func discardHedges(results <-chan hedgeAttempt, n int) {
+	for i := 0; i < n; i++ {
+		if a := <-results; a.resp != nil {
+			a.resp.Body.Close()
+		}
+	}
+}
+
+// cancelOnClose keeps the winning attempt's context alive until the proxy
+// has finished with its body.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+func (c *Config) hedgeCounters() []collector {
+	counter := func(name, help string, get func(*HedgingConfig) uint64) collector {
+		return &funcMetric{name: name, help: help, label: "service", typ: "counter", values: func() map[string]float64 {
+			values := make(map[string]float64)
+			for svcName, svc := range c.Services {
+				if svc.Hedging != nil && svc.Hedging.Enabled {
+					values[svcName] = float64(get(svc.Hedging))
+				}
+			}
+			return values
+		}}
+	}
+	return []collector{
+		counter("gateway_hedged_requests_total", "Hedged copies sent because the first attempt was slow.", func(hc *HedgingConfig) uint64 { return hc.hedged.Load() }),
+		counter("gateway_hedge_wins_total", "Requests answered by a hedged copy rather than the original.", func(hc *HedgingConfig) uint64 { return hc.wins.Load() }),
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// The gateway logs every request; keep test output readable
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// loadTestConfig loads a config from YAML, with "{{name}}" placeholders
+// replaced by the given values, such as backend URLs.
+func loadTestConfig(t *testing.T, config string, vars map[string]string) *Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, config, vars)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	return cfg
+}
+
+// writeTestConfig writes a config as loadTestConfig takes it to path.
+func writeTestConfig(t *testing.T, path, config string, vars map[string]string) {
+	t.Helper()
+	for name, value := range vars {
+		config = strings.ReplaceAll(config, "{{"+name+"}}", value)
+	}
+	if err := os.WriteFile(path, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testBackend is an upstream that answers with a fixed status and counts
+// the requests it gets.
+type testBackend struct {
+	*httptest.Server
+	hits   atomic.Int64
+	status atomic.Int64
+}
+
+func newTestBackend(t *testing.T, status int) *testBackend {
+	t.Helper()
+	b := &testBackend{}
+	b.status.Store(int64(status))
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.hits.Add(1)
+		io.Copy(io.Discard, r.Body)
+		w.WriteHeader(int(b.status.Load()))
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+// serve sends a request through the gateway and returns the response.
+func serve(cfg *Config, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	cfg.handler().ServeHTTP(w, r)
+	return w
+}
+
+// upstreamFor returns the service's target with the given URL.
+func upstreamFor(t *testing.T, svc *Service, target string) *upstream {
+	t.Helper()
+	for _, up := range svc.upstreams {
+		if up.url.String() == target {
+			return up
+		}
+	}
+	t.Fatalf("no target %s", target)
+	return nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// Hop-by-hop headers (RFC 9110 section 7.6.1) describe one connection and
+// are never forwarded, along with the non-standard Proxy-Connection that
+// old clients still send.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// removeHopHeaders strips the hop-by-hop headers from h, and the headers
+// its Connection header names. A protocol upgrade such as a WebSocket
+// handshake keeps its Upgrade and "Connection: Upgrade", and "TE: trailers"
+// is kept since gRPC backends require it.
+//
+// Inbound requests are cleaned before the gateway adds headers of its own:
+// the reverse proxy cleans its outgoing copy too, but only after routing has
+// run, and a client naming, say, the request ID header in Connection would
+// then have that removed.
+func removeHopHeaders(h http.Header) {
+	upgrade, te := "", ""
+	for _, v := range h.Values("Te") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(textproto.TrimString(token), "trailers") {
+				te = "trailers"
+			}
+		}
+	}
+	for _, v := range h.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			name = textproto.TrimString(name)
+			if strings.EqualFold(name, "upgrade") {
+				upgrade = h.Get("Upgrade")
+			}
+			if name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+	if upgrade != "" {
+		h.Set("Connection", "Upgrade")
+		h.Set("Upgrade", upgrade)
+	}
+	if te != "" {
+		h.Set("Te", te)
+	}
+}
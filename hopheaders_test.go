@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRemoveHopHeaders(t *testing.T) {
+	tests := []struct {
+		name string
+		in   http.Header
+		want http.Header
+	}{
+		{
+			name: "hop-by-hop headers",
+			in: http.Header{
+				"Connection": {"keep-alive"}, "Keep-Alive": {"timeout=5"}, "Proxy-Connection": {"keep-alive"},
+				"Proxy-Authenticate": {"Basic"}, "Proxy-Authorization": {"Basic Zm9v"}, "Te": {"gzip"},
+				"Trailer": {"X-Checksum"}, "Transfer-Encoding": {"chunked"}, "Upgrade": {"h2c"},
+				"Content-Type": {"application/json"},
+			},
+			want: http.Header{"Content-Type": {"application/json"}},
+		},
+		{
+			name: "headers named by Connection",
+			in: http.Header{
+				"Connection": {"X-Secret, close", " X-Other "}, "X-Secret": {"1"}, "X-Other": {"2"}, "X-Kept": {"3"},
+			},
+			want: http.Header{"X-Kept": {"3"}},
+		},
+		{
+			name: "websocket upgrade kept",
+			in: http.Header{
+				"Connection": {"keep-alive, Upgrade"}, "Upgrade": {"websocket"}, "Keep-Alive": {"timeout=5"},
+				"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="},
+			},
+			want: http.Header{
+				"Connection": {"Upgrade"}, "Upgrade": {"websocket"},
+				"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="},
+			},
+		},
+		{
+			name: "TE: trailers kept for gRPC",
+			in:   http.Header{"Te": {"gzip, trailers"}, "Content-Type": {"application/grpc"}},
+			want: http.Header{"Te": {"trailers"}, "Content-Type": {"application/grpc"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.in.Clone()
+			removeHopHeaders(h)
+			if !reflect.DeepEqual(h, tt.want) {
+				t.Fatalf("got %v, want %v", h, tt.want)
+			}
+		})
+	}
+}
+
+const hopHeadersConfig = `
+request_id: {}
+services:
+  api:
+    target: "{{target}}"
+`
+
+func TestHopHeadersNotForwarded(t *testing.T) {
+	var upstream http.Header
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream = r.Header.Clone()
+		w.Header().Set("Connection", "X-Internal-Token")
+		w.Header().Set("X-Internal-Token", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Public", "yes")
+	}))
+	defer backend.Close()
+	gw := httptest.NewServer(loadTestConfig(t, hopHeadersConfig, map[string]string{"target": backend.URL}).handler())
+	defer gw.Close()
+
+	req, err := http.NewRequest(http.MethodGet, gw.URL+"/api/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A client trying to strip the request ID the gateway adds
+	req.Header.Set("Connection", "X-Request-ID, X-Client-Hop")
+	req.Header.Set("X-Client-Hop", "1")
+	req.Header.Set("Proxy-Authorization", "Basic Zm9v")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	for _, name := range []string{"X-Client-Hop", "Proxy-Authorization", "Keep-Alive"} {
+		if v := upstream.Get(name); v != "" {
+			t.Errorf("upstream got %s: %s", name, v)
+		}
+	}
+	if upstream.Get("X-Request-ID") == "" {
+		t.Error("client removed the gateway's request ID through Connection")
+	}
+	for _, name := range []string{"X-Internal-Token", "Keep-Alive", "Proxy-Authenticate"} {
+		if v := resp.Header.Get(name); v != "" {
+			t.Errorf("client got %s: %s", name, v)
+		}
+	}
+	if resp.Header.Get("X-Public") != "yes" {
+		t.Error("end-to-end response header dropped")
+	}
+}
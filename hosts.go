@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net"
+	"strings"
+)
+
+// hostAllowed reports whether the request's Host is one of the service's
+// allowed_hosts. Patterns are matched case-insensitively without the port,
+// unless they include one; "*.example.com" matches any subdomain of
+// example.com but not example.com itself. No patterns allow any host.
+func (svc *Service) hostAllowed(host string) bool {
+	if len(svc.AllowedHosts) == 0 {
+		return true
+	}
+
+	host = strings.ToLower(host)
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+
+	for _, pattern := range svc.AllowedHosts {
+		candidate := hostname
+		if strings.Contains(pattern, ":") {
+			candidate = host
+		}
+		if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+			if strings.HasSuffix(candidate, suffix) && len(candidate) > len(suffix) {
+				return true
+			}
+		} else if candidate == pattern {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type HTTP10Config struct {
+	BufferResponses bool `yaml:"buffer_responses"`
+	ForceClose      bool `yaml:"force_close"`
+}
+
+type http10Key struct{}
+
+// prepareHTTP10 adapts an HTTP/1.0 request before proxying. Chunked
+// encoding is never used towards these clients (net/http falls back to
+// close-delimited bodies), so the remaining work is dropping what they can't
+// speak and, optionally, buffering responses to give them a Content-Length.
+func prepareHTTP10(w http.ResponseWriter, r *http.Request, cfg *HTTP10Config) *http.Request {
+	// Protocol upgrades require HTTP/1.1
+	r.Header.Del("Upgrade")
+
+	if cfg == nil {
+		cfg = &HTTP10Config{}
+	}
+	if cfg.ForceClose {
+		w.Header().Set("Connection", "close")
+	}
+	return r.WithContext(context.WithValue(r.Context(), http10Key{}, cfg))
+}
+
+func adaptHTTP10Response(resp *http.Response, maxBuffered int64) error {
+	cfg, ok := resp.Request.Context().Value(http10Key{}).(*HTTP10Config)
+	if !ok {
+		return nil
+	}
+
+	// Trailers can only be sent with chunked encoding
+	resp.Header.Del("Trailer")
+	resp.Trailer = nil
+
+	if !cfg.BufferResponses || resp.ContentLength >= 0 || strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return nil
+	}
+
+	body, ok, err := bufferResponseBody(resp, maxBuffered)
+	if err != nil || !ok {
+		return err
+	}
+	setResponseBody(resp, body)
+	// Reading to the end filled in the trailers again
+	resp.Trailer = nil
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const http10Config = `
+http10: {buffer_responses: {{buffer}}, force_close: {{close}}}
+services:
+  api:
+    target: "{{target}}"
+`
+
+// http10Backend streams its response with no length, as chunks with a
+// trailer, setting the content type from the request's path.
+func http10Backend(t *testing.T, upgrades *[]string) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*upgrades = append(*upgrades, r.Header.Get("Upgrade"))
+		if strings.HasSuffix(r.URL.Path, "/events") {
+			w.Header().Set("Content-Type", "text/event-stream")
+		}
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "part one, ")
+		w.(http.Flusher).Flush()
+		io.WriteString(w, "part two")
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// http10Get sends a raw HTTP/1.0 request and reads the response.
+func http10Get(t *testing.T, conn net.Conn, br *bufio.Reader, path, header string) *http.Response {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "GET "+path+" HTTP/1.0\r\nHost: gateway\r\n"+header+"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestHTTP10Clients(t *testing.T) {
+	tests := []struct {
+		name, buffer, close, path, header string
+		wantLength                        bool
+		wantClose                         bool
+	}{
+		{name: "close-delimited by default", buffer: "false", close: "false", path: "/api/data", wantClose: true},
+		{name: "buffered to a Content-Length", buffer: "true", close: "false", path: "/api/data", wantLength: true, wantClose: true},
+		{name: "event streams aren't buffered", buffer: "true", close: "false", path: "/api/events", wantClose: true},
+		{name: "buffered keep-alive", buffer: "true", close: "false", path: "/api/data", header: "Connection: keep-alive\r\n", wantLength: true},
+		{name: "force_close", buffer: "true", close: "true", path: "/api/data", header: "Connection: keep-alive\r\n", wantLength: true, wantClose: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upgrades []string
+			backend := http10Backend(t, &upgrades)
+			cfg := loadTestConfig(t, http10Config, map[string]string{
+				"target": backend.URL, "buffer": tt.buffer, "close": tt.close,
+			})
+			gw := httptest.NewServer(cfg.handler())
+			defer gw.Close()
+			conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			br := bufio.NewReader(conn)
+
+			resp := http10Get(t, conn, br, tt.path, tt.header+"Upgrade: websocket\r\n")
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil || string(body) != "part one, part two" {
+				t.Fatalf("body %q (%v)", body, err)
+			}
+			if len(resp.TransferEncoding) > 0 || resp.Header.Get("Trailer") != "" || len(resp.Trailer) > 0 {
+				t.Fatalf("HTTP/1.0 client got Transfer-Encoding %v, trailers %v %v", resp.TransferEncoding, resp.Header.Get("Trailer"), resp.Trailer)
+			}
+			if hasLength := resp.Header.Get("Content-Length") != ""; hasLength != tt.wantLength {
+				t.Fatalf("Content-Length %q, want one: %t", resp.Header.Get("Content-Length"), tt.wantLength)
+			}
+			if resp.Close != tt.wantClose {
+				t.Fatalf("connection closed %t, want %t", resp.Close, tt.wantClose)
+			}
+			if upgrades[0] != "" {
+				t.Fatalf("Upgrade %q forwarded for an HTTP/1.0 request", upgrades[0])
+			}
+
+			if !tt.wantClose {
+				// The connection is reusable
+				resp := http10Get(t, conn, br, tt.path, tt.header)
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Fatalf("second request on the connection: status %d", resp.StatusCode)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"crypto/sha256"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyConfig makes requests carrying an Idempotency-Key run at most
+// once per ttl. Duplicates that arrive while the first request is in flight
+// wait for it; later ones are answered from its stored response. Gateway
+// retries happen inside that single execution, with the key forwarded on
+// every attempt so the backend can dedupe them too.
+type IdempotencyConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	TTL          time.Duration `yaml:"ttl"`
+	MaxBodyBytes byteSize      `yaml:"max_body_bytes"`
+}
+
+func (ic *IdempotencyConfig) setDefaults() {
+	if ic.TTL == 0 {
+		ic.TTL = 5 * time.Minute
+	}
+	if ic.MaxBodyBytes == 0 {
+		ic.MaxBodyBytes = 1 << 20
+	}
+}
+
+// beginIdempotent runs r through the idempotency store if it carries a key.
+// See replayStore.begin.
+func (svc *Service) beginIdempotent(w http.ResponseWriter, r *http.Request) (http.ResponseWriter, func()) {
+	key := r.Header.Get("Idempotency-Key")
+	if key == "" || safeMethod(r.Method) {
+		return w, func() {}
+	}
+
+	body, ok := svc.idempotency.peekBody(r)
+	if !ok {
+		return w, func() {}
+	}
+	return svc.idempotency.begin(w, r, credentialKey(r, key), requestFingerprint(r, body))
+}
+
+func safeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// credentialKey scopes key to the caller's credentials so clients can't
+// collide.
+func credentialKey(r *http.Request, key string) string {
+	h := sha256.New()
+	for _, part := range []string{key, r.Header.Get("Authorization"), r.Header.Get("X-API-Key"), r.Header.Get(clientCertFingerprintHeader)} {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	return string(h.Sum(nil))
+}
+
+// requestFingerprint identifies what a request asks for.
+func requestFingerprint(r *http.Request, body []byte) [sha256.Size]byte {
+	return sha256.Sum256(append([]byte(r.Method+" "+r.URL.RequestURI()+"\x00"), body...))
+}
+
+type replayEntry struct {
+	fingerprint [sha256.Size]byte
+	done        chan struct{}
+	result      *replayedResponse // nil if the response was too large to keep, or aborted
+	expires     time.Time         // zero while in flight
+}
+
+type replayedResponse struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// replayStore runs a request once per id and replays its response to
+// duplicates until ttl after it completed.
+type replayStore struct {
+	service   string
+	ttl       time.Duration
+	maxBody   int64
+	errors    *errorWriter
+	mu        sync.Mutex
+	entries   map[string]*replayEntry
+	lastSweep time.Time
+}
+
+func newReplayStore(service string, ttl time.Duration, maxBody byteSize, errors *errorWriter) *replayStore {
+	return &replayStore{
+		service:   service,
+		ttl:       ttl,
+		maxBody:   int64(maxBody),
+		errors:    errors,
+		entries:   make(map[string]*replayEntry),
+		lastSweep: time.Now(),
+	}
+}
+
+// peekBody returns the request body, or ok=false if it is too large to
+// take part.
+func (s *replayStore) peekBody(r *http.Request) ([]byte, bool) {
+	body, err := peekRequestBody(r, s.maxBody+1)
+	if err != nil || int64(len(body)) > s.maxBody {
+		log.Printf("[%s] request body too large to dedupe, proxying %s %s as is", s.service, r.Method, r.URL.Path)
+		return nil, false
+	}
+	return body, true
+}
+
+// begin claims id. The first request gets a writer that records its response
+// and a done func to call once it has been handled; for duplicates the
+// response has already been written and done is nil. A duplicate whose
+// fingerprint differs from the first request's is rejected.
+func (s *replayStore) begin(w http.ResponseWriter, r *http.Request, id string, fingerprint [sha256.Size]byte) (http.ResponseWriter, func()) {
+	entry, leader := s.claim(id, &replayEntry{fingerprint: fingerprint, done: make(chan struct{})})
+	if !leader {
+		s.replay(w, r, entry, fingerprint)
+		return w, nil
+	}
+
+	capture := &replayCapture{bodyCapture: bodyCapture{ResponseWriter: w, limit: s.maxBody}, status: http.StatusOK}
+	return capture, func() {
+		// An aborted response (upstream failing mid-body) must not be replayed
+		if p := recover(); p != nil {
+			capture.truncated = true
+			s.finish(id, entry, capture)
+			panic(p)
+		}
+		s.finish(id, entry, capture)
+	}
+}
+
+// claim returns the live entry for id, or stores entry and reports that the
+// caller is the one to execute the request.
+func (s *replayStore) claim(id string, entry *replayEntry) (*replayEntry, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.entries[id]; ok && (existing.expires.IsZero() || now.Before(existing.expires)) {
+		return existing, false
+	}
+	if now.Sub(s.lastSweep) > time.Minute {
+		for k, e := range s.entries {
+			if !e.expires.IsZero() && now.After(e.expires) {
+				delete(s.entries, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	s.entries[id] = entry
+	return entry, true
+}
+
+// finish publishes the first request's response to anyone waiting on it.
+// Server errors are shared with waiters but not kept, so a later client
+// retry runs the request again.
+func (s *replayStore) finish(id string, entry *replayEntry, capture *replayCapture) {
+	if !capture.truncated {
+		header := capture.header
+		if header == nil {
+			header = capture.Header().Clone()
+		}
+		entry.result = &replayedResponse{status: capture.status, header: header, body: capture.buf.Bytes()}
+	}
+
+	s.mu.Lock()
+	entry.expires = time.Now().Add(s.ttl)
+	if entry.result == nil || entry.result.status >= 500 {
+		delete(s.entries, id)
+	}
+	s.mu.Unlock()
+	close(entry.done)
+}
+
+func (s *replayStore) replay(w http.ResponseWriter, r *http.Request, entry *replayEntry, fingerprint [sha256.Size]byte) {
+	if fingerprint != entry.fingerprint {
+		s.errors.write(w, r, errIdempotencyMismatch)
+		return
+	}
+
+	select {
+	case <-entry.done:
+	case <-r.Context().Done():
+		return
+	}
+	if entry.result == nil {
+		s.errors.write(w, r, errIdempotencyUnavailable)
+		return
+	}
+
+	// The duplicate keeps its own gateway headers, such as its request ID
+	h := w.Header()
+	for k, v := range entry.result.header {
+		if _, ok := h[k]; !ok {
+			h[k] = v
+		}
+	}
+	h.Set("Idempotent-Replayed", "true")
+	w.WriteHeader(entry.result.status)
+	w.Write(entry.result.body)
+}
+
+// replayCapture records the response as the upstream gave it. The header is
+// taken before passing it on, since compression below changes it in place,
+// so each replay negotiates its own encoding for the stored plain body.
+type replayCapture struct {
+	bodyCapture
+	status      int
+	header      http.Header
+	wroteHeader bool
+}
+
+func (rc *replayCapture) WriteHeader(code int) {
+	if !rc.wroteHeader && code >= 200 {
+		rc.status = code
+		rc.header = rc.Header().Clone()
+		rc.wroteHeader = true
+	}
+	rc.ResponseWriter.WriteHeader(code)
+}
+
+func (rc *replayCapture) Write(p []byte) (int, error) {
+	if !rc.wroteHeader {
+		if rc.Header().Get("Content-Type") == "" {
+			rc.Header().Set("Content-Type", http.DetectContentType(p))
+		}
+		rc.WriteHeader(http.StatusOK)
+	}
+	return rc.bodyCapture.Write(p)
+}
+
+func (rc *replayCapture) Flush() {
+	if f, ok := rc.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const idempotencyConfig = `
+services:
+  jobs:
+    target: "{{target}}"
+    retry: {attempts: 2, retry_on_status: [503], backoff: 1ms}
+    idempotency: {enabled: true, ttl: 5m}
+`
+
+// jobBackend creates a job per request, answering with its number. Each
+// request waits for release, and the first fail503 requests get 503.
+type jobBackend struct {
+	*httptest.Server
+	created atomic.Int64
+	arrived chan struct{}
+}
+
+func newJobBackend(t *testing.T, release <-chan struct{}, fail503 int64) *jobBackend {
+	t.Helper()
+	b := &jobBackend{arrived: make(chan struct{}, 100)}
+	b.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		b.arrived <- struct{}{}
+		<-release
+		n := b.created.Add(1)
+		if n <= fail503 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "job-%d", n)
+	}))
+	t.Cleanup(b.Close)
+	return b
+}
+
+func postJob(cfg *Config, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/jobs/", strings.NewReader(body))
+	r.Header.Set("Idempotency-Key", key)
+	return serve(cfg, r)
+}
+
+func TestIdempotencyConcurrentDuplicates(t *testing.T) {
+	release := make(chan struct{})
+	backend := newJobBackend(t, release, 0)
+	cfg := loadTestConfig(t, idempotencyConfig, map[string]string{"target": backend.URL})
+
+	const clients = 10
+	responses := make([]*httptest.ResponseRecorder, clients)
+	var wg sync.WaitGroup
+	for i := range responses {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i] = postJob(cfg, "create-1", `{"name": "nightly"}`)
+		}(i)
+	}
+	<-backend.arrived
+	time.Sleep(50 * time.Millisecond) // let the duplicates queue up behind it
+	close(release)
+	wg.Wait()
+
+	replayed := 0
+	for i, w := range responses {
+		if w.Code != http.StatusCreated || w.Body.String() != "job-1" {
+			t.Fatalf("client %d got %d %q, want 201 job-1", i, w.Code, w.Body)
+		}
+		if w.Header().Get("Idempotent-Replayed") == "true" {
+			replayed++
+		}
+	}
+	if n := backend.created.Load(); n != 1 {
+		t.Fatalf("backend created %d jobs for one key", n)
+	}
+	if replayed != clients-1 {
+		t.Fatalf("%d responses marked replayed, want %d", replayed, clients-1)
+	}
+
+	if w := postJob(cfg, "create-1", `{"name": "nightly"}`); w.Body.String() != "job-1" || w.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("later duplicate got %d %q, want the stored job-1", w.Code, w.Body)
+	}
+	if n := backend.created.Load(); n != 1 {
+		t.Fatalf("later duplicate reached the backend: %d jobs", n)
+	}
+}
+
+// A gateway retry is part of the first execution; the client retrying with
+// the same key afterwards gets its result rather than a third attempt.
+func TestIdempotencyGatewayAndClientRetry(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	backend := newJobBackend(t, release, 1)
+	cfg := loadTestConfig(t, idempotencyConfig, map[string]string{"target": backend.URL})
+
+	first := postJob(cfg, "create-2", "{}")
+	if first.Code != http.StatusCreated || first.Body.String() != "job-2" {
+		t.Fatalf("first request got %d %q, want job-2 after a gateway retry", first.Code, first.Body)
+	}
+	retry := postJob(cfg, "create-2", "{}")
+	if retry.Code != http.StatusCreated || retry.Body.String() != "job-2" {
+		t.Fatalf("client retry got %d %q, want the stored job-2", retry.Code, retry.Body)
+	}
+	if n := backend.created.Load(); n != 2 {
+		t.Fatalf("backend saw %d attempts, want 2", n)
+	}
+}
+
+func TestIdempotencyServerErrorsNotStored(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	backend := newJobBackend(t, release, 2) // both gateway attempts fail
+	cfg := loadTestConfig(t, idempotencyConfig, map[string]string{"target": backend.URL})
+
+	if w := postJob(cfg, "create-3", "{}"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("first request got %d, want 503", w.Code)
+	}
+	if w := postJob(cfg, "create-3", "{}"); w.Code != http.StatusCreated || w.Body.String() != "job-3" {
+		t.Fatalf("client retry after a 503 got %d %q, want it run again", w.Code, w.Body)
+	}
+}
+
+func TestIdempotencyKeyReuseRejected(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	backend := newJobBackend(t, release, 0)
+	cfg := loadTestConfig(t, idempotencyConfig, map[string]string{"target": backend.URL})
+
+	postJob(cfg, "create-4", `{"name": "a"}`)
+	if w := postJob(cfg, "create-4", `{"name": "b"}`); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("key reused for another body got %d, want 422", w.Code)
+	}
+	if n := backend.created.Load(); n != 1 {
+		t.Fatalf("backend created %d jobs", n)
+	}
+}
+
+const idempotencyCompressionConfig = `
+services:
+  jobs:
+    target: "{{target}}"
+    idempotency: {enabled: true}
+    compression: {min_size: 100}
+`
+
+// Replays negotiate compression for themselves rather than inheriting the
+// first response's encoding.
+func TestIdempotencyReplayCompression(t *testing.T) {
+	doc := `{"job": "` + strings.Repeat("nightly-", 100) + `"}`
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, doc)
+	}))
+	defer backend.Close()
+	cfg := loadTestConfig(t, idempotencyCompressionConfig, map[string]string{"target": backend.URL})
+
+	post := func(acceptEncoding string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/jobs/", strings.NewReader("{}"))
+		r.Header.Set("Idempotency-Key", "create-5")
+		if acceptEncoding != "" {
+			r.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		return serve(cfg, r)
+	}
+	decoded := func(w *httptest.ResponseRecorder) string {
+		t.Helper()
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			return w.Body.String()
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatalf("gzip-labelled body: %v", err)
+		}
+		body, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("gzip-labelled body: %v", err)
+		}
+		return string(body)
+	}
+
+	tests := []struct {
+		name, acceptEncoding, wantEncoding string
+		replayed                           bool
+	}{
+		{"first request", "gzip", "gzip", false},
+		{"replay to a gzip client", "gzip", "gzip", true},
+		{"replay to a client without gzip", "", "", true},
+		{"replay to a gzip client after a plain one", "gzip", "gzip", true},
+	}
+	for _, tt := range tests {
+		w := post(tt.acceptEncoding)
+		if got := w.Header().Get("Idempotent-Replayed") == "true"; got != tt.replayed {
+			t.Fatalf("%s: replayed %t, want %t", tt.name, got, tt.replayed)
+		}
+		if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Fatalf("%s: Content-Encoding %q, want %q", tt.name, got, tt.wantEncoding)
+		}
+		if w.Code != http.StatusCreated || decoded(w) != doc {
+			t.Fatalf("%s: %d with a body that doesn't match the backend's", tt.name, w.Code)
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxAuthCacheEntries = 10000
+
+var introspectionClient = &http.Client{Timeout: 5 * time.Second}
+
+// introspect asks the identity provider whether a bearer token is active
+// (RFC 7662), and which scopes it grants. With cache_ttl, active tokens are
+// remembered so repeat requests skip the round trip.
+func (ac *AuthConfig) introspect(token string) (active bool, scope string) {
+	key := sha256.Sum256([]byte(token))
+	if ac.cache != nil {
+		if scope, ok := ac.cache.valid(key); ok {
+			return true, scope
+		}
+	}
+
+	active, exp, scope, err := ac.introspectRemote(token)
+	if err != nil {
+		log.Printf("[auth] introspection failed: %v", err)
+		return false, ""
+	}
+	if active && ac.cache != nil {
+		ac.cache.add(key, ac.CacheTTL, exp, scope)
+	}
+	return active, scope
+}
+
+func (ac *AuthConfig) introspectRemote(token string) (active bool, exp time.Time, scope string, err error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, ac.IntrospectionURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, exp, "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if ac.ClientID != "" {
+		req.SetBasicAuth(ac.ClientID, ac.ClientSecret)
+	}
+
+	resp, err := introspectionClient.Do(req)
+	if err != nil {
+		return false, exp, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, exp, "", fmt.Errorf("%s returned %s", ac.IntrospectionURL, resp.Status)
+	}
+
+	var result struct {
+		Active bool   `json:"active"`
+		Exp    int64  `json:"exp"`
+		Scope  string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return false, exp, "", err
+	}
+	if result.Exp > 0 {
+		exp = time.Unix(result.Exp, 0)
+		if time.Now().After(exp) {
+			return false, exp, "", nil
+		}
+	}
+	return result.Active, exp, result.Scope, nil
+}
+
+// authCache remembers validated tokens by hash, never past the token's own
+// expiry.
+type authCache struct {
+	mu      sync.Mutex
+	entries map[[sha256.Size]byte]authCacheEntry
+}
+
+type authCacheEntry struct {
+	until time.Time
+	scope string
+}
+
+func newAuthCache() *authCache {
+	return &authCache{entries: make(map[[sha256.Size]byte]authCacheEntry)}
+}
+
+func (c *authCache) valid(key [sha256.Size]byte) (scope string, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(entry.until) {
+		delete(c.entries, key)
+		return "", false
+	}
+	return entry.scope, true
+}
+
+func (c *authCache) add(key [sha256.Size]byte, ttl time.Duration, exp time.Time, scope string) {
+	until := time.Now().Add(ttl)
+	if !exp.IsZero() && exp.Before(until) {
+		until = exp
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.entries) >= maxAuthCacheEntries {
+		c.evict()
+	}
+	c.entries[key] = authCacheEntry{until: until, scope: scope}
+}
+
+// evict drops expired entries, or an arbitrary tenth of the cache if none
+// have expired. Called with mu held.
+func (c *authCache) evict() {
+	now := time.Now()
+	for key, entry := range c.entries {
+		if now.After(entry.until) {
+			delete(c.entries, key)
+		}
+	}
+	for key := range c.entries {
+		if len(c.entries) < maxAuthCacheEntries*9/10 {
+			break
+		}
+		delete(c.entries, key)
+	}
+}
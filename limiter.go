@@ -0,0 +1,264 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// limiter decides whether a request identified by key fits within limit
+// requests per minute.
+type limiter interface {
+	allow(key string, limit int) bool
+}
+
+type RedisConfig struct {
+	Address  string        `yaml:"address"`
+	Password string        `yaml:"password,omitempty"`
+	DB       int           `yaml:"db,omitempty"`
+	Timeout  time.Duration `yaml:"timeout,omitempty"`
+}
+
+// limitGroup is the limiter shared by the services in a rate limit group,
+// along with the settings every member has to agree on.
+type limitGroup struct {
+	member    string
+	backend   string
+	persist   bool
+	stateFile string
+	limiter   limiter
+}
+
+// newLimiter builds the rate limiter for a service from its backend, or the
+// gateway-wide rate_limit_backend when the service doesn't choose one.
+// Services in a group get the group's limiter.
+func (c *Config) newLimiter(name string, rl *RateLimitConfig) (limiter, error) {
+	backend := rl.Backend
+	if backend == "" {
+		backend = c.RateLimitBackend
+	}
+
+	if rl.Group != "" {
+		if g, ok := c.limitGroups[rl.Group]; ok {
+			if g.backend != backend || g.persist != rl.Persist || g.stateFile != rl.StateFile {
+				return nil, fmt.Errorf("rate_limit group %q: %s and %s must use the same backend, persist and state_file", rl.Group, g.member, name)
+			}
+			return g.limiter, nil
+		}
+		l, err := c.backendLimiter(name, rl, backend)
+		if err != nil {
+			return nil, err
+		}
+		if c.limitGroups == nil {
+			c.limitGroups = make(map[string]*limitGroup)
+		}
+		c.limitGroups[rl.Group] = &limitGroup{member: name, backend: backend, persist: rl.Persist, stateFile: rl.StateFile, limiter: l}
+		return l, nil
+	}
+	return c.backendLimiter(name, rl, backend)
+}
+
+func (c *Config) backendLimiter(name string, rl *RateLimitConfig, backend string) (limiter, error) {
+	if rl.Persist && backend != "" && backend != "local" {
+		return nil, fmt.Errorf("rate_limit persist for %s requires the local backend", name)
+	}
+
+	switch backend {
+	case "", "local":
+		if !rl.Persist {
+			return newRateLimiter(), nil
+		}
+		return c.persistentLimiter(name, rl.StateFile)
+	case "redis":
+		if c.Redis == nil || c.Redis.Address == "" {
+			return nil, fmt.Errorf("rate_limit backend redis for %s requires redis.address", name)
+		}
+		if c.redisLimiter == nil {
+			c.redisLimiter = newRedisLimiter(c.Redis)
+		}
+		return c.redisLimiter, nil
+	default:
+		return nil, fmt.Errorf("invalid rate_limit backend for %s: %q", name, backend)
+	}
+}
+
+// redisLimiter counts requests in fixed one-minute windows shared by every
+// gateway instance using the same Redis. If Redis is unreachable, requests
+// are allowed rather than failing the service.
+type redisLimiter struct {
+	cfg   *RedisConfig
+	conns chan *redisConn
+}
+
+const redisPoolSize = 8
+
+func newRedisLimiter(cfg *RedisConfig) *redisLimiter {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = time.Second
+	}
+	return &redisLimiter{cfg: cfg, conns: make(chan *redisConn, redisPoolSize)}
+}
+
+func (rl *redisLimiter) allow(key string, limit int) bool {
+	window := time.Now().Unix() / 60
+	redisKey := fmt.Sprintf("gateway:ratelimit:%s:%d", key, window)
+
+	count, err := rl.incr(redisKey)
+	if err != nil {
+		log.Printf("[ratelimit] redis error, allowing request: %v", err)
+		return true
+	}
+	return count <= int64(limit)
+}
+
+// incr increments the window's counter, creating it with an expiry first so
+// a counter never outlives its window.
+func (rl *redisLimiter) incr(key string) (int64, error) {
+	conn, err := rl.get()
+	if err != nil {
+		return 0, err
+	}
+
+	replies, err := conn.do(rl.cfg.Timeout,
+		[]string{"SET", key, "0", "PX", "60000", "NX"},
+		[]string{"INCR", key},
+	)
+	if err != nil {
+		conn.Close()
+		return 0, err
+	}
+	rl.put(conn)
+
+	return strconv.ParseInt(replies[1], 10, 64)
+}
+
+func (rl *redisLimiter) get() (*redisConn, error) {
+	select {
+	case conn := <-rl.conns:
+		return conn, nil
+	default:
+	}
+
+	nc, err := net.DialTimeout("tcp", rl.cfg.Address, rl.cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: nc, r: bufio.NewReader(nc)}
+
+	var setup [][]string
+	if rl.cfg.Password != "" {
+		setup = append(setup, []string{"AUTH", rl.cfg.Password})
+	}
+	if rl.cfg.DB != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(rl.cfg.DB)})
+	}
+	if len(setup) > 0 {
+		if _, err := conn.do(rl.cfg.Timeout, setup...); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (rl *redisLimiter) put(conn *redisConn) {
+	select {
+	case rl.conns <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+// close closes the idle connections in the pool.
+func (rl *redisLimiter) close() {
+	for {
+		select {
+		case conn := <-rl.conns:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// redisConn speaks just enough RESP for pipelined commands with simple,
+// integer, bulk, and error replies.
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (rc *redisConn) do(timeout time.Duration, cmds ...[]string) ([]string, error) {
+	rc.SetDeadline(time.Now().Add(timeout))
+
+	var b strings.Builder
+	for _, args := range cmds {
+		fmt.Fprintf(&b, "*%d\r\n", len(args))
+		for _, arg := range args {
+			fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+		}
+	}
+	if _, err := rc.Write([]byte(b.String())); err != nil {
+		return nil, err
+	}
+
+	replies := make([]string, len(cmds))
+	var firstErr error
+	for i := range cmds {
+		reply, err := rc.readReply()
+		if err != nil {
+			var redisErr redisError
+			if !errors.As(err, &redisErr) {
+				return nil, err
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		replies[i] = reply
+	}
+	return replies, firstErr
+}
+
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+func (rc *redisConn) readReply() (string, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("redis: bad bulk length %q", line)
+		}
+		if n < 0 {
+			return "", nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rc.r, buf); err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	default:
+		return "", fmt.Errorf("redis: unsupported reply %q", line)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// persistentLimiter returns the local limiter whose request history is kept
+// in stateFile across restarts, loading it on first use. Keys carry the
+// service name, so services naming the same file share one limiter.
+func (c *Config) persistentLimiter(name, stateFile string) (*rateLimiter, error) {
+	if stateFile == "" {
+		return nil, fmt.Errorf("rate_limit persist for %s requires state_file", name)
+	}
+	if rl, ok := c.localLimiters[stateFile]; ok {
+		return rl, nil
+	}
+
+	rl := newRateLimiter()
+	rl.stateFile = stateFile
+	if err := rl.load(); err != nil {
+		log.Printf("[ratelimit] ignoring state file %s: %v", stateFile, err)
+	}
+	if c.localLimiters == nil {
+		c.localLimiters = make(map[string]*rateLimiter)
+	}
+	c.localLimiters[stateFile] = rl
+	return rl, nil
+}
+
+func (rl *rateLimiter) load() error {
+	data, err := os.ReadFile(rl.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var requests map[string][]time.Time
+	if err := json.Unmarshal(data, &requests); err != nil {
+		return err
+	}
+
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	cutoff := time.Now().Add(-time.Minute)
+	for key, reqs := range requests {
+		var recent []time.Time
+		for _, t := range reqs {
+			if t.After(cutoff) {
+				recent = append(recent, t)
+			}
+		}
+		if len(recent) > 0 {
+			rl.requests[key] = recent
+		}
+	}
+	return nil
+}
+
+// save writes the requests still within the window, replacing the state
+// file atomically.
+func (rl *rateLimiter) save() error {
+	rl.mu.Lock()
+	cutoff := time.Now().Add(-time.Minute)
+	requests := make(map[string][]time.Time, len(rl.requests))
+	for key, reqs := range rl.requests {
+		for i, t := range reqs {
+			if t.After(cutoff) {
+				requests[key] = reqs[i:]
+				break
+			}
+		}
+	}
+	data, err := json.Marshal(requests)
+	rl.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(rl.stateFile), filepath.Base(rl.stateFile)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), rl.stateFile)
+}
+
+func (c *Config) saveLimiterState() {
+	for stateFile, rl := range c.localLimiters {
+		if err := rl.save(); err != nil {
+			log.Printf("[ratelimit] saving state to %s: %v", stateFile, err)
+		}
+	}
+}
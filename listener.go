@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+type ListenerConfig struct {
+	ReusePort bool `yaml:"reuse_port"`
+	Backlog   int  `yaml:"backlog"`
+}
+
+// listen opens the gateway's TCP listener, applying SO_REUSEPORT and a
+// custom accept backlog when configured.
+func listen(addr string, lc *ListenerConfig) (net.Listener, error) {
+	if lc == nil {
+		return net.Listen("tcp", addr)
+	}
+
+	var cfg net.ListenConfig
+	if lc.ReusePort {
+		cfg.Control = reusePortControl
+	}
+
+	ln, err := cfg.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if lc.Backlog > 0 {
+		if err := setBacklog(ln, lc.Backlog); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
@@ -0,0 +1,19 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly)
+
+package main
+
+import (
+	"log"
+	"net"
+	"syscall"
+)
+
+func reusePortControl(network, address string, c syscall.RawConn) error {
+	log.Println("listener: reuse_port is not supported on this platform, ignoring")
+	return nil
+}
+
+func setBacklog(ln net.Listener, backlog int) error {
+	log.Println("listener: backlog is not supported on this platform, ignoring")
+	return nil
+}
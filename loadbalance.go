@@ -0,0 +1,145 @@
+package main
+
+import (
+	"crypto/cipher"
+	crand "crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type LoadBalanceConfig struct {
+	Strategy   string        `yaml:"strategy"` // round_robin (default), hash, cookie
+	HashHeader string        `yaml:"hash_header,omitempty"`
+	CookieName string        `yaml:"cookie_name,omitempty"`
+	CookieKey  string        `yaml:"cookie_key,omitempty"`
+	TTL        time.Duration `yaml:"ttl,omitempty"`
+	// DeterministicSeed makes percentage splits reproducible, for tests
+	DeterministicSeed *int64 `yaml:"deterministic_seed,omitempty"`
+	aead              cipher.AEAD
+	rngMu             sync.Mutex
+	rng               *rand.Rand
+}
+
+func (lb *LoadBalanceConfig) validate() error {
+	switch lb.Strategy {
+	case "", "round_robin":
+	case "hash":
+		if lb.HashHeader == "" {
+			return fmt.Errorf("strategy hash requires hash_header")
+		}
+	case "cookie":
+		if lb.CookieName == "" {
+			lb.CookieName = "GWAFFINITY"
+		}
+		if lb.TTL == 0 {
+			lb.TTL = time.Hour
+		}
+		var err error
+		if lb.aead, err = newAffinityCipher(os.ExpandEnv(lb.CookieKey)); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown strategy %q", lb.Strategy)
+	}
+	if lb.DeterministicSeed != nil {
+		lb.rng = rand.New(rand.NewSource(*lb.DeterministicSeed))
+	}
+	return nil
+}
+
+// splitPoint places a request in [0, 100) for percentage splits such as the
+// canary's. With deterministic_seed it is a hash of the seed and the request
+// ID, so the same IDs are split the same way on every run, in any order;
+// requests without an ID draw from a generator seeded with it. Without a
+// seed the point comes from crypto/rand, so clients can't predict which
+// side of a split their next request lands on.
+func (svc *Service) splitPoint(r *http.Request) float64 {
+	lb := svc.LoadBalance
+	if lb == nil || lb.rng == nil {
+		var b [8]byte
+		crand.Read(b[:])
+		return float64(binary.BigEndian.Uint64(b[:])>>11) / (1 << 53) * 100
+	}
+	if r != nil {
+		if id := requestIDFrom(r.Context()); id != "" {
+			h := hashKey(strconv.FormatInt(*lb.DeterministicSeed, 10) + "\x00" + id)
+			return float64(h>>11) / (1 << 53) * 100
+		}
+	}
+	lb.rngMu.Lock()
+	defer lb.rngMu.Unlock()
+	return lb.rng.Float64() * 100
+}
+
+// Virtual nodes per target; enough to spread keys evenly over a few targets
+const hashRingReplicas = 160
+
+type hashRingPoint struct {
+	hash uint64
+	up   *upstream
+}
+
+// hashRing maps keys to targets by consistent hashing, so adding or
+// removing a target only moves the keys that hashed to it.
+type hashRing []hashRingPoint
+
+func newHashRing(upstreams []*upstream) hashRing {
+	ring := make(hashRing, 0, len(upstreams)*hashRingReplicas)
+	for _, up := range upstreams {
+		for i := 0; i < hashRingReplicas; i++ {
+			ring = append(ring, hashRingPoint{hash: hashKey(up.url.String() + "#" + strconv.Itoa(i)), up: up})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	return ring
+}
+
+// hashKey is FNV-1a followed by the murmur3 finalizer; FNV alone clusters
+// keys that differ only in their last characters, like the replica suffixes.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+// get returns the target owning key, moving clockwise past targets that are
+// unavailable. If none is available it returns the key's owner anyway.
+func (ring hashRing) get(key string, now time.Time) *upstream {
+	h := hashKey(key)
+	start := sort.Search(len(ring), func(i int) bool { return ring[i].hash >= h })
+
+	for i := 0; i < len(ring); i++ {
+		up := ring[(start+i)%len(ring)].up
+		if up.available(now) {
+			return up
+		}
+	}
+	return ring[start%len(ring)].up
+}
+
+// hashTarget picks a target by the request's hash header, if the service
+// balances by hash and the header is present.
+func (svc *Service) hashTarget(r *http.Request, now time.Time) (*upstream, bool) {
+	if svc.hashRing == nil || r == nil {
+		return nil, false
+	}
+	key := r.Header.Get(svc.LoadBalance.HashHeader)
+	if key == "" {
+		return nil, false
+	}
+	return svc.hashRing.get(key, now), true
+}
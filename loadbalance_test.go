@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func testUpstreams(t *testing.T, n int) []*upstream {
+	t.Helper()
+	ups := make([]*upstream, n)
+	for i := range ups {
+		u, err := url.Parse(fmt.Sprintf("http://10.0.0.%d:8080", i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ups[i] = newUpstream(u)
+	}
+	return ups
+}
+
+func setUnhealthy(up *upstream, unhealthy bool) {
+	up.mu.Lock()
+	up.unhealthy = unhealthy
+	up.mu.Unlock()
+}
+
+func TestHashRingDistribution(t *testing.T) {
+	const keys = 20000
+	ups := testUpstreams(t, 4)
+	ring := newHashRing(ups)
+	now := time.Now()
+
+	owner := make(map[string]*upstream, keys)
+	counts := map[*upstream]int{}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("cache-key-%d", i)
+		up := ring.get(key, now)
+		owner[key] = up
+		counts[up]++
+	}
+	even := keys / len(ups)
+	for _, up := range ups {
+		if c := counts[up]; c < even*3/4 || c > even*5/4 {
+			t.Errorf("%s owns %d of %d keys, want about %d", up.url, c, keys, even)
+		}
+	}
+
+	// The same key keeps its target
+	for key, up := range owner {
+		if got := ring.get(key, now); got != up {
+			t.Fatalf("%s moved from %s to %s", key, up.url, got.url)
+		}
+	}
+
+	// Removing a target only moves the keys it owned
+	smaller := newHashRing(ups[:3])
+	for key, up := range owner {
+		got := smaller.get(key, now)
+		if up != ups[3] && got != up {
+			t.Fatalf("%s moved from %s to %s though its target stayed", key, up.url, got.url)
+		}
+	}
+}
+
+func TestHashRingSkipsUnavailable(t *testing.T) {
+	ups := testUpstreams(t, 3)
+	ring := newHashRing(ups)
+	now := time.Now()
+	key := "user-42"
+	owner := ring.get(key, now)
+	setUnhealthy(owner, true)
+
+	next := ring.get(key, now)
+	if next == owner {
+		t.Fatal("key still sent to its unhealthy target")
+	}
+	for i := 0; i < 10; i++ {
+		if got := ring.get(key, now); got != next {
+			t.Fatalf("key spread over %s and %s while its target was down", next.url, got.url)
+		}
+	}
+	setUnhealthy(owner, false)
+	if got := ring.get(key, now); got != owner {
+		t.Fatal("key didn't return to its target once it recovered")
+	}
+}
+
+const hashBalanceConfig = `
+services:
+  api:
+    targets: ["{{a}}", "{{b}}"]
+    load_balance: {strategy: hash, hash_header: X-Cache-Key}
+`
+
+func TestHashBalanceFallsBackToRoundRobin(t *testing.T) {
+	a, b := newTestBackend(t, http.StatusOK), newTestBackend(t, http.StatusOK)
+	cfg := loadTestConfig(t, hashBalanceConfig, map[string]string{"a": a.URL, "b": b.URL})
+
+	for i := 0; i < 10; i++ {
+		r := httptest.NewRequest(http.MethodGet, "/api/", nil)
+		r.Header.Set("X-Cache-Key", "same")
+		serve(cfg, r)
+	}
+	if a.hits.Load() != 10 && b.hits.Load() != 10 {
+		t.Fatalf("one key split %d/%d across targets", a.hits.Load(), b.hits.Load())
+	}
+
+	a.hits.Store(0)
+	b.hits.Store(0)
+	for i := 0; i < 10; i++ {
+		serve(cfg, httptest.NewRequest(http.MethodGet, "/api/", nil))
+	}
+	if a.hits.Load() != 5 || b.hits.Load() != 5 {
+		t.Fatalf("requests without the header split %d/%d, want round-robin", a.hits.Load(), b.hits.Load())
+	}
+}
+
+func TestSplitPointUnseeded(t *testing.T) {
+	svc := &Service{}
+	const n = 20000
+	var below10 int
+	for i := 0; i < n; i++ {
+		p := svc.splitPoint(nil)
+		if p < 0 || p >= 100 {
+			t.Fatalf("split point %g outside [0, 100)", p)
+		}
+		if p < 10 {
+			below10++
+		}
+	}
+	if share := float64(below10) / n; share < 0.09 || share > 0.11 {
+		t.Fatalf("%.1f%% of split points below 10", share*100)
+	}
+}
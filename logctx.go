@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type LogContextConfig struct {
+	Headers []string `yaml:"headers"`
+	Claims  []string `yaml:"claims"`
+	Mask    []string `yaml:"mask"`
+}
+
+// Headers that always carry credentials and are masked even when not listed
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "X-API-Key"}
+
+type logField struct {
+	key   string
+	value string
+}
+
+type logContext []logField
+
+// String renders the fields as " key=value" pairs, ready to append to a log line.
+func (lc logContext) String() string {
+	var b strings.Builder
+	for _, f := range lc {
+		v := f.value
+		if v == "" || strings.ContainsAny(v, " \t\r\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %s=%s", f.key, v)
+	}
+	return b.String()
+}
+
+type logContextKey struct{}
+
+func withLogContext(ctx context.Context, lc logContext) context.Context {
+	return context.WithValue(ctx, logContextKey{}, lc)
+}
+
+func logContextFrom(ctx context.Context) logContext {
+	lc, _ := ctx.Value(logContextKey{}).(logContext)
+	return lc
+}
+
+func (lcc *LogContextConfig) masked(header string) bool {
+	for _, h := range sensitiveHeaders {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	for _, h := range lcc.Mask {
+		if strings.EqualFold(h, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// build extracts the configured headers and token claims from the request.
+// Claims are only read from tokens the gateway has already authenticated
+// with auth, the request's.
+func (lcc *LogContextConfig) build(svc *Service, auth *AuthConfig, r *http.Request) logContext {
+	var lc logContext
+
+	for _, h := range lcc.Headers {
+		v := r.Header.Get(h)
+		if v == "" {
+			continue
+		}
+		if lcc.masked(h) || svc.LogRedaction.matchesHeader(h) {
+			v = maskValue(v)
+		}
+		lc = append(lc, logField{key: h, value: v})
+	}
+
+	if len(lcc.Claims) > 0 && auth != nil && (auth.Type == "bearer" || auth.Type == "introspection") {
+		claims := jwtClaims(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		for _, name := range lcc.Claims {
+			if v, ok := claims[name]; ok {
+				lc = append(lc, logField{key: name, value: fmt.Sprint(v)})
+			}
+		}
+	}
+
+	return lc
+}
+
+func maskValue(v string) string {
+	if len(v) <= 4 {
+		return "****"
+	}
+	return v[:4] + "****"
+}
+
+// jwtClaims decodes the payload of a JWT without verifying it.
+func jwtClaims(token string) map[string]interface{} {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil
+	}
+	return claims
+}
@@ -2,45 +2,251 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
+	"net/netip"
 	"net/url"
 	"os"
 	"os/signal"
+	"slices"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"text/template"
 	"time"
 
 	"gopkg.in/yaml.v3"
 )
 
 type Config struct {
-	Port     int                 `yaml:"port"`
-	Services map[string]*Service `yaml:"services"`
+	Port               int                       `yaml:"port"`
+	Listener           *ListenerConfig           `yaml:"listener,omitempty"`
+	LogContext         *LogContextConfig         `yaml:"log_context,omitempty"`
+	Record             *RecordConfig             `yaml:"record,omitempty"`
+	HTTP10             *HTTP10Config             `yaml:"http10,omitempty"`
+	AccessLogFormat    string                    `yaml:"access_log_format,omitempty"`
+	AccessLog          *AccessLogConfig          `yaml:"access_log,omitempty"`
+	WAF                *WAFConfig                `yaml:"waf,omitempty"`
+	StatsD             *StatsDConfig             `yaml:"statsd,omitempty"`
+	RootPath           *RootPathConfig           `yaml:"root_path,omitempty"`
+	HealthPath         string                    `yaml:"health_path,omitempty"`
+	ExposeTiming       bool                      `yaml:"expose_timing,omitempty"`
+	MetricsPath        string                    `yaml:"metrics_path,omitempty"`
+	StatsPath          string                    `yaml:"stats_path,omitempty"`
+	Admin              *AdminConfig              `yaml:"admin,omitempty"`
+	TLS                *TLSConfig                `yaml:"tls,omitempty"`
+	MTLS               *MTLSConfig               `yaml:"mtls,omitempty"`
+	SNIRoutes          map[string]string         `yaml:"sni_routes,omitempty"`
+	GeoIP              *GeoIPConfig              `yaml:"geoip,omitempty"`
+	Limits             *LimitsConfig             `yaml:"limits,omitempty"`
+	OverloadProtection *OverloadProtectionConfig `yaml:"overload_protection,omitempty"`
+	Decompression      *DecompressionConfig      `yaml:"decompression,omitempty"`
+	ReservedPrecedence string                    `yaml:"reserved_precedence,omitempty"` // gateway, services
+	Defaults           *DefaultsConfig           `yaml:"defaults,omitempty"`
+	StripTrailingSlash bool                      `yaml:"strip_trailing_slash,omitempty"`
+	LogConnectionInfo  bool                      `yaml:"log_connection_info,omitempty"`
+	RequestID          *RequestIDConfig          `yaml:"request_id,omitempty"`
+	ClientKeepalive    *KeepaliveConfig          `yaml:"client_keepalive,omitempty"`
+	ErrorFormat        string                    `yaml:"error_format,omitempty"` // text, json
+	IncludeRequestID   bool                      `yaml:"include_request_id,omitempty"`
+	RateLimitBackend   string                    `yaml:"rate_limit_backend,omitempty"` // local, redis
+	Redis              *RedisConfig              `yaml:"redis,omitempty"`
+	ShutdownReport     *ShutdownReportConfig     `yaml:"shutdown_report,omitempty"`
+	Services           map[string]*Service       `yaml:"services"`
+	recorder           *recorder
+	statsd             *statsdClient
+	otlp               *otlpExporter
+	metrics            *metricsRegistry
+	accessLog          *template.Template
+	reserved           map[string]http.Handler
+	draining           atomic.Bool
+	drainCut           atomic.Bool  // requests were cancelled at a drain timeout
+	inFlight           atomic.Int64 // requests routed to a service
+	active             atomic.Int64 // every request using this config, counted as it arrives; see gateway.ServeHTTP
+	redisLimiter       *redisLimiter
+	localLimiters      map[string]*rateLimiter // by state_file
+	limitGroups        map[string]*limitGroup
+	errors             *errorWriter
+	global             *globalLimiter
+	gateway            *gateway
+	serve              http.HandlerFunc
+	stopBackground     context.CancelFunc
 }
 
 type Service struct {
-	Target   string            `yaml:"target"`
-	Auth     *AuthConfig       `yaml:"auth,omitempty"`
-	RateLimit *RateLimitConfig `yaml:"rate_limit,omitempty"`
-	proxy    *httputil.ReverseProxy
+	Target                 string                   `yaml:"target"`
+	Targets                []string                 `yaml:"targets,omitempty"`
+	Auth                   *AuthConfig              `yaml:"auth,omitempty"`
+	AuthRules              []AuthRule               `yaml:"auth_rules,omitempty"`
+	ExtAuthz               *ExtAuthzConfig          `yaml:"ext_authz,omitempty"`
+	RateLimit              *RateLimitConfig         `yaml:"rate_limit,omitempty"`
+	HealthCheck            *HealthCheckConfig       `yaml:"health_check,omitempty"`
+	StartupProbe           *StartupProbeConfig      `yaml:"startup_probe,omitempty"`
+	OutlierDetection       *OutlierDetectionConfig  `yaml:"outlier_detection,omitempty"`
+	Canary                 *CanaryConfig            `yaml:"canary,omitempty"`
+	AffinityOverrides      []AffinityOverride       `yaml:"affinity_overrides,omitempty"`
+	RewriteURLs            *RewriteURLsConfig       `yaml:"rewrite_urls,omitempty"`
+	DetectContentType      bool                     `yaml:"detect_content_type,omitempty"`
+	ResponsePipeline       []PipelineStage          `yaml:"response_pipeline,omitempty"`
+	AccessLogFormat        string                   `yaml:"access_log_format,omitempty"`
+	LogRedaction           *LogRedactionConfig      `yaml:"log_redaction,omitempty"`
+	PathRules              *PathRulesConfig         `yaml:"path_rules,omitempty"`
+	MaxUpstreamConnections int                      `yaml:"max_upstream_connections,omitempty"`
+	Transport              *TransportConfig         `yaml:"transport,omitempty"`
+	UpstreamConnectionWait time.Duration            `yaml:"upstream_connection_wait,omitempty"`
+	Timeout                TimeoutConfig            `yaml:"timeout,omitempty"`
+	PropagateDeadline      *PropagateDeadlineConfig `yaml:"propagate_deadline,omitempty"`
+	LatencyBudget          time.Duration            `yaml:"latency_budget,omitempty"`
+	DeadlineHeaders        []string                 `yaml:"deadline_headers,omitempty"` // grpc-timeout, x-request-timeout, ...
+	Retry                  *RetryConfig             `yaml:"retry,omitempty"`
+	Hedging                *HedgingConfig           `yaml:"hedging,omitempty"`
+	Maintenance            *MaintenanceConfig       `yaml:"maintenance,omitempty"`
+	Cache                  *CacheConfig             `yaml:"cache,omitempty"`
+	Shutdown               *ShutdownConfig          `yaml:"shutdown,omitempty"`
+	ProfileSlow            *ProfileSlowConfig       `yaml:"profile_slow,omitempty"`
+	Concurrency            *ConcurrencyConfig       `yaml:"concurrency,omitempty"`
+	MaxBodySize            byteSize                 `yaml:"max_body_size,omitempty"`
+	BodyTransform          *BodyTransformConfig     `yaml:"body_transform,omitempty"`
+	MaxBufferedResponse    byteSize                 `yaml:"max_buffered_response,omitempty"`
+	Schema                 *SchemaConfig            `yaml:"schema,omitempty"`
+	MaxResponseHeaderSize  byteSize                 `yaml:"max_response_header_size,omitempty"`
+	BandwidthLimit         byteRate                 `yaml:"bandwidth_limit,omitempty"`
+	ClientBandwidthLimit   byteRate                 `yaml:"client_bandwidth_limit,omitempty"`
+	Compression            *CompressionConfig       `yaml:"compression,omitempty"`
+	WebSocket              *WebSocketConfig         `yaml:"websocket,omitempty"`
+	LoadBalance            *LoadBalanceConfig       `yaml:"load_balance,omitempty"`
+	GeoRoutes              map[string]string        `yaml:"geo_routes,omitempty"`
+	AllowedHosts           []string                 `yaml:"allowed_hosts,omitempty"`
+	MethodRewrite          map[string]string        `yaml:"method_rewrite,omitempty"`
+	Tenant                 *TenantConfig            `yaml:"tenant,omitempty"`
+	Tenants                map[string]yaml.Node     `yaml:"tenants,omitempty"`
+	ExpectContinueTimeout  time.Duration            `yaml:"expect_continue_timeout,omitempty"`
+	Mirror                 *MirrorConfig            `yaml:"mirror,omitempty"`
+	Idempotency            *IdempotencyConfig       `yaml:"idempotency,omitempty"`
+	Dedup                  *DedupConfig             `yaml:"dedup,omitempty"`
+	Priority               int                      `yaml:"priority,omitempty"` // see overload_protection
+	name                   string
+	upstreams              []*upstream
+	next                   uint64
+	ejectMu                sync.Mutex
+	proxy                  *httputil.ReverseProxy
+	transport              *http.Transport // the base of proxy's transport
+	accessLog              *template.Template
+	cache                  *responseCache
+	idempotency            *replayStore
+	dedup                  *replayStore
+	concurrency            *concurrencyLimiter
+	warming                atomic.Int32 // targets yet to pass the startup probe
+	requests               atomic.Uint64
+	bandwidth              *tokenBucket
+	clientBandwidth        *clientBuckets
+	taps                   tapHub
+	limiter                limiter
+	hashRing               hashRing
+	errors                 *errorWriter
+	decompression          *DecompressionConfig
+	pipeline               []responseStage
+	requestIDHeader        string
+	node                   *yaml.Node
+	tenants                map[string]*Service
+	tenantOf               string
+	drainCtx               context.Context
+	cancelDrain            context.CancelFunc
 }
 
 type AuthConfig struct {
-	Type   string   `yaml:"type"` // bearer, apikey
-	Tokens []string `yaml:"tokens"`
+	Type             string        `yaml:"type"` // bearer, apikey, introspection
+	Tokens           []string      `yaml:"tokens"`
+	IntrospectionURL string        `yaml:"introspection_url,omitempty"`
+	ClientID         string        `yaml:"client_id,omitempty"`
+	ClientSecret     string        `yaml:"client_secret,omitempty"`
+	CacheTTL         time.Duration `yaml:"cache_ttl,omitempty"`
+	RequiredScopes   []string      `yaml:"required_scopes,omitempty"` // bearer and introspection only
+	cache            *authCache
+}
+
+func (ac *AuthConfig) setup() error {
+	if ac.Type == "introspection" {
+		if ac.IntrospectionURL == "" {
+			return fmt.Errorf("auth type introspection requires introspection_url")
+		}
+		if ac.CacheTTL > 0 {
+			ac.cache = newAuthCache()
+		}
+	}
+	if len(ac.RequiredScopes) > 0 && ac.Type != "bearer" && ac.Type != "introspection" {
+		return fmt.Errorf("required_scopes requires bearer or introspection auth")
+	}
+	return nil
 }
 
 type RateLimitConfig struct {
-	RequestsPerMinute int `yaml:"requests_per_minute"`
+	RequestsPerMinute int            `yaml:"requests_per_minute"`
+	ByMethod          map[string]int `yaml:"by_method,omitempty"`
+	Backend           string         `yaml:"backend,omitempty"` // local, redis
+	Persist           bool           `yaml:"persist,omitempty"`
+	StateFile         string         `yaml:"state_file,omitempty"`
+	Group             string         `yaml:"group,omitempty"`         // services in a group share buckets
+	KnownClients      map[string]int `yaml:"known_clients,omitempty"` // per-minute limits for particular client IPs
+	known             map[netip.Addr]int
+}
+
+func (rl *RateLimitConfig) compile() error {
+	rl.known = make(map[netip.Addr]int, len(rl.KnownClients))
+	for s, limit := range rl.KnownClients {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return fmt.Errorf("known_clients: %w", err)
+		}
+		if limit < 0 {
+			return fmt.Errorf("known_clients: limit for %s must not be negative", s)
+		}
+		if limit == 0 {
+			limit = unlimited
+		}
+		rl.known[addr.Unmap()] = limit
+	}
+	return nil
+}
+
+// scope names what a service's buckets are counted under: its group, or the
+// service itself.
+func (rl *RateLimitConfig) scope(service string) string {
+	if rl.Group != "" {
+		return "group:" + rl.Group
+	}
+	return service
+}
+
+// A known client with a zero limit isn't limited at all, where any other
+// zero limit turns every request away.
+const unlimited = -1
+
+// limitFor returns the per-minute limit for a client's request and the
+// bucket it is counted in. A known client's limit covers all its requests;
+// otherwise methods with their own limit get their own bucket, and all
+// others share the default one.
+func (rl *RateLimitConfig) limitFor(method, clientIP string) (int, string) {
+	if addr, err := netip.ParseAddr(clientIP); err == nil {
+		if limit, ok := rl.known[addr.Unmap()]; ok {
+			return limit, "*"
+		}
+	}
+	if limit, ok := rl.ByMethod[method]; ok {
+		return limit, method
+	}
+	return rl.RequestsPerMinute, "*"
 }
 
 type rateLimiter struct {
-	mu       sync.Mutex
-	requests map[string][]time.Time
+	mu        sync.Mutex
+	requests  map[string][]time.Time
+	stateFile string
 }
 
 func newRateLimiter() *rateLimiter {
@@ -74,118 +280,773 @@ func (rl *rateLimiter) allow(key string, limit int) bool {
 	return true
 }
 
+// remoteIP returns the remote address without its port, so that every
+// connection from the same host shares rate-limit buckets.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
 func loadConfig(path string) (*Config, error) {
-	data, err := os.ReadFile(path)
+	data, err := readConfigSource(path, true)
 	if err != nil {
 		return nil, err
 	}
+	return parseConfig(path, data)
+}
 
+// parseConfig builds the config read from path.
+func parseConfig(path string, data []byte) (*Config, error) {
 	var cfg Config
 	if err := yaml.Unmarshal(data, &cfg); err != nil {
 		return nil, err
 	}
 
+	var err error
+	cfg.accessLog, err = parseAccessLogFormat("access_log_format", cfg.AccessLogFormat)
+	if err != nil {
+		return nil, fmt.Errorf("invalid access_log_format: %w", err)
+	}
+
+	if cfg.WAF != nil {
+		if err := cfg.WAF.compile(); err != nil {
+			return nil, fmt.Errorf("invalid waf config: %w", err)
+		}
+	}
+
+	switch cfg.ErrorFormat {
+	case "", "text", "json":
+	default:
+		return nil, fmt.Errorf("invalid error_format %q", cfg.ErrorFormat)
+	}
+	if cfg.IncludeRequestID && cfg.RequestID == nil {
+		return nil, fmt.Errorf("include_request_id requires request_id")
+	}
+	cfg.errors = &errorWriter{json: cfg.ErrorFormat == "json", includeRequestID: cfg.IncludeRequestID, drainBody: defaultRejectedBodyDrain}
+	if cfg.Limits != nil && cfg.Limits.DrainRejectedBody > 0 {
+		cfg.errors.drainBody = int64(cfg.Limits.DrainRejectedBody)
+	}
+	if err := cfg.expandTenants(); err != nil {
+		return nil, err
+	}
+	if cfg.Decompression != nil {
+		if err := cfg.Decompression.validate(); err != nil {
+			return nil, fmt.Errorf("invalid decompression config: %w", err)
+		}
+	}
+	if cfg.RequestID != nil {
+		cfg.RequestID.setDefaults()
+		if err := cfg.RequestID.compile(); err != nil {
+			return nil, fmt.Errorf("invalid request_id: %w", err)
+		}
+	}
+
 	// Initialize reverse proxies
 	for name, svc := range cfg.Services {
-		target, err := url.Parse(svc.Target)
+		svc.name = name
+		svc.errors = cfg.errors
+		svc.decompression = cfg.Decompression
+		if cfg.RequestID != nil {
+			svc.requestIDHeader = cfg.RequestID.Header
+		}
+		if cfg.Defaults != nil {
+			cfg.Defaults.applyTo(svc)
+		}
+		if svc.MaxBufferedResponse == 0 {
+			svc.MaxBufferedResponse = defaultMaxBufferedResponse
+		}
+
+		svc.accessLog, err = parseAccessLogFormat(name, svc.AccessLogFormat)
 		if err != nil {
-			return nil, fmt.Errorf("invalid target URL for %s: %w", name, err)
+			return nil, fmt.Errorf("invalid access_log_format for %s: %w", name, err)
+		}
+		if svc.accessLog == nil {
+			svc.accessLog = cfg.accessLog
+		}
+
+		targets := svc.Targets
+		if len(targets) == 0 {
+			targets = []string{svc.Target}
+		}
+		for _, raw := range targets {
+			target, err := url.Parse(raw)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target URL for %s: %w", name, err)
+			}
+			svc.upstreams = append(svc.upstreams, newUpstream(target))
+		}
+
+		if svc.LoadBalance != nil {
+			if err := svc.LoadBalance.validate(); err != nil {
+				return nil, fmt.Errorf("invalid load_balance for %s: %w", name, err)
+			}
+			if svc.LoadBalance.Strategy == "hash" {
+				svc.hashRing = newHashRing(svc.upstreams)
+			}
+		}
+		if err := svc.compileAffinityOverrides(); err != nil {
+			return nil, fmt.Errorf("invalid affinity_overrides for %s: %w", name, err)
+		}
+		if err := svc.buildPipeline(); err != nil {
+			return nil, fmt.Errorf("invalid response_pipeline for %s: %w", name, err)
+		}
+
+		if svc.Canary != nil {
+			target, err := url.Parse(svc.Canary.Target)
+			if err != nil {
+				return nil, fmt.Errorf("invalid canary target URL for %s: %w", name, err)
+			}
+			svc.Canary.upstream = newUpstream(target)
+			svc.Canary.setDefaults()
+			if err := svc.Canary.validate(); err != nil {
+				return nil, fmt.Errorf("invalid canary for %s: %w", name, err)
+			}
+		}
+
+		if svc.Auth != nil {
+			if err := svc.Auth.setup(); err != nil {
+				return nil, fmt.Errorf("invalid auth for %s: %w", name, err)
+			}
+		}
+		if err := svc.compileAuthRules(); err != nil {
+			return nil, fmt.Errorf("invalid auth_rules for %s: %w", name, err)
+		}
+
+		if svc.Mirror != nil {
+			if err := svc.Mirror.setup(); err != nil {
+				return nil, fmt.Errorf("invalid mirror target URL for %s: %w", name, err)
+			}
+			svc.Mirror.redaction = svc.LogRedaction
+			svc.Mirror.decompression = cfg.Decompression
+		}
+
+		if svc.PropagateDeadline != nil && svc.PropagateDeadline.Header == "" {
+			svc.PropagateDeadline.Header = "X-Request-Deadline"
+		}
+
+		if svc.Cache != nil {
+			if err := svc.Cache.compile(); err != nil {
+				return nil, fmt.Errorf("invalid cache for %s: %w", name, err)
+			}
+			svc.cache = newResponseCache(name, svc.Cache, svc.MaxBufferedResponse)
+		}
+		if svc.Idempotency != nil && svc.Idempotency.Enabled {
+			svc.Idempotency.setDefaults()
+			svc.idempotency = newReplayStore(name, svc.Idempotency.TTL, svc.Idempotency.MaxBodyBytes, svc.errors)
+		}
+		if svc.Dedup != nil && svc.Dedup.Enabled {
+			svc.Dedup.setDefaults()
+			svc.dedup = newReplayStore(name, svc.Dedup.Window, svc.Dedup.MaxBodyBytes, svc.errors)
+		}
+
+		if svc.RateLimit != nil {
+			if err := svc.RateLimit.compile(); err != nil {
+				return nil, fmt.Errorf("invalid rate_limit for %s: %w", name, err)
+			}
+			if svc.limiter, err = cfg.newLimiter(name, svc.RateLimit); err != nil {
+				return nil, err
+			}
+		}
+
+		svc.drainCtx, svc.cancelDrain = context.WithCancel(context.Background())
+		if svc.concurrency, err = newConcurrencyLimiter(name, svc.Concurrency); err != nil {
+			return nil, fmt.Errorf("invalid concurrency for %s: %w", name, err)
+		}
+		if svc.BandwidthLimit > 0 {
+			svc.bandwidth = newTokenBucket(svc.BandwidthLimit)
+		}
+		if svc.ClientBandwidthLimit > 0 {
+			svc.clientBandwidth = newClientBuckets(svc.ClientBandwidthLimit)
+		}
+
+		for i, host := range svc.AllowedHosts {
+			svc.AllowedHosts[i] = strings.ToLower(host)
+		}
+		if svc.Maintenance != nil {
+			svc.Maintenance.setDefaults()
+			if err := svc.Maintenance.compile(); err != nil {
+				return nil, fmt.Errorf("invalid maintenance for %s: %w", name, err)
+			}
+		}
+		if svc.LogRedaction != nil {
+			if err := svc.LogRedaction.compile(); err != nil {
+				return nil, fmt.Errorf("invalid log_redaction for %s: %w", name, err)
+			}
+		}
+		if err := svc.compileDeadlineHeaders(); err != nil {
+			return nil, fmt.Errorf("invalid deadline_headers for %s: %w", name, err)
+		}
+		if err := svc.compileMethodRewrite(); err != nil {
+			return nil, fmt.Errorf("invalid method_rewrite for %s: %w", name, err)
+		}
+		if svc.ExtAuthz != nil {
+			svc.ExtAuthz.setDefaults()
+			if err := svc.ExtAuthz.validate(); err != nil {
+				return nil, fmt.Errorf("invalid ext_authz for %s: %w", name, err)
+			}
+		}
+		if svc.Schema != nil {
+			svc.Schema.setDefaults()
+			if err := svc.Schema.compile(); err != nil {
+				return nil, fmt.Errorf("invalid schema for %s: %w", name, err)
+			}
+		}
+		if svc.BodyTransform != nil {
+			svc.BodyTransform.setDefaults()
+			if err := svc.BodyTransform.validate(); err != nil {
+				return nil, fmt.Errorf("invalid body_transform for %s: %w", name, err)
+			}
+		}
+		if svc.WebSocket != nil {
+			if err := svc.WebSocket.compile(); err != nil {
+				return nil, fmt.Errorf("invalid websocket for %s: %w", name, err)
+			}
+		}
+		if svc.Compression != nil {
+			svc.Compression.setDefaults()
+			if err := svc.Compression.compile(); err != nil {
+				return nil, fmt.Errorf("invalid compression for %s: %w", name, err)
+			}
+		}
+
+		if svc.PathRules != nil {
+			if err := svc.PathRules.compile(); err != nil {
+				return nil, fmt.Errorf("invalid path_rules for %s: %w", name, err)
+			}
+		}
+		if svc.HealthCheck != nil {
+			svc.HealthCheck.setDefaults()
+		}
+		if svc.StartupProbe != nil {
+			if svc.HealthCheck == nil {
+				return nil, fmt.Errorf("startup_probe for %s requires health_check", name)
+			}
+			svc.StartupProbe.setDefaults()
+			for _, up := range svc.upstreams {
+				up.warming = true
+			}
+			if svc.Canary != nil {
+				svc.Canary.upstream.warming = true
+			}
+			svc.warming.Store(int32(len(svc.upstreams)))
+		}
+		if svc.OutlierDetection != nil {
+			svc.OutlierDetection.setDefaults()
+		}
+
+		svc.transport = svc.newTransport()
+		var transport http.RoundTripper = svc.transport
+		if svc.ProfileSlow != nil && svc.ProfileSlow.Enabled {
+			svc.ProfileSlow.setDefaults()
+			transport = &profileTransport{svc: svc, base: transport}
+		}
+		if svc.LatencyBudget < 0 {
+			return nil, fmt.Errorf("invalid latency_budget for %s: must not be negative", name)
+		}
+		if svc.LatencyBudget > 0 {
+			transport = &budgetTransport{svc: svc, base: transport}
+		}
+		if svc.Hedging != nil && svc.Hedging.Enabled {
+			svc.Hedging.setDefaults()
+			if err := svc.Hedging.validate(); err != nil {
+				return nil, fmt.Errorf("invalid hedging for %s: %w", name, err)
+			}
+			transport = &hedgeTransport{svc: svc, base: transport}
+		}
+		if svc.Retry != nil {
+			svc.Retry.setDefaults()
+			transport = &retryTransport{svc: svc, base: transport}
+		}
+
+		svc.proxy = &httputil.ReverseProxy{
+			Transport:      transport,
+			Director:       svc.director,
+			ModifyResponse: svc.modifyResponse,
+			ErrorHandler:   svc.errorHandler,
+			BufferPool:     proxyBuffers,
 		}
-		svc.proxy = httputil.NewSingleHostReverseProxy(target)
+	}
+
+	if cfg.RootPath != nil {
+		if err := cfg.RootPath.validate(cfg.Services); err != nil {
+			return nil, fmt.Errorf("invalid root_path: %w", err)
+		}
+	}
+	if err := cfg.validateSNIRoutes(); err != nil {
+		return nil, err
+	}
+	if cfg.GeoIP != nil {
+		if cfg.GeoIP.db, err = openGeoIPDB(cfg.GeoIP.Database); err != nil {
+			return nil, fmt.Errorf("invalid geoip database: %w", err)
+		}
+	}
+	if err := cfg.validateGeoRoutes(); err != nil {
+		return nil, err
+	}
+	if cfg.TLS != nil {
+		if err := cfg.TLS.validate(); err != nil {
+			return nil, fmt.Errorf("invalid tls: %w", err)
+		}
+	}
+	if cfg.MTLS != nil && cfg.TLS == nil {
+		return nil, fmt.Errorf("mtls requires tls")
+	}
+	switch cfg.ReservedPrecedence {
+	case "", "gateway", "services":
+	default:
+		return nil, fmt.Errorf("invalid reserved_precedence %q", cfg.ReservedPrecedence)
+	}
+	if cfg.HealthPath != "" {
+		cfg.registerReserved(cfg.HealthPath, http.HandlerFunc(cfg.gatewayHealthHandler))
+	}
+	if cfg.MetricsPath != "" {
+		cfg.metrics = newMetricsRegistry()
+		cfg.metrics.register(cfg.inFlightGauges()...)
+		cfg.metrics.register(cfg.mirrorCounters()...)
+		cfg.metrics.register(cfg.hedgeCounters()...)
+		cfg.metrics.register(cfg.queueMetrics(newHistogramVec("gateway_concurrency_queue_wait_seconds", "Time requests waited in the concurrency queue before getting a slot.", "service", queueWaitBuckets))...)
+		cfg.registerReserved(cfg.MetricsPath, cfg.metrics)
+	}
+	if cfg.StatsPath != "" {
+		cfg.registerReserved(cfg.StatsPath, http.HandlerFunc(cfg.statsHandler))
+	}
+	if cfg.global, err = newGlobalLimiter(cfg.Limits); err != nil {
+		return nil, fmt.Errorf("invalid limits: %w", err)
+	}
+	if cfg.OverloadProtection != nil {
+		cfg.OverloadProtection.setDefaults()
+		if err := cfg.OverloadProtection.validate(); err != nil {
+			return nil, fmt.Errorf("invalid overload_protection: %w", err)
+		}
+	}
+	if cfg.Admin != nil {
+		cfg.Admin.setDefaults()
+		if err := cfg.Admin.validate(); err != nil {
+			return nil, fmt.Errorf("invalid admin: %w", err)
+		}
+		cfg.registerAdmin()
+	}
+
+	if isRemoteConfig(path) {
+		cacheRemoteConfig(path, data)
 	}
 
 	return &cfg, nil
 }
 
-func (c *Config) authenticate(svc *Service, r *http.Request) bool {
-	if svc.Auth == nil {
-		return true
+// authenticate checks a request's credentials against ac, returning the
+// error to reject it with. A nil ac lets every request through.
+func (ac *AuthConfig) authenticate(r *http.Request) *gatewayError {
+	if ac == nil {
+		return nil
 	}
 
-	switch svc.Auth.Type {
+	var token, scope string
+	switch ac.Type {
 	case "bearer":
 		auth := r.Header.Get("Authorization")
 		if !strings.HasPrefix(auth, "Bearer ") {
-			return false
+			return errUnauthorized
 		}
-		token := strings.TrimPrefix(auth, "Bearer ")
-		for _, validToken := range svc.Auth.Tokens {
-			if token == validToken {
-				return true
-			}
+		token = strings.TrimPrefix(auth, "Bearer ")
+		if !slices.Contains(ac.Tokens, token) {
+			return errUnauthorized
+		}
+
+	case "introspection":
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") {
+			return errUnauthorized
+		}
+		token = strings.TrimPrefix(auth, "Bearer ")
+		var active bool
+		if active, scope = ac.introspect(token); !active {
+			return errUnauthorized
 		}
-		return false
 
 	case "apikey":
-		key := r.Header.Get("X-API-Key")
-		for _, validKey := range svc.Auth.Tokens {
-			if key == validKey {
-				return true
-			}
+		if !slices.Contains(ac.Tokens, r.Header.Get("X-API-Key")) {
+			return errUnauthorized
 		}
-		return false
 
 	default:
-		return true
+		return nil
+	}
+
+	if !ac.grantsScopes(token, scope) {
+		return errInsufficientScope
 	}
+	return nil
 }
 
-func (c *Config) handler(limiter *rateLimiter) http.HandlerFunc {
+func (c *Config) handler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		originalPath := r.URL.Path
+
+		removeHopHeaders(r.Header)
+		if c.RequestID != nil {
+			var ok bool
+			if r, ok = c.RequestID.assign(w, r); !ok {
+				c.errors.write(w, r, errInvalidRequestID)
+				return
+			}
+		}
+		if c.ClientKeepalive != nil {
+			c.ClientKeepalive.limitRequests(w, r)
+		}
+
+		if c.ExposeTiming {
+			w = &responseRecorder{ResponseWriter: w, status: http.StatusOK, beforeHeader: func(h http.Header) {
+				h.Set("X-Gateway-Duration", fmt.Sprintf("%.3fms", float64(time.Since(start))/float64(time.Millisecond)))
+			}}
+		}
+
+		if c.WAF != nil {
+			if rule := c.WAF.check(r); rule != nil {
+				log.Printf("[waf] blocked %s %q from %s: rule %q matched", r.Method, r.URL.Path, r.RemoteAddr, rule.Name)
+				c.errors.write(w, r, errWAFBlocked)
+				return
+			}
+		}
+
+		if c.MTLS != nil {
+			c.MTLS.forwardCertHeaders(r)
+		}
+
+		if !c.normalizeRequestPath(w, r) {
+			return
+		}
+
 		// Extract service name from path: /service-name/path
 		parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
-		if len(parts) == 0 || parts[0] == "" {
-			http.Error(w, "Service not specified", http.StatusBadRequest)
+
+		if h, ok := c.reservedHandler(r.URL.Path, parts[0]); ok {
+			h.ServeHTTP(w, r)
 			return
 		}
 
-		serviceName := parts[0]
+		c.inFlight.Add(1)
+		defer c.inFlight.Add(-1)
+
+		// SNI routes map a whole hostname to a service, so the path is kept intact
+		serviceName, sniRouted := c.sniRoute(r)
+		upstreamPath := r.URL.Path
+		if !sniRouted {
+			if parts[0] == "" {
+				var ok bool
+				if parts[0], ok = c.serveRoot(w, r); !ok {
+					return
+				}
+			}
+
+			serviceName = parts[0]
+			upstreamPath = "/"
+			if len(parts) > 1 {
+				upstreamPath = "/" + parts[1]
+			}
+		}
+
 		svc, ok := c.Services[serviceName]
-		if !ok {
-			http.Error(w, "Service not found", http.StatusNotFound)
+		if !ok || svc.tenantOf != "" {
+			c.errors.write(w, r, errServiceNotFound)
+			return
+		}
+		if !svc.hostAllowed(r.Host) {
+			c.errors.write(w, r, errHostNotAllowed)
 			return
 		}
+		if len(svc.GeoRoutes) > 0 {
+			serviceName, svc = c.geoRoute(serviceName, svc, r)
+		}
+		if svc.Tenant != nil {
+			svc = svc.tenantFor(r)
+			serviceName = svc.name
+		}
+		svc.requests.Add(1)
 
-		// Authentication
-		if !c.authenticate(svc, r) {
-			w.Header().Set("WWW-Authenticate", `Bearer realm="gateway"`)
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		if c.rejectDraining(w, r, svc) || c.shedForMemory(w, r, svc) || c.rejectMaintenance(w, r, svc) || c.rejectStarting(w, r, svc) {
 			return
 		}
+		if c.global != nil {
+			ok, o := c.global.acquire(r.Context(), svc.Priority)
+			if !ok {
+				c.errors.writeOverload(w, r, errGatewayAtCapacity, o)
+				return
+			}
+			defer c.global.release()
+		}
+
+		// Checked before anything is upgraded, so a cross-site page can't
+		// hijack a WebSocket with the user's cookies
+		if isWebSocketUpgrade(r) && !svc.WebSocket.originAllowed(r.Header.Get("Origin")) {
+			c.errors.write(w, r, errOriginNotAllowed)
+			return
+		}
+
+		if svc.PathRules != nil {
+			if e := svc.PathRules.check(upstreamPath); e != nil {
+				c.errors.write(w, r, e)
+				return
+			}
+		}
+
+		// Authentication
+		auth := svc.authFor(upstreamPath)
+		if auth != nil {
+			if e := auth.authenticate(r); e != nil {
+				c.statsd.count("auth_failures."+statsdName(serviceName), 1)
+				challenge := `Bearer realm="gateway"`
+				if e == errInsufficientScope {
+					challenge += fmt.Sprintf(`, error="insufficient_scope", scope=%q`, strings.Join(auth.RequiredScopes, " "))
+				}
+				w.Header().Set("WWW-Authenticate", challenge)
+				c.errors.write(w, r, e)
+				return
+			}
+		}
+
+		var lc logContext
+		if c.LogContext != nil {
+			lc = c.LogContext.build(svc, auth, r)
+			r = r.WithContext(withLogContext(r.Context(), lc))
+		}
 
 		// Rate limiting
 		if svc.RateLimit != nil {
-			clientIP := r.RemoteAddr
-			key := fmt.Sprintf("%s:%s", serviceName, clientIP)
-			if !limiter.allow(key, svc.RateLimit.RequestsPerMinute) {
-				w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", svc.RateLimit.RequestsPerMinute))
+			clientIP := remoteIP(r)
+			limit, bucket := svc.RateLimit.limitFor(r.Method, clientIP)
+			key := fmt.Sprintf("%s:%s:%s", svc.RateLimit.scope(serviceName), clientIP, bucket)
+			if limit != unlimited && !svc.limiter.allow(key, limit) {
+				w.Header().Set("X-RateLimit-Limit", fmt.Sprintf("%d", limit))
 				w.Header().Set("X-RateLimit-Remaining", "0")
 				w.Header().Set("Retry-After", "60")
-				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
+				c.statsd.count("rate_limited."+statsdName(serviceName), 1)
+				c.errors.write(w, r, errRateLimited)
+				return
+			}
+		}
+
+		if svc.ExtAuthz != nil && !svc.checkExtAuthz(w, r, upstreamPath) {
+			return
+		}
+
+		if svc.MaxBodySize > 0 {
+			if r.ContentLength > int64(svc.MaxBodySize) {
+				c.errors.write(w, r, errBodyTooLarge)
+				return
+			}
+			r.Body = http.MaxBytesReader(w, r.Body, int64(svc.MaxBodySize))
+		}
+
+		// The request schema describes JSON, so a form body is converted
+		// before it is checked and a JSON body checked before it is converted
+		formFirst := svc.BodyTransform != nil && svc.BodyTransform.From == "form"
+		if formFirst {
+			if e := svc.transformRequestBody(r); e != nil {
+				c.errors.write(w, r, e)
+				return
+			}
+		}
+
+		if svc.Schema != nil && svc.Schema.request != nil {
+			if e := svc.checkRequestSchema(r); e != nil {
+				c.errors.write(w, r, e)
+				return
+			}
+		}
+
+		if c.recorder != nil {
+			c.recorder.maybeRecord(r, svc.LogRedaction)
+		}
+
+		if svc.BodyTransform != nil && !formFirst {
+			if e := svc.transformRequestBody(r); e != nil {
+				c.errors.write(w, r, e)
 				return
 			}
 		}
 
 		// Rewrite path to remove service prefix
-		if len(parts) > 1 {
-			r.URL.Path = "/" + parts[1]
-		} else {
-			r.URL.Path = "/"
+		r.URL.Path = upstreamPath
+
+		if !r.ProtoAtLeast(1, 1) {
+			r = prepareHTTP10(w, r, c.HTTP10)
+		}
+
+		w = svc.throttle(w, r)
+		w, finishCompression := svc.compress(w, r)
+		defer finishCompression()
+
+		if svc.idempotency != nil {
+			var done func()
+			if w, done = svc.beginIdempotent(w, r); done == nil {
+				return
+			}
+			defer done()
+		}
+		if svc.dedup != nil {
+			var done func()
+			if w, done = svc.beginDedup(w, r); done == nil {
+				return
+			}
+			defer done()
+		}
+
+		if svc.cache != nil {
+			if ttl, ok := svc.Cache.ttlForPath(r.URL.Path); ok {
+				if key, ok := cacheKey(serviceName, r); ok {
+					if entry := svc.cache.get(key); entry != nil {
+						entry.serve(w, r, "HIT")
+						return
+					}
+					r = r.WithContext(withCacheKey(r.Context(), key, ttl))
+				}
+			}
+		}
+
+		r, stopDrain := svc.withDrain(r)
+		defer stopDrain()
+
+		if svc.Timeout.Total > 0 {
+			ctx, cancel := context.WithTimeout(r.Context(), svc.Timeout.Total)
+			defer cancel()
+			r = r.WithContext(ctx)
+		}
+		if svc.LatencyBudget > 0 {
+			// Counted from arrival, so time spent queued is spent
+			r = r.WithContext(withBudget(r.Context(), start.Add(svc.LatencyBudget)))
 		}
 
+		if ok, o := svc.concurrency.acquire(r.Context()); !ok {
+			c.errors.writeOverload(w, r, errAtCapacity, o)
+			return
+		}
+		defer svc.concurrency.release()
+
 		// Proxy request
-		log.Printf("[%s] %s %s -> %s%s", serviceName, r.Method, r.RemoteAddr, svc.Target, r.URL.Path)
-		svc.proxy.ServeHTTP(w, r)
+		up := svc.pickUpstream(r)
+		r = r.WithContext(withInbound(withUpstream(r.Context(), up), r))
+		if svc.accessLog == nil {
+			var conn string
+			if c.LogConnectionInfo {
+				conn = requestConnInfo(r).String()
+			}
+			if id := requestIDFrom(r.Context()); id != "" {
+				conn += " request_id=" + id
+			}
+			log.Printf("[%s] %s %s -> %s%s%s%s", serviceName, r.Method, r.RemoteAddr, up.url, r.URL.Path, lc, conn)
+		}
+
+		var reqBody *countingReader
+		if c.metrics != nil && r.ContentLength != 0 {
+			reqBody = &countingReader{ReadCloser: r.Body}
+			r.Body = reqBody
+		}
+
+		var mirrored <-chan *mirrorResult
+		if svc.Mirror != nil {
+			mirrored = svc.Mirror.start(r)
+		}
+
+		taps, tapBodies := svc.taps.sample()
+		var tapReqBody []byte
+		var tapResp *bodyCapture
+		if tapBodies {
+			tapReqBody, _ = peekRequestBody(r, tapBodyBytes)
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		var pw http.ResponseWriter = rec
+		if tapBodies {
+			tapResp = &bodyCapture{ResponseWriter: rec, limit: tapBodyBytes}
+			pw = tapResp
+		}
+		if mirrored != nil && svc.Mirror.Compare {
+			capture := &bodyCapture{ResponseWriter: pw, limit: svc.Mirror.MaxBodyBytes}
+			svc.proxy.ServeHTTP(capture, r)
+			go svc.Mirror.compare(c.statsd, serviceName, r.Method+" "+r.URL.RequestURI(), capture.result(rec.status), mirrored)
+		} else {
+			svc.proxy.ServeHTTP(pw, r)
+		}
+		c.statsd.requestDone(serviceName, rec.status, time.Since(start))
+
+		if c.metrics != nil {
+			var n int64
+			if reqBody != nil {
+				n = atomic.LoadInt64(&reqBody.n)
+			}
+			c.metrics.requestBytes.observe(serviceName, float64(n))
+			c.metrics.responseBytes.observe(serviceName, float64(rec.bytes))
+		}
+
+		if taps != nil {
+			ev := &tapEvent{
+				Time:           start,
+				Service:        serviceName,
+				Method:         r.Method,
+				Path:           originalPath,
+				ClientIP:       remoteIP(r),
+				RequestID:      requestIDFrom(r.Context()),
+				Target:         up.url.String(),
+				Status:         rec.status,
+				LatencyMS:      float64(time.Since(start)) / float64(time.Millisecond),
+				RequestHeader:  r.Header,
+				ResponseHeader: rec.Header(),
+			}
+			if r.URL.RawQuery != "" {
+				ev.Path += "?" + r.URL.RawQuery
+			}
+			var respBody []byte
+			if tapResp != nil {
+				respBody = tapResp.buf.Bytes()
+			}
+			publishTap(taps, ev, tapReqBody, respBody, svc.LogRedaction)
+		}
+
+		if svc.accessLog == nil && c.otlp == nil {
+			return
+		}
+		entry := &accessLogEntry{
+			Time:       start,
+			Service:    serviceName,
+			Method:     r.Method,
+			Path:       originalPath,
+			Query:      r.URL.RawQuery,
+			Proto:      r.Proto,
+			Host:       r.Host,
+			RemoteAddr: r.RemoteAddr,
+			ClientIP:   remoteIP(r),
+			Target:     up.url.String(),
+			Status:     rec.status,
+			Bytes:      rec.bytes,
+			Latency:    time.Since(start),
+			Header:     svc.LogRedaction.header(r.Header),
+			Conn:       requestConnInfo(r),
+			RequestID:  requestIDFrom(r.Context()),
+		}
+		if svc.accessLog != nil {
+			writeAccessLog(svc.accessLog, entry, lc)
+		}
+		c.otlp.export(entry, lc)
 	}
 }
 
 func main() {
-	configPath := "gateway.yaml"
-	if len(os.Args) > 1 {
-		configPath = os.Args[1]
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
 	}
 
-	cfg, err := loadConfig(configPath)
+	configPath := flag.String("config", "gateway.yaml", "config file path or http(s) URL")
+	flag.Parse()
+	if flag.NArg() > 0 {
+		*configPath = flag.Arg(0)
+	}
+
+	cfg, err := loadConfig(*configPath)
 	if err != nil {
 		log.Fatalf("Failed to load config: %v", err)
 	}
@@ -194,32 +1055,126 @@ func main() {
 		cfg.Port = 8080
 	}
 
-	limiter := newRateLimiter()
+	cfg.start()
+
+	if cfg.Record != nil && cfg.Record.Enabled {
+		cfg.recorder, err = newRecorder(cfg.Record)
+		if err != nil {
+			log.Fatalf("Failed to open record file: %v", err)
+		}
+	}
+
+	if cfg.StatsD != nil {
+		cfg.statsd, err = newStatsDClient(cfg.StatsD)
+		if err != nil {
+			log.Fatalf("Failed to set up statsd: %v", err)
+		}
+	}
+
+	if cfg.AccessLog != nil && cfg.AccessLog.OTLPEndpoint != "" {
+		cfg.otlp, err = newOTLPExporter(cfg.AccessLog)
+		if err != nil {
+			log.Fatalf("Failed to set up otlp access log: %v", err)
+		}
+	}
+
+	g := newGateway(*configPath, cfg)
 	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", cfg.Port),
-		Handler: cfg.handler(limiter),
+		Addr:        fmt.Sprintf(":%d", cfg.Port),
+		Handler:     g,
+		ConnState:   cfg.statsd.connState,
+		ConnContext: connContext,
 	}
 
 	// Graceful shutdown
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 
+	if cfg.TLS != nil {
+		server.TLSConfig, err = cfg.TLS.build()
+		if err != nil {
+			log.Fatalf("Failed to load TLS certificate: %v", err)
+		}
+		if cfg.MTLS != nil {
+			if err := cfg.MTLS.apply(server.TLSConfig); err != nil {
+				log.Fatalf("Failed to load client CA: %v", err)
+			}
+		}
+	}
+
+	ln, err := listen(server.Addr, cfg.Listener)
+	if err != nil {
+		log.Fatalf("Failed to listen: %v", err)
+	}
+	if cfg.Limits != nil && cfg.Limits.NewConnsPerSec > 0 {
+		ln = newThrottledListener(ln, cfg.Limits)
+	}
+
 	go func() {
 		log.Printf("Agent API Gateway listening on :%d", cfg.Port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		serve := server.Serve
+		if server.TLSConfig != nil {
+			serve = func(ln net.Listener) error { return server.ServeTLS(ln, "", "") }
+		}
+		if err := serve(ln); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Server error: %v", err)
 		}
 	}()
 
+	drain := make(chan os.Signal, 1)
+	if len(drainSignals) > 0 {
+		signal.Notify(drain, drainSignals...)
+	}
+	go func() {
+		for range drain {
+			g.current.Load().enterDrain("signal received")
+		}
+	}()
+
+	reload := make(chan os.Signal, 1)
+	if len(reloadSignals) > 0 {
+		signal.Notify(reload, reloadSignals...)
+	}
+	go func() {
+		for range reload {
+			g.reload("signal received")
+		}
+	}()
+
 	<-stop
 	log.Println("Shutting down gracefully...")
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// Requests still on configs replaced by a reload drain too
+	current := g.current.Load()
+	report := current.startShutdownReport()
+	var drainTimeout time.Duration
+	var endDrain []func()
+	for _, live := range current.liveConfigs() {
+		timeout, end := live.beginDrain()
+		drainTimeout = max(drainTimeout, timeout)
+		endDrain = append(endDrain, end)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
 	defer cancel()
 
-	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Shutdown error: %v", err)
+	err = server.Shutdown(ctx)
+	for _, end := range endDrain {
+		end()
+	}
+	current.finishShutdownReport(report, err)
+	if err != nil {
+		// Requests were cut off, but what the gateway holds is still saved
+		log.Printf("Shutdown error: %v", err)
 	}
 
+	if current.recorder != nil {
+		current.recorder.close()
+	}
+	current.saveLimiterState()
+	current.otlp.close()
+
+	if err != nil {
+		os.Exit(1)
+	}
 	log.Println("Gateway stopped")
 }
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// MaintenanceConfig takes a service out of service for everyone except
+// operators, who can reach the backend with the bypass token or from a
+// bypass address to check it before reopening.
+type MaintenanceConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	RetryAfter   time.Duration `yaml:"retry_after,omitempty"`
+	BypassToken  string        `yaml:"bypass_token,omitempty"`
+	BypassHeader string        `yaml:"bypass_header,omitempty"`
+	BypassIPs    []string      `yaml:"bypass_ips,omitempty"` // addresses or CIDR ranges
+	active       atomic.Bool
+	prefixes     []netip.Prefix
+}
+
+func (mc *MaintenanceConfig) setDefaults() {
+	if mc.RetryAfter == 0 {
+		mc.RetryAfter = 5 * time.Minute
+	}
+	if mc.BypassHeader == "" {
+		mc.BypassHeader = "X-Maintenance-Bypass"
+	}
+	mc.BypassToken = os.ExpandEnv(mc.BypassToken)
+}
+
+func (mc *MaintenanceConfig) compile() error {
+	for _, s := range mc.BypassIPs {
+		if !strings.Contains(s, "/") {
+			addr, err := netip.ParseAddr(s)
+			if err != nil {
+				return fmt.Errorf("bypass_ips: %w", err)
+			}
+			mc.prefixes = append(mc.prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return fmt.Errorf("bypass_ips: %w", err)
+		}
+		mc.prefixes = append(mc.prefixes, prefix.Masked())
+	}
+	mc.active.Store(mc.Enabled)
+	return nil
+}
+
+// bypass reports whether r may pass through maintenance. The token is
+// removed from the request either way, so it never reaches the backend.
+func (mc *MaintenanceConfig) bypass(r *http.Request) bool {
+	token := r.Header.Get(mc.BypassHeader)
+	r.Header.Del(mc.BypassHeader)
+	if mc.BypassToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(mc.BypassToken)) == 1 {
+		return true
+	}
+
+	addr, err := netip.ParseAddr(remoteIP(r))
+	if err != nil {
+		return false
+	}
+	addr = addr.Unmap()
+	for _, p := range mc.prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// rejectMaintenance turns away requests for a service in maintenance,
+// letting operators through.
+func (c *Config) rejectMaintenance(w http.ResponseWriter, r *http.Request, svc *Service) bool {
+	mc := svc.Maintenance
+	if mc == nil {
+		return false
+	}
+	if !mc.active.Load() {
+		r.Header.Del(mc.BypassHeader)
+		return false
+	}
+	if mc.bypass(r) {
+		log.Printf("[%s] maintenance bypassed by %s for %s %q", svc.name, remoteIP(r), r.Method, r.URL.Path)
+		return false
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(mc.RetryAfter.Seconds())))
+	c.errors.write(w, r, errMaintenance)
+	return true
+}
+
+// maintenanceHandler turns a service's maintenance mode on or off at run
+// time, e.g. POST /admin/maintenance?service=api&enabled=false.
+func (c *Config) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	q := r.URL.Query()
+	name := q.Get("service")
+	svc, ok := c.Services[name]
+	if !ok || svc.Maintenance == nil {
+		http.Error(w, fmt.Sprintf("service %q has no maintenance config", name), http.StatusBadRequest)
+		return
+	}
+	enabled, err := strconv.ParseBool(q.Get("enabled"))
+	if err != nil {
+		http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+
+	// Tenant variants are services of their own, built from the same config
+	svc.Maintenance.active.Store(enabled)
+	for _, variant := range svc.tenants {
+		if variant.Maintenance != nil {
+			variant.Maintenance.active.Store(enabled)
+		}
+	}
+	state := "disabled"
+	if enabled {
+		state = "enabled"
+	}
+	log.Printf("[%s] maintenance %s by %s", name, state, remoteIP(r))
+	w.WriteHeader(http.StatusNoContent)
+}
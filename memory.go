@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime/metrics"
+	"sync/atomic"
+	"time"
+)
+
+// OverloadProtectionConfig sheds low-priority traffic while the heap is
+// over a threshold, as a last line of defence against the gateway being
+// killed for running out of memory.
+type OverloadProtectionConfig struct {
+	MaxHeapMB         int           `yaml:"max_heap_mb"`
+	ShedPriorityBelow int           `yaml:"shed_priority_below,omitempty"` // services with a lower priority are shed
+	CheckInterval     time.Duration `yaml:"check_interval,omitempty"`
+	shedding          atomic.Bool
+}
+
+// Shedding stops once the heap falls this far below the threshold, so the
+// gateway doesn't flap around it
+const memoryRecoveryRatio = 0.9
+
+// heapMetric is the heap still reachable at the end of the last
+// collection. The runtime collects more often as it grows, so the figure
+// stays current under memory pressure without any garbage in it.
+const heapMetric = "/gc/heap/live:bytes"
+
+func (op *OverloadProtectionConfig) setDefaults() {
+	if op.ShedPriorityBelow == 0 {
+		op.ShedPriorityBelow = 1
+	}
+	if op.CheckInterval == 0 {
+		op.CheckInterval = time.Second
+	}
+}
+
+func (op *OverloadProtectionConfig) validate() error {
+	if op.MaxHeapMB <= 0 {
+		return fmt.Errorf("max_heap_mb must be positive")
+	}
+	return nil
+}
+
+// monitor samples the heap every check_interval and turns shedding on and
+// off. Reading runtime/metrics doesn't stop the world, unlike
+// runtime.ReadMemStats, and the live heap it reports needs no collection
+// of our own to leave garbage out.
+func (op *OverloadProtectionConfig) monitor(ctx context.Context) {
+	limit := float64(op.MaxHeapMB << 20)
+	sample := []metrics.Sample{{Name: heapMetric}}
+	heap := func() float64 {
+		metrics.Read(sample)
+		return float64(sample[0].Value.Uint64())
+	}
+
+	ticker := time.NewTicker(op.CheckInterval)
+	defer ticker.Stop()
+
+	for ; ctx.Err() == nil; tick(ctx, ticker) {
+		h := heap()
+		mb := int(h) >> 20
+
+		switch {
+		case h > limit && !op.shedding.Load():
+			op.shedding.Store(true)
+			log.Printf("[gateway] heap at %dMB, over max_heap_mb %d: shedding services below priority %d", mb, op.MaxHeapMB, op.ShedPriorityBelow)
+		case h < limit*memoryRecoveryRatio && op.shedding.Load():
+			op.shedding.Store(false)
+			log.Printf("[gateway] heap down to %dMB: no longer shedding", mb)
+		}
+	}
+}
+
+// shedForMemory turns away requests for low-priority services while the
+// gateway is short of memory.
+func (c *Config) shedForMemory(w http.ResponseWriter, r *http.Request, svc *Service) bool {
+	op := c.OverloadProtection
+	if op == nil || !op.shedding.Load() || svc.Priority >= op.ShedPriorityBelow {
+		return false
+	}
+	c.statsd.count("memory_shed."+statsdName(svc.name), 1)
+	c.errors.writeOverload(w, r, errMemoryPressure, overload{reason: "memory_pressure", retryAfter: op.CheckInterval})
+	return true
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"runtime"
+	"testing"
+	"time"
+)
+
+var memorySink []byte
+
+// Shedding follows the live heap: garbage alone doesn't start it, and
+// freeing what was retained ends it.
+func TestOverloadProtectionLiveHeap(t *testing.T) {
+	runtime.GC()
+	op := &OverloadProtectionConfig{MaxHeapMB: 64, CheckInterval: 5 * time.Millisecond}
+	op.setDefaults()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go op.monitor(ctx)
+
+	waitFor := func(want bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for op.shedding.Load() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("shedding %t, want %t", !want, want)
+			}
+			runtime.GC()
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	for i := 0; i < 200; i++ {
+		memorySink = make([]byte, 1<<20) // 200MB of garbage
+	}
+	memorySink = nil
+	time.Sleep(20 * time.Millisecond)
+	if op.shedding.Load() {
+		t.Fatal("shedding on garbage")
+	}
+
+	retained := make([][]byte, 100)
+	for i := range retained {
+		retained[i] = make([]byte, 1<<20)
+	}
+	waitFor(true)
+	runtime.KeepAlive(retained)
+	retained = nil
+	waitFor(false)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// compileMethodRewrite upper-cases method_rewrite so it matches the
+// request line as sent.
+func (svc *Service) compileMethodRewrite() error {
+	if len(svc.MethodRewrite) == 0 {
+		return nil
+	}
+	methods := make(map[string]string, len(svc.MethodRewrite))
+	for from, to := range svc.MethodRewrite {
+		from, to = strings.ToUpper(from), strings.ToUpper(to)
+		for _, m := range []string{from, to} {
+			if m == "" || strings.Trim(m, "ABCDEFGHIJKLMNOPQRSTUVWXYZ-") != "" {
+				return fmt.Errorf("invalid method %q", m)
+			}
+		}
+		methods[from] = to
+	}
+	svc.MethodRewrite = methods
+	return nil
+}
+
+// rewriteMethod changes the method of an outgoing request whose inbound
+// method is listed in method_rewrite.
+func (svc *Service) rewriteMethod(req *http.Request, inbound string) {
+	to, ok := svc.MethodRewrite[inbound]
+	if !ok || to == req.Method {
+		return
+	}
+	log.Printf("[%s] rewriting method %s to %s for %s%s", svc.name, inbound, to, req.URL.Path, logContextFrom(req.Context()))
+	req.Method = to
+}
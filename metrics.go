@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// A minimal Prometheus text-format registry, to keep the gateway free of
+// client library dependencies.
+
+type collector interface {
+	writeTo(w io.Writer)
+}
+
+type metricsRegistry struct {
+	collectors    []collector
+	requestBytes  *histogramVec
+	responseBytes *histogramVec
+}
+
+var sizeBuckets = []float64{256, 1 << 10, 4 << 10, 16 << 10, 64 << 10, 256 << 10, 1 << 20, 4 << 20, 16 << 20, 64 << 20}
+
+func newMetricsRegistry() *metricsRegistry {
+	m := &metricsRegistry{
+		requestBytes:  newHistogramVec("gateway_request_body_bytes", "Size of request bodies sent upstream.", "service", sizeBuckets),
+		responseBytes: newHistogramVec("gateway_response_body_bytes", "Size of response bodies sent to clients.", "service", sizeBuckets),
+	}
+	m.register(m.requestBytes, m.responseBytes)
+	return m
+}
+
+func (m *metricsRegistry) register(collectors ...collector) {
+	m.collectors = append(m.collectors, collectors...)
+}
+
+func (m *metricsRegistry) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	for _, c := range m.collectors {
+		c.writeTo(w)
+	}
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	label   string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help, label string, buckets []float64) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		label:   label,
+		buckets: buckets,
+		series:  make(map[string]*histogram),
+	}
+}
+
+func (hv *histogramVec) observe(labelValue string, v float64) {
+	hv.mu.Lock()
+	h, ok := hv.series[labelValue]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(hv.buckets))}
+		hv.series[labelValue] = h
+	}
+	hv.mu.Unlock()
+
+	h.mu.Lock()
+	for i, upper := range hv.buckets {
+		if v <= upper {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+	h.mu.Unlock()
+}
+
+func (hv *histogramVec) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", hv.name, hv.help, hv.name)
+
+	hv.mu.Lock()
+	labels := make([]string, 0, len(hv.series))
+	for l := range hv.series {
+		labels = append(labels, l)
+	}
+	hv.mu.Unlock()
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		hv.mu.Lock()
+		h := hv.series[l]
+		hv.mu.Unlock()
+
+		h.mu.Lock()
+		var cumulative uint64
+		for i, upper := range hv.buckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{%s=%q,le=%q} %d\n", hv.name, hv.label, l, strconv.FormatFloat(upper, 'f', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s=%q,le=\"+Inf\"} %d\n", hv.name, hv.label, l, h.count)
+		fmt.Fprintf(w, "%s_sum{%s=%q} %g\n", hv.name, hv.label, l, h.sum)
+		fmt.Fprintf(w, "%s_count{%s=%q} %d\n", hv.name, hv.label, l, h.count)
+		h.mu.Unlock()
+	}
+}
+
+// funcMetric reports per-label values computed at scrape time, as a gauge
+// unless typ says otherwise.
+type funcMetric struct {
+	name   string
+	help   string
+	typ    string
+	label  string
+	values func() map[string]float64
+}
+
+func (g *funcMetric) writeTo(w io.Writer) {
+	typ := g.typ
+	if typ == "" {
+		typ = "gauge"
+	}
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", g.name, g.help, g.name, typ)
+
+	values := g.values()
+	labels := make([]string, 0, len(values))
+	for l := range values {
+		labels = append(labels, l)
+	}
+	sort.Strings(labels)
+
+	for _, l := range labels {
+		fmt.Fprintf(w, "%s{%s=%q} %g\n", g.name, g.label, l, values[l])
+	}
+}
+
+// countingReader counts bytes as the proxy streams a request body upstream.
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.ReadCloser.Read(p)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type MirrorConfig struct {
+	Target       string        `yaml:"target"`
+	Percent      float64       `yaml:"percent"` // default 100
+	Compare      bool          `yaml:"compare"`
+	DiffLog      bool          `yaml:"diff_log"`
+	MaxBodyBytes int64         `yaml:"max_body_bytes"`
+	Timeout      time.Duration `yaml:"timeout"`
+
+	url           *url.URL
+	client        *http.Client
+	redaction     *LogRedactionConfig // the service's, for diff_log
+	decompression *DecompressionConfig
+	inFlight      chan struct{}
+	matches       atomic.Uint64
+	mismatches    atomic.Uint64
+	errors        atomic.Uint64
+}
+
+// Mirrored requests beyond this are dropped rather than piling up behind a
+// slow mirror
+const maxMirrorsInFlight = 100
+
+func (mc *MirrorConfig) setup() error {
+	u, err := url.Parse(mc.Target)
+	if err != nil {
+		return err
+	}
+	mc.url = u
+	if mc.Percent == 0 {
+		mc.Percent = 100
+	}
+	if mc.MaxBodyBytes == 0 {
+		mc.MaxBodyBytes = 1 << 20
+	}
+	if mc.Timeout == 0 {
+		mc.Timeout = 30 * time.Second
+	}
+	mc.client = &http.Client{
+		Timeout:   mc.Timeout,
+		Transport: http.DefaultTransport.(*http.Transport).Clone(),
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	mc.inFlight = make(chan struct{}, maxMirrorsInFlight)
+	return nil
+}
+
+type mirrorResult struct {
+	status    int
+	header    http.Header
+	body      []byte
+	truncated bool
+	err       error
+}
+
+// start sends a copy of r to the mirror in the background and returns a
+// channel that yields the mirror's response, or nil if r isn't mirrored.
+// Bodies larger than max_body_bytes are not mirrored.
+func (mc *MirrorConfig) start(r *http.Request) <-chan *mirrorResult {
+	if rand.Float64()*100 >= mc.Percent || r.Header.Get("Upgrade") != "" {
+		return nil
+	}
+
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		var err error
+		body, err = peekRequestBody(r, mc.MaxBodyBytes+1)
+		if err != nil || int64(len(body)) > mc.MaxBodyBytes {
+			return nil
+		}
+	}
+
+	target := mc.url.JoinPath(r.URL.Path)
+	target.RawQuery = r.URL.RawQuery
+	req, err := http.NewRequestWithContext(context.Background(), r.Method, target.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil
+	}
+	req.Header = r.Header.Clone()
+	for _, h := range []string{"Connection", "Keep-Alive", "Proxy-Connection", "Te", "Transfer-Encoding", "Upgrade"} {
+		req.Header.Del(h)
+	}
+	req.Header.Set("X-Gateway-Mirror", "1")
+
+	select {
+	case mc.inFlight <- struct{}{}:
+	default:
+		return nil
+	}
+
+	results := make(chan *mirrorResult, 1)
+	go func() {
+		defer func() { <-mc.inFlight }()
+		results <- mc.send(req)
+	}()
+	return results
+}
+
+func (mc *MirrorConfig) send(req *http.Request) *mirrorResult {
+	resp, err := mc.client.Do(req)
+	if err != nil {
+		return &mirrorResult{err: err}
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, mc.MaxBodyBytes+1))
+	if err != nil {
+		return &mirrorResult{err: err}
+	}
+	res := &mirrorResult{status: resp.StatusCode, header: resp.Header, body: body}
+	if int64(len(body)) > mc.MaxBodyBytes {
+		res.body, res.truncated = body[:mc.MaxBodyBytes], true
+	}
+	return res
+}
+
+// compare waits for the mirror's response and checks it against what the
+// client got from the primary, counting and optionally logging differences.
+func (mc *MirrorConfig) compare(stats *statsdClient, service, request string, primary *mirrorResult, mirrored <-chan *mirrorResult) {
+	mirror := <-mirrored
+	if mirror.err != nil {
+		mc.errors.Add(1)
+		stats.count("mirror_errors."+statsdName(service), 1)
+		if mc.DiffLog {
+			log.Printf("[%s] mirror %s failed: %v", service, request, mirror.err)
+		}
+		return
+	}
+
+	diffs := responseDiffs(primary, mirror, mc.redaction, mc.decompression)
+	if len(diffs) == 0 {
+		mc.matches.Add(1)
+		stats.count("mirror_matches."+statsdName(service), 1)
+		return
+	}
+
+	mc.mismatches.Add(1)
+	stats.count("mirror_mismatches."+statsdName(service), 1)
+	if mc.DiffLog {
+		log.Printf("[%s] mirror mismatch %s: %s", service, request, strings.Join(diffs, "; "))
+	}
+}
+
+func responseDiffs(primary, mirror *mirrorResult, lr *LogRedactionConfig, dc *DecompressionConfig) []string {
+	var diffs []string
+	if primary.status != mirror.status {
+		diffs = append(diffs, fmt.Sprintf("status %d vs %d", primary.status, mirror.status))
+	}
+
+	a, b := decodedBody(primary, dc), decodedBody(mirror, dc)
+	if isJSON(primary.header) && isJSON(mirror.header) && !primary.truncated && !mirror.truncated {
+		var va, vb any
+		if json.Unmarshal(a, &va) == nil && json.Unmarshal(b, &vb) == nil {
+			if !reflect.DeepEqual(va, vb) {
+				diffs = append(diffs, "JSON bodies differ"+bodyDiff(a, b, lr))
+			}
+			return diffs
+		}
+	}
+
+	if primary.truncated || mirror.truncated {
+		// Only the captured prefixes can be compared
+		n := min(len(a), len(b))
+		a, b = a[:n], b[:n]
+	}
+	if !bytes.Equal(a, b) {
+		diffs = append(diffs, "bodies differ"+bodyDiff(a, b, lr))
+	}
+	return diffs
+}
+
+// bodyDiff describes where two bodies first differ, after redacting both.
+func bodyDiff(a, b []byte, lr *LogRedactionConfig) string {
+	a, b = lr.body(a), lr.body(b)
+	if bytes.Equal(a, b) {
+		return " in redacted fields"
+	}
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	snippet := func(p []byte) string {
+		end := min(i+40, len(p))
+		return string(p[min(i, end):end])
+	}
+	return fmt.Sprintf(" at byte %d: %q vs %q", i, snippet(a), snippet(b))
+}
+
+func decodedBody(res *mirrorResult, dc *DecompressionConfig) []byte {
+	if !strings.EqualFold(res.header.Get("Content-Encoding"), "gzip") {
+		return res.body
+	}
+	decoded, err := dc.gunzip(res.body, defaultMaxBufferedResponse)
+	if err != nil && len(decoded) == 0 {
+		// Compare the bodies as sent, bombs included
+		return res.body
+	}
+	return decoded
+}
+
+func isJSON(h http.Header) bool {
+	return strings.Contains(h.Get("Content-Type"), "json")
+}
+
+// bodyCapture keeps a copy of the first limit bytes of a response as it is
+// written to the client.
+type bodyCapture struct {
+	http.ResponseWriter
+	limit     int64
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (bc *bodyCapture) Write(p []byte) (int, error) {
+	if room := bc.limit - int64(bc.buf.Len()); room > 0 {
+		bc.buf.Write(p[:min(int64(len(p)), room)])
+		bc.truncated = bc.truncated || int64(len(p)) > room
+	} else if len(p) > 0 {
+		bc.truncated = true
+	}
+	return bc.ResponseWriter.Write(p)
+}
+
+func (bc *bodyCapture) Unwrap() http.ResponseWriter {
+	return bc.ResponseWriter
+}
+
+func (bc *bodyCapture) result(status int) *mirrorResult {
+	return &mirrorResult{status: status, header: bc.Header().Clone(), body: bc.buf.Bytes(), truncated: bc.truncated}
+}
+
+func (c *Config) mirrorCounters() []collector {
+	counter := func(name, help string, get func(*MirrorConfig) uint64) collector {
+		return &funcMetric{name: name, help: help, label: "service", typ: "counter", values: func() map[string]float64 {
+			values := make(map[string]float64)
+			for svcName, svc := range c.Services {
+				if svc.Mirror != nil && svc.Mirror.Compare {
+					values[svcName] = float64(get(svc.Mirror))
+				}
+			}
+			return values
+		}}
+	}
+	return []collector{
+		counter("gateway_mirror_matches_total", "Mirrored requests whose response matched the primary.", func(mc *MirrorConfig) uint64 { return mc.matches.Load() }),
+		counter("gateway_mirror_mismatches_total", "Mirrored requests whose response differed from the primary.", func(mc *MirrorConfig) uint64 { return mc.mismatches.Load() }),
+		counter("gateway_mirror_errors_total", "Mirrored requests that failed.", func(mc *MirrorConfig) uint64 { return mc.errors.Load() }),
+	}
+}
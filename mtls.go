@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	clientCertCNHeader          = "X-Client-Cert-CN"
+	clientCertSANHeader         = "X-Client-Cert-SAN"
+	clientCertFingerprintHeader = "X-Client-Cert-Fingerprint"
+)
+
+type MTLSConfig struct {
+	ClientCAFile       string `yaml:"client_ca_file"`
+	Required           bool   `yaml:"required"` // reject handshakes without a valid client certificate
+	ForwardCertHeaders bool   `yaml:"forward_cert_headers"`
+}
+
+func (mc *MTLSConfig) apply(tc *tls.Config) error {
+	pem, err := os.ReadFile(mc.ClientCAFile)
+	if err != nil {
+		return err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("no certificates found in %s", mc.ClientCAFile)
+	}
+
+	tc.ClientCAs = pool
+	tc.ClientAuth = tls.VerifyClientCertIfGiven
+	if mc.Required {
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// forwardCertHeaders replaces any client-supplied identity headers with the
+// details of the verified client certificate, if there is one.
+func (mc *MTLSConfig) forwardCertHeaders(r *http.Request) {
+	if !mc.ForwardCertHeaders {
+		return
+	}
+	r.Header.Del(clientCertCNHeader)
+	r.Header.Del(clientCertSANHeader)
+	r.Header.Del(clientCertFingerprintHeader)
+
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	sum := sha256.Sum256(cert.Raw)
+
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+
+	r.Header.Set(clientCertCNHeader, cert.Subject.CommonName)
+	r.Header.Set(clientCertFingerprintHeader, hex.EncodeToString(sum[:]))
+	if len(sans) > 0 {
+		r.Header.Set(clientCertSANHeader, strings.Join(sans, ","))
+	}
+}
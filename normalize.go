@@ -0,0 +1,53 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// normalizePath resolves "." and ".." segments and collapses repeated
+// slashes. It fails if ".." would climb into or above the first root
+// segments, i.e. out of the service the path was addressed to.
+func normalizePath(p string, root int, stripTrailingSlash bool) (string, bool) {
+	var segments []string
+	for _, seg := range strings.Split(p, "/") {
+		switch seg {
+		case "", ".":
+		case "..":
+			if len(segments) <= root {
+				return "", false
+			}
+			segments = segments[:len(segments)-1]
+		default:
+			segments = append(segments, seg)
+		}
+	}
+
+	normalized := "/" + strings.Join(segments, "/")
+	if strings.HasSuffix(p, "/") && len(segments) > 0 && !stripTrailingSlash {
+		normalized += "/"
+	}
+	return normalized, true
+}
+
+// normalizeRequestPath cleans the request path before routing. Paths routed
+// by SNI are rooted at "/"; all others at their /service-name/ prefix.
+func (c *Config) normalizeRequestPath(w http.ResponseWriter, r *http.Request) bool {
+	root := 1
+	if _, ok := c.sniRoute(r); ok {
+		root = 0
+	}
+
+	normalized, ok := normalizePath(r.URL.Path, root, c.StripTrailingSlash)
+	if !ok {
+		log.Printf("rejected path traversal %q from %s", r.URL.Path, r.RemoteAddr)
+		c.errors.write(w, r, errBadPath)
+		return false
+	}
+	if normalized != r.URL.Path {
+		r.URL.Path = normalized
+		r.URL.RawPath = ""
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type AccessLogConfig struct {
+	OTLPEndpoint  string            `yaml:"otlp_endpoint"`
+	OTLPHeaders   map[string]string `yaml:"otlp_headers,omitempty"`
+	ServiceName   string            `yaml:"service_name,omitempty"`
+	BatchSize     int               `yaml:"batch_size,omitempty"`
+	BufferSize    int               `yaml:"buffer_size,omitempty"`
+	FlushInterval time.Duration     `yaml:"flush_interval,omitempty"`
+	Timeout       time.Duration     `yaml:"timeout,omitempty"`
+}
+
+func (ac *AccessLogConfig) setDefaults() {
+	if ac.ServiceName == "" {
+		ac.ServiceName = "agent-api-gateway"
+	}
+	if ac.BatchSize == 0 {
+		ac.BatchSize = 512
+	}
+	if ac.BufferSize == 0 {
+		ac.BufferSize = 2048
+	}
+	if ac.FlushInterval == 0 {
+		ac.FlushInterval = 5 * time.Second
+	}
+	if ac.Timeout == 0 {
+		ac.Timeout = 10 * time.Second
+	}
+}
+
+// otlpExporter ships access log entries to an OpenTelemetry collector as
+// OTLP/HTTP JSON, batching them in a background goroutine. Records are
+// dropped if the buffer fills up. All methods are no-ops on a nil exporter.
+type otlpExporter struct {
+	cfg      *AccessLogConfig
+	endpoint string
+	client   *http.Client
+	ch       chan otlpLogRecord
+	stop     chan struct{}
+	done     chan struct{}
+	dropped  atomic.Uint64
+}
+
+func newOTLPExporter(cfg *AccessLogConfig) (*otlpExporter, error) {
+	cfg.setDefaults()
+
+	u, err := url.Parse(cfg.OTLPEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("otlp_endpoint must be an http(s) URL")
+	}
+	// A bare collector address gets the standard logs path
+	if u.Path == "" || u.Path == "/" {
+		u.Path = "/v1/logs"
+	}
+
+	e := &otlpExporter{
+		cfg:      cfg,
+		endpoint: u.String(),
+		client:   &http.Client{Timeout: cfg.Timeout},
+		ch:       make(chan otlpLogRecord, cfg.BufferSize),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+type otlpValue map[string]any
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpLogRecord struct {
+	TimeUnixNano         string          `json:"timeUnixNano"`
+	ObservedTimeUnixNano string          `json:"observedTimeUnixNano"`
+	SeverityNumber       int             `json:"severityNumber"`
+	SeverityText         string          `json:"severityText"`
+	Body                 otlpValue       `json:"body"`
+	Attributes           []otlpAttribute `json:"attributes"`
+	TraceID              string          `json:"traceId,omitempty"`
+	SpanID               string          `json:"spanId,omitempty"`
+}
+
+// export queues an access log entry. The record is built right away, as the
+// entry refers to the request.
+func (e *otlpExporter) export(entry *accessLogEntry, lc logContext) {
+	if e == nil {
+		return
+	}
+
+	var attrs []otlpAttribute
+	str := func(key, value string) {
+		if value != "" {
+			attrs = append(attrs, otlpAttribute{key, otlpValue{"stringValue": value}})
+		}
+	}
+	// OTLP JSON encodes 64-bit integers as strings
+	integer := func(key string, value int64) {
+		attrs = append(attrs, otlpAttribute{key, otlpValue{"intValue": strconv.FormatInt(value, 10)}})
+	}
+
+	str("gateway.service", entry.Service)
+	str("http.request.method", entry.Method)
+	str("url.path", entry.Path)
+	str("url.query", entry.Query)
+	str("network.protocol.version", strings.TrimPrefix(entry.Proto, "HTTP/"))
+	str("server.address", entry.Host)
+	str("client.address", entry.ClientIP)
+	str("gateway.target", entry.Target)
+	integer("http.response.status_code", int64(entry.Status))
+	integer("http.response.body.size", entry.Bytes)
+	attrs = append(attrs, otlpAttribute{"gateway.latency_ms", otlpValue{"doubleValue": float64(entry.Latency) / float64(time.Millisecond)}})
+	str("gateway.request_id", entry.RequestID)
+	for _, f := range lc {
+		str(f.key, f.value)
+	}
+
+	severity, severityText := 9, "INFO"
+	switch {
+	case entry.Status >= 500:
+		severity, severityText = 17, "ERROR"
+	case entry.Status >= 400:
+		severity, severityText = 13, "WARN"
+	}
+
+	rec := otlpLogRecord{
+		TimeUnixNano:         strconv.FormatInt(entry.Time.UnixNano(), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(time.Now().UnixNano(), 10),
+		SeverityNumber:       severity,
+		SeverityText:         severityText,
+		Body:                 otlpValue{"stringValue": fmt.Sprintf("%s %s %d", entry.Method, entry.Path, entry.Status)},
+		Attributes:           attrs,
+	}
+	// Correlate with the client's trace, if it sent a W3C traceparent
+	if parts := strings.Split(entry.Header.Get("Traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		rec.TraceID, rec.SpanID = parts[1], parts[2]
+	}
+
+	select {
+	case e.ch <- rec:
+	default:
+		e.dropped.Add(1)
+	}
+}
+
+func (e *otlpExporter) run() {
+	defer close(e.done)
+
+	ticker := time.NewTicker(e.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]otlpLogRecord, 0, e.cfg.BatchSize)
+	flush := func() {
+		if n := e.dropped.Swap(0); n > 0 {
+			log.Printf("otlp: dropped %d access log records, buffer full", n)
+		}
+		if len(batch) == 0 {
+			return
+		}
+		if err := e.send(batch); err != nil {
+			log.Printf("otlp: exporting %d access log records: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case rec := <-e.ch:
+			batch = append(batch, rec)
+			if len(batch) >= e.cfg.BatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-e.stop:
+			for {
+				select {
+				case rec := <-e.ch:
+					batch = append(batch, rec)
+					if len(batch) >= e.cfg.BatchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func (e *otlpExporter) send(batch []otlpLogRecord) error {
+	payload := map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{{"service.name", otlpValue{"stringValue": e.cfg.ServiceName}}},
+			},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "gateway.access_log"},
+				"logRecords": batch,
+			}},
+		}},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.OTLPHeaders {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// close exports whatever is still buffered, waiting up to the export timeout.
+func (e *otlpExporter) close() {
+	if e == nil {
+		return
+	}
+	close(e.stop)
+	select {
+	case <-e.done:
+	case <-time.After(e.cfg.Timeout):
+	}
+}
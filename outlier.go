@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+type OutlierDetectionConfig struct {
+	Consecutive5xx     int           `yaml:"consecutive_5xx"`
+	BaseEjectionTime   time.Duration `yaml:"base_ejection_time"`
+	MaxEjectionPercent int           `yaml:"max_ejection_percent"`
+	Interval           time.Duration `yaml:"interval"`
+	MinRequests        int           `yaml:"min_requests"`
+	ErrorRateThreshold float64       `yaml:"error_rate_threshold"`
+}
+
+func (od *OutlierDetectionConfig) setDefaults() {
+	if od.Consecutive5xx == 0 {
+		od.Consecutive5xx = 5
+	}
+	if od.BaseEjectionTime == 0 {
+		od.BaseEjectionTime = 30 * time.Second
+	}
+	if od.MaxEjectionPercent == 0 {
+		od.MaxEjectionPercent = 10
+	}
+	if od.Interval == 0 {
+		od.Interval = 10 * time.Second
+	}
+	if od.MinRequests == 0 {
+		od.MinRequests = 20
+	}
+	if od.ErrorRateThreshold == 0 {
+		od.ErrorRateThreshold = 0.3
+	}
+}
+
+func (svc *Service) recordResult(up *upstream, failed bool) {
+	if svc.Canary != nil && up == svc.Canary.upstream {
+		svc.Canary.recordResult(svc.name, failed)
+	}
+
+	od := svc.OutlierDetection
+	if od == nil {
+		return
+	}
+
+	up.mu.Lock()
+	up.requests++
+	if failed {
+		up.failures++
+		up.consecutive5xx++
+	} else {
+		up.consecutive5xx = 0
+	}
+	trip := up.consecutive5xx >= od.Consecutive5xx
+	count := up.consecutive5xx
+	up.mu.Unlock()
+
+	if trip {
+		svc.eject(up, fmt.Sprintf("%d consecutive 5xx", count))
+	}
+}
+
+// eject removes a target from rotation for a period that grows with each
+// repeated ejection, as long as doing so stays within max_ejection_percent.
+func (svc *Service) eject(up *upstream, reason string) {
+	od := svc.OutlierDetection
+
+	svc.ejectMu.Lock()
+	defer svc.ejectMu.Unlock()
+
+	now := time.Now()
+	if up.ejected(now) {
+		return
+	}
+
+	ejected := 0
+	for _, u := range svc.upstreams {
+		if u.ejected(now) {
+			ejected++
+		}
+	}
+	if ejected*100 >= od.MaxEjectionPercent*len(svc.upstreams) {
+		log.Printf("[%s] outlier detection: not ejecting %s (%s), max_ejection_percent reached", svc.name, up.url, reason)
+		return
+	}
+
+	up.mu.Lock()
+	up.ejections++
+	duration := od.BaseEjectionTime * time.Duration(up.ejections)
+	up.ejectedUntil = now.Add(duration)
+	up.consecutive5xx = 0
+	up.mu.Unlock()
+
+	log.Printf("[%s] outlier detection: ejecting %s for %s (%s)", svc.name, up.url, duration, reason)
+}
+
+func (svc *Service) detectOutliers(ctx context.Context) {
+	ticker := time.NewTicker(svc.OutlierDetection.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			svc.evaluateErrorRates()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// evaluateErrorRates ejects targets whose error rate over the last interval
+// is well above the average of their peers.
+func (svc *Service) evaluateErrorRates() {
+	od := svc.OutlierDetection
+	now := time.Now()
+
+	rates := make(map[*upstream]float64)
+	for _, up := range svc.upstreams {
+		up.mu.Lock()
+		requests, failures := up.requests, up.failures
+		up.requests, up.failures = 0, 0
+
+		// Healthy intervals gradually forgive past ejections
+		if failures == 0 && up.ejections > 0 && !up.ejectedUntil.After(now) {
+			up.ejections--
+		}
+		up.mu.Unlock()
+
+		if requests >= od.MinRequests {
+			rates[up] = float64(failures) / float64(requests)
+		}
+	}
+
+	if len(rates) < 2 {
+		return
+	}
+
+	total := 0.0
+	for _, rate := range rates {
+		total += rate
+	}
+
+	for up, rate := range rates {
+		peers := (total - rate) / float64(len(rates)-1)
+		if rate-peers > od.ErrorRateThreshold {
+			svc.eject(up, fmt.Sprintf("error rate %.0f%% vs peers %.0f%%", rate*100, peers*100))
+		}
+	}
+}
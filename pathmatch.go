@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// pathPattern matches request paths against a glob. "*" matches within a
+// segment, except as the final character where it matches any suffix
+// ("/v1/*" matches "/v1/a/b"); "?" matches one character.
+type pathPattern struct {
+	pattern string
+	re      *regexp.Regexp
+}
+
+func compilePathPattern(pattern string) (pathPattern, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i, ch := range pattern {
+		switch {
+		case ch == '*' && i == len(pattern)-1:
+			b.WriteString(".*")
+		case ch == '*':
+			b.WriteString("[^/]*")
+		case ch == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(string(ch)))
+		}
+	}
+	b.WriteString("$")
+
+	re, err := regexp.Compile(b.String())
+	if err != nil {
+		return pathPattern{}, err
+	}
+	return pathPattern{pattern: pattern, re: re}, nil
+}
+
+func (pp pathPattern) match(p string) bool {
+	return pp.re.MatchString(p)
+}
+
+func compilePathPatterns(patterns []string) ([]pathPattern, error) {
+	compiled := make([]pathPattern, 0, len(patterns))
+	for _, p := range patterns {
+		pp, err := compilePathPattern(p)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, pp)
+	}
+	return compiled, nil
+}
+
+func matchAny(patterns []pathPattern, p string) bool {
+	for _, pp := range patterns {
+		if pp.match(p) {
+			return true
+		}
+	}
+	return false
+}
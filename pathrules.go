@@ -0,0 +1,30 @@
+package main
+
+type PathRulesConfig struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+	allow []pathPattern
+	deny  []pathPattern
+}
+
+func (pr *PathRulesConfig) compile() error {
+	var err error
+	if pr.allow, err = compilePathPatterns(pr.Allow); err != nil {
+		return err
+	}
+	pr.deny, err = compilePathPatterns(pr.Deny)
+	return err
+}
+
+// check returns the error to reject a (prefix-stripped) path with, or nil if
+// it may be proxied. Deny rules take precedence over allow rules; paths
+// outside a non-empty allowlist are reported as not found.
+func (pr *PathRulesConfig) check(p string) *gatewayError {
+	if matchAny(pr.deny, p) {
+		return errPathDenied
+	}
+	if len(pr.allow) > 0 && !matchAny(pr.allow, p) {
+		return errPathNotAllowed
+	}
+	return nil
+}
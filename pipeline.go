@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// PipelineStage is one step of a service's response_pipeline: a bare name
+// such as "decompress", or a single-key map for a stage with settings, such
+// as {rewrite_urls: {from: ..., to: ...}}.
+type PipelineStage struct {
+	Name        string
+	RewriteURLs *RewriteURLsConfig
+}
+
+func (ps *PipelineStage) UnmarshalYAML(node *yaml.Node) error {
+	*ps = PipelineStage{}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		ps.Name = node.Value
+		return nil
+	case yaml.MappingNode:
+		if len(node.Content) != 2 {
+			return fmt.Errorf("line %d: a pipeline stage has exactly one name", node.Line)
+		}
+		ps.Name = node.Content[0].Value
+		if ps.Name != "rewrite_urls" {
+			return fmt.Errorf("line %d: stage %s takes no settings", node.Line, ps.Name)
+		}
+		ps.RewriteURLs = new(RewriteURLsConfig)
+		return node.Content[1].Decode(ps.RewriteURLs)
+	default:
+		return fmt.Errorf("line %d: invalid pipeline stage", node.Line)
+	}
+}
+
+// pipelineState is what stages learn about a response as it passes through.
+type pipelineState struct {
+	decompressed bool // by a decompress stage, for recompress to undo
+}
+
+type responseStage func(resp *http.Response, st *pipelineState) error
+
+// buildPipeline turns response_pipeline into the stages every response
+// passes through, in order. Services without one get the standalone
+// detect_content_type and rewrite_urls settings, in that order.
+func (svc *Service) buildPipeline() error {
+	stages := svc.ResponsePipeline
+	if stages == nil {
+		if svc.DetectContentType {
+			stages = append(stages, PipelineStage{Name: "detect_content_type"})
+		}
+		if svc.RewriteURLs != nil && svc.RewriteURLs.From != "" {
+			stages = append(stages, PipelineStage{Name: "rewrite_urls", RewriteURLs: svc.RewriteURLs})
+		}
+	} else if svc.DetectContentType || svc.RewriteURLs != nil {
+		return fmt.Errorf("detect_content_type and rewrite_urls go in the pipeline when there is one")
+	}
+
+	svc.pipeline = nil
+	decompressed := false
+	for i, ps := range stages {
+		var stage responseStage
+		switch ps.Name {
+		case "decompress":
+			stage, decompressed = svc.decompressStage, true
+		case "recompress":
+			if !decompressed {
+				return fmt.Errorf("stage %d: recompress requires an earlier decompress", i)
+			}
+			stage = svc.recompressStage
+		case "detect_content_type":
+			stage = svc.detectContentTypeStage
+		case "rewrite_urls":
+			ru := ps.RewriteURLs
+			if ru == nil || ru.From == "" {
+				return fmt.Errorf("stage %d: rewrite_urls requires from", i)
+			}
+			stage = func(resp *http.Response, _ *pipelineState) error { return svc.rewriteURLs(resp, ru) }
+		default:
+			return fmt.Errorf("stage %d: unknown stage %q", i, ps.Name)
+		}
+		svc.pipeline = append(svc.pipeline, stage)
+	}
+	return nil
+}
+
+func (svc *Service) transformResponse(resp *http.Response) error {
+	var st pipelineState
+	for _, stage := range svc.pipeline {
+		if err := stage(resp, &st); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// decompressStage decodes a gzip body, within max_buffered_response and the
+// decompression limits, so the stages after it see plain bytes. Bodies it
+// can't hold are left encoded.
+func (svc *Service) decompressStage(resp *http.Response, st *pipelineState) error {
+	if !strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		return nil
+	}
+	body, ok, err := readResponseBody(resp, int64(svc.MaxBufferedResponse), svc.decompression)
+	if err != nil || !ok {
+		return err
+	}
+	setResponseBody(resp, body)
+	st.decompressed = true
+	return nil
+}
+
+// recompressStage gzips a body that decompress decoded, so the client gets
+// the encoding the upstream chose for it.
+func (svc *Service) recompressStage(resp *http.Response, st *pipelineState) error {
+	if !st.decompressed || resp.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	body, ok, err := bufferResponseBody(resp, int64(svc.MaxBufferedResponse))
+	if err != nil || !ok {
+		return err
+	}
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(body)
+	zw.Close()
+	setResponseBody(resp, buf.Bytes())
+	resp.Header.Set("Content-Encoding", "gzip")
+	st.decompressed = false
+	return nil
+}
+
+func (svc *Service) detectContentTypeStage(resp *http.Response, _ *pipelineState) error {
+	return svc.detectContentType(resp)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+const pipelineConfig = `
+services:
+  api:
+    target: "{{target}}"
+    response_pipeline: {{pipeline}}
+`
+
+const pipelineBody = `{"next": "http://backend:8080/items?page=2"}`
+
+func gzipBytes(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(data))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Each stage sees the output of the one before it, so the same stages in
+// another order give a different response.
+func TestResponsePipelineOrder(t *testing.T) {
+	const rewritten = `{"next": "https://api.example.com/items?page=2"}`
+	rewrite := `{rewrite_urls: {from: "http://backend:8080", to: "https://api.example.com"}}`
+	tests := []struct {
+		name         string
+		pipeline     string
+		gzipped      bool
+		contentType  string
+		wantEncoding string
+		wantType     string
+		wantBody     string
+	}{
+		{
+			name:     "rewrite inside decompress and recompress",
+			pipeline: "[decompress, " + rewrite + ", recompress]",
+			gzipped:  true, contentType: "application/json",
+			wantEncoding: "gzip", wantType: "application/json", wantBody: rewritten,
+		},
+		{
+			name:     "rewrite before decompress leaves nothing to recompress",
+			pipeline: "[" + rewrite + ", decompress, recompress]",
+			gzipped:  true, contentType: "application/json",
+			wantEncoding: "", wantType: "application/json", wantBody: rewritten,
+		},
+		{
+			name:     "detection after decompress labels the body for rewriting",
+			pipeline: "[decompress, detect_content_type, " + rewrite + ", recompress]",
+			gzipped:  true, contentType: "text/plain",
+			wantEncoding: "gzip", wantType: "application/json", wantBody: rewritten,
+		},
+		{
+			name:     "detection before decompress sees an encoded body",
+			pipeline: "[detect_content_type, decompress, " + rewrite + ", recompress]",
+			gzipped:  true, contentType: "text/plain",
+			wantEncoding: "gzip", wantType: "text/plain", wantBody: pipelineBody,
+		},
+		{
+			name:         "detection after rewriting is too late for it",
+			pipeline:     "[" + rewrite + ", detect_content_type]",
+			contentType:  "text/plain",
+			wantEncoding: "", wantType: "application/json", wantBody: pipelineBody,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := []byte(pipelineBody)
+			if tt.gzipped {
+				body = gzipBytes(t, pipelineBody)
+			}
+			backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				if tt.gzipped {
+					w.Header().Set("Content-Encoding", "gzip")
+				}
+				w.Write(body)
+			}))
+			defer backend.Close()
+			cfg := loadTestConfig(t, pipelineConfig, map[string]string{"target": backend.URL, "pipeline": tt.pipeline})
+
+			r := httptest.NewRequest(http.MethodGet, "/api/items", nil)
+			r.Header.Set("Accept-Encoding", "gzip")
+			w := serve(cfg, r)
+			if got := w.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+				t.Fatalf("Content-Encoding %q, want %q", got, tt.wantEncoding)
+			}
+			if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.wantType) {
+				t.Fatalf("Content-Type %q, want %q", got, tt.wantType)
+			}
+			got := w.Body.Bytes()
+			if tt.wantEncoding == "gzip" {
+				zr, err := gzip.NewReader(bytes.NewReader(got))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got, err = io.ReadAll(zr); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(got) != tt.wantBody {
+				t.Fatalf("body %s, want %s", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestBuildPipelineErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		svc  *Service
+	}{
+		{"recompress without decompress", &Service{ResponsePipeline: []PipelineStage{{Name: "recompress"}, {Name: "decompress"}}}},
+		{"unknown stage", &Service{ResponsePipeline: []PipelineStage{{Name: "minify"}}}},
+		{"rewrite_urls without from", &Service{ResponsePipeline: []PipelineStage{{Name: "rewrite_urls", RewriteURLs: &RewriteURLsConfig{}}}}},
+		{"standalone setting with a pipeline", &Service{ResponsePipeline: []PipelineStage{{Name: "decompress"}}, DetectContentType: true}},
+	}
+	for _, tt := range tests {
+		if err := tt.svc.buildPipeline(); err == nil {
+			t.Errorf("%s: built", tt.name)
+		}
+	}
+}
+
+// Without a pipeline the standalone settings run detection first
+func TestBuildPipelineStandaloneOrder(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, pipelineBody)
+	}))
+	defer backend.Close()
+	cfg := loadTestConfig(t, `
+services:
+  api:
+    target: "{{target}}"
+    detect_content_type: true
+    rewrite_urls: {from: "http://backend:8080", to: "https://api.example.com"}
+`, map[string]string{"target": backend.URL})
+
+	w := serve(cfg, httptest.NewRequest(http.MethodGet, "/api/items", nil))
+	if !strings.Contains(w.Body.String(), "https://api.example.com/items") {
+		t.Fatalf("body %s not rewritten after detection", w.Body)
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ProfileSlowConfig struct {
+	Enabled   bool          `yaml:"enabled"`
+	Threshold time.Duration `yaml:"threshold"`
+}
+
+func (pc *ProfileSlowConfig) setDefaults() {
+	if pc.Threshold == 0 {
+		pc.Threshold = 5 * time.Second
+	}
+}
+
+// requestTiming collects connection phase timestamps from httptrace. Only
+// timestamps are recorded on the hot path; the breakdown is formatted for
+// requests that turn out to be slow.
+type requestTiming struct {
+	mu                     sync.Mutex
+	start                  time.Time
+	dnsStart, dnsDone      time.Time
+	connectStart, connDone time.Time
+	tlsStart, tlsDone      time.Time
+	gotConn, wroteRequest  time.Time
+	firstByte              time.Time
+	reused                 bool
+}
+
+func (rt *requestTiming) mark(t *time.Time) {
+	rt.mu.Lock()
+	*t = time.Now()
+	rt.mu.Unlock()
+}
+
+func (rt *requestTiming) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { rt.mark(&rt.dnsStart) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { rt.mark(&rt.dnsDone) },
+		ConnectStart:      func(string, string) { rt.mark(&rt.connectStart) },
+		ConnectDone:       func(string, string, error) { rt.mark(&rt.connDone) },
+		TLSHandshakeStart: func() { rt.mark(&rt.tlsStart) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { rt.mark(&rt.tlsDone) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			rt.mark(&rt.gotConn)
+			rt.mu.Lock()
+			rt.reused = info.Reused
+			rt.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { rt.mark(&rt.wroteRequest) },
+		GotFirstResponseByte: func() { rt.mark(&rt.firstByte) },
+	}
+}
+
+func (rt *requestTiming) String() string {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	var b strings.Builder
+	phase := func(name string, from, to time.Time) {
+		if !from.IsZero() && !to.IsZero() {
+			fmt.Fprintf(&b, " %s=%s", name, to.Sub(from).Round(time.Microsecond))
+		}
+	}
+	phase("dns", rt.dnsStart, rt.dnsDone)
+	phase("connect", rt.connectStart, rt.connDone)
+	phase("tls", rt.tlsStart, rt.tlsDone)
+	phase("conn_wait", rt.start, rt.gotConn)
+	phase("ttfb", rt.wroteRequest, rt.firstByte)
+	fmt.Fprintf(&b, " reused=%t", rt.reused)
+	return b.String()
+}
+
+// profileTransport logs a timing breakdown of upstream round trips that take
+// longer than the threshold, including the time to read the response body.
+type profileTransport struct {
+	svc  *Service
+	base http.RoundTripper
+}
+
+func (pt *profileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	timing := &requestTiming{start: time.Now()}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), timing.trace()))
+
+	resp, err := pt.base.RoundTrip(req)
+	if err != nil {
+		pt.logIfSlow(req, timing, "error", err.Error())
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		// The body is the upgraded connection and must stay an io.ReadWriteCloser
+		pt.logIfSlow(req, timing, "status", fmt.Sprint(resp.StatusCode))
+		return resp, nil
+	}
+	resp.Body = &profiledBody{ReadCloser: resp.Body, done: func() {
+		pt.logIfSlow(req, timing, "status", fmt.Sprint(resp.StatusCode))
+	}}
+	return resp, nil
+}
+
+func (pt *profileTransport) logIfSlow(req *http.Request, timing *requestTiming, key, value string) {
+	total := time.Since(timing.start)
+	if total < pt.svc.ProfileSlow.Threshold {
+		return
+	}
+	log.Printf("[%s] slow request %s %s%s: %s=%s total=%s%s%s", pt.svc.name, req.Method, req.URL.Host, req.URL.Path,
+		key, value, total.Round(time.Microsecond), timing, logContextFrom(req.Context()))
+}
+
+type profiledBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (pb *profiledBody) Close() error {
+	err := pb.ReadCloser.Close()
+	pb.once.Do(pb.done)
+	return err
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+type upstreamKey struct{}
+
+type inboundKey struct{}
+
+type inboundRequest struct {
+	url    url.URL
+	method string
+}
+
+func withUpstream(ctx context.Context, up *upstream) context.Context {
+	return context.WithValue(ctx, upstreamKey{}, up)
+}
+
+// withInbound remembers the request URL and method as the director first
+// sees them, so that retries can point the request at a different target.
+func withInbound(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, inboundKey{}, &inboundRequest{url: *r.URL, method: r.Method})
+}
+
+func upstreamFrom(ctx context.Context) *upstream {
+	up, _ := ctx.Value(upstreamKey{}).(*upstream)
+	return up
+}
+
+func (svc *Service) director(req *http.Request) {
+	up := upstreamFrom(req.Context())
+	if up == nil {
+		up = svc.pickUpstream(req)
+	}
+	up.director(req)
+
+	if len(svc.MethodRewrite) > 0 {
+		inbound := req.Method
+		if in, ok := req.Context().Value(inboundKey{}).(*inboundRequest); ok {
+			inbound = in.method
+		}
+		svc.rewriteMethod(req, inbound)
+	}
+
+	if svc.PropagateDeadline != nil {
+		svc.PropagateDeadline.setDeadlineHeader(req)
+	}
+	if len(svc.DeadlineHeaders) > 0 {
+		svc.setDeadlineHeaders(req)
+	}
+}
+
+// retarget returns a copy of an outgoing request aimed at another target.
+func (svc *Service) retarget(req *http.Request, up *upstream) *http.Request {
+	next := req.Clone(withUpstream(req.Context(), up))
+	if in, ok := req.Context().Value(inboundKey{}).(*inboundRequest); ok {
+		copied := in.url
+		next.URL = &copied
+	}
+	svc.director(next)
+	return next
+}
+
+func (svc *Service) modifyResponse(resp *http.Response) error {
+	// The reverse proxy leaves the headers of upgrade responses alone
+	removeHopHeaders(resp.Header)
+	// The gateway has already set the request ID on the response
+	if svc.requestIDHeader != "" {
+		resp.Header.Del(svc.requestIDHeader)
+	}
+	if err := svc.checkResponseHeaderSize(resp); err != nil {
+		return err
+	}
+	if svc.Retry == nil {
+		// Otherwise the retry transport has recorded every attempt
+		svc.recordAttempt(resp.Request, resp, nil)
+	}
+	svc.setAffinityCookie(resp)
+	svc.wrapWebSocket(resp)
+	if err := svc.transformResponse(resp); err != nil {
+		return err
+	}
+	if svc.Schema != nil && svc.Schema.response != nil {
+		if err := svc.checkResponseSchema(resp); err != nil {
+			return err
+		}
+	}
+	if svc.cache != nil {
+		if err := svc.cache.store(resp); err != nil {
+			return err
+		}
+	}
+	return adaptHTTP10Response(resp, int64(svc.MaxBufferedResponse))
+}
+
+func (svc *Service) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	var tooLarge *http.MaxBytesError
+	var netErr net.Error
+	e := errBadGateway
+	switch {
+	case errors.Is(err, errUpstreamConnLimit):
+		e = errUpstreamBusy
+	case errors.As(err, &tooLarge):
+		e = errBodyTooLarge
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		// The total deadline, or a transport timeout such as response_header
+		e = errUpstreamTimeout
+	}
+	log.Printf("[%s] proxy error %s: %v%s", svc.name, e.code, err, logContextFrom(r.Context()))
+
+	// Hitting our own connection cap is not the backend's fault, nor is a
+	// request body over max_body_size, nor a client hanging up
+	if e == errUpstreamBusy {
+		svc.connLimitOverload().setHeaders(w.Header())
+	}
+	if e == errBodyTooLarge {
+		// The rest of the body is still on its way
+		w.Header().Set("Connection", "close")
+	}
+	if e == errUpstreamBusy || e == errBodyTooLarge {
+		svc.errors.writeStatus(w, r, e)
+		return
+	}
+
+	if svc.Retry == nil {
+		svc.recordAttempt(r, nil, err)
+	}
+
+	if svc.cache != nil && svc.cache.serveStale(w, r) {
+		return
+	}
+
+	svc.errors.writeStatus(w, r, e)
+}
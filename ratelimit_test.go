@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const rateLimitConfig = `
+services:
+  api:
+    target: "{{target}}"
+    rate_limit:
+      requests_per_minute: {{per_minute}}
+      by_method: {GET: 3, POST: 1, DELETE: 0}
+      known_clients: {"10.0.0.5": 5, "10.0.0.6": 0}
+`
+
+func TestRateLimitByMethod(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK)
+	type step struct {
+		method string
+		client string
+		want   int
+	}
+	const ok, limited = http.StatusOK, http.StatusTooManyRequests
+	tests := []struct {
+		name      string
+		perMinute string
+		steps     []step
+	}{
+		{
+			name:      "methods count in their own buckets",
+			perMinute: "2",
+			steps: []step{
+				{"GET", "", ok}, {"POST", "", ok}, {"GET", "", ok}, {"POST", "", limited},
+				{"GET", "", ok}, {"GET", "", limited},
+				// Unlisted methods share the default bucket
+				{"PUT", "", ok}, {"PATCH", "", ok}, {"PUT", "", limited},
+				{"DELETE", "", limited},
+			},
+		},
+		{
+			name:      "a zero default refuses unlisted methods",
+			perMinute: "0",
+			steps:     []step{{"PUT", "", limited}, {"GET", "", ok}},
+		},
+		{
+			name:      "clients are limited separately",
+			perMinute: "1",
+			steps: []step{
+				{"PUT", "192.0.2.1", ok}, {"PUT", "192.0.2.1", limited}, {"PUT", "192.0.2.2", ok},
+			},
+		},
+		{
+			name:      "a known client's limit covers every method",
+			perMinute: "0",
+			steps: []step{
+				{"GET", "10.0.0.5", ok}, {"POST", "10.0.0.5", ok}, {"DELETE", "10.0.0.5", ok},
+				{"PUT", "10.0.0.5", ok}, {"PUT", "10.0.0.5", ok}, {"GET", "10.0.0.5", limited},
+			},
+		},
+		{
+			name:      "a known client with a zero limit is exempt",
+			perMinute: "0",
+			steps: []step{
+				{"DELETE", "10.0.0.6", ok}, {"PUT", "10.0.0.6", ok}, {"PUT", "10.0.0.6", ok},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, rateLimitConfig, map[string]string{"target": backend.URL, "per_minute": tt.perMinute})
+			for i, s := range tt.steps {
+				r := httptest.NewRequest(s.method, "/api/items", nil)
+				if s.client != "" {
+					r.RemoteAddr = s.client + ":40000"
+				}
+				if w := serve(cfg, r); w.Code != s.want {
+					t.Fatalf("request %d, %s from %s: status %d, want %d", i+1, s.method, r.RemoteAddr, w.Code, s.want)
+				}
+			}
+		})
+	}
+}
+
+const rateLimitGroupConfig = `
+services:
+  v1:
+    target: "{{target}}"
+    rate_limit: {requests_per_minute: 2, by_method: {POST: 1}, group: backend-a}
+  v2:
+    target: "{{target}}"
+    rate_limit: {requests_per_minute: 2, by_method: {POST: 1}, group: backend-a}
+  v3:
+    target: "{{target}}"
+    rate_limit: {requests_per_minute: 4, group: backend-a}
+  solo:
+    target: "{{target}}"
+    rate_limit: {requests_per_minute: 2}
+`
+
+func TestRateLimitGroupSharesCount(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK)
+	cfg := loadTestConfig(t, rateLimitGroupConfig, map[string]string{"target": backend.URL})
+	const ok, limited = http.StatusOK, http.StatusTooManyRequests
+	steps := []struct {
+		method, path, client string
+		want                 int
+	}{
+		{"GET", "/v1/", "192.0.2.1", ok},
+		{"GET", "/v2/", "192.0.2.1", ok},
+		{"GET", "/v1/", "192.0.2.1", limited},
+		{"GET", "/v2/", "192.0.2.1", limited},
+		// A member with a higher limit counts against the same requests
+		{"GET", "/v3/", "192.0.2.1", ok},
+		{"GET", "/v3/", "192.0.2.1", ok},
+		{"GET", "/v3/", "192.0.2.1", limited},
+		// Services outside the group, and other clients, are counted apart
+		{"GET", "/solo/", "192.0.2.1", ok},
+		{"GET", "/v1/", "192.0.2.2", ok},
+		// by_method buckets are shared by method
+		{"POST", "/v2/", "192.0.2.1", ok},
+		{"POST", "/v1/", "192.0.2.1", limited},
+	}
+	for i, s := range steps {
+		r := httptest.NewRequest(s.method, s.path, nil)
+		r.RemoteAddr = s.client + ":40000"
+		if w := serve(cfg, r); w.Code != s.want {
+			t.Fatalf("request %d, %s %s from %s: status %d, want %d", i+1, s.method, s.path, s.client, w.Code, s.want)
+		}
+	}
+}
+
+func TestRateLimitGroupMembersMustAgree(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, `
+services:
+  v1:
+    target: "http://localhost:3000"
+    rate_limit: {requests_per_minute: 2, group: backend-a}
+  v2:
+    target: "http://localhost:3000"
+    rate_limit: {requests_per_minute: 2, group: backend-a, persist: true, state_file: "{{state}}"}
+`, map[string]string{"state": filepath.Join(t.TempDir(), "limits.json")})
+	if _, err := loadConfig(path); err == nil {
+		t.Fatal("group members with different persist settings accepted")
+	}
+}
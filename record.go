@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RecordConfig struct {
+	Enabled      bool    `yaml:"enabled"`
+	SampleRate   float64 `yaml:"sample_rate"`
+	File         string  `yaml:"file"`
+	MaxBodyBytes int64   `yaml:"max_body_bytes"`
+	BufferSize   int     `yaml:"buffer_size"`
+}
+
+type recordedRequest struct {
+	Time      time.Time   `json:"time"`
+	Method    string      `json:"method"`
+	Path      string      `json:"path"`
+	Header    http.Header `json:"header"`
+	Body      []byte      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+// recorder samples requests and appends them to a JSON-lines file from a
+// background goroutine. When the buffer is full, samples are dropped rather
+// than slowing down the request path.
+type recorder struct {
+	cfg  *RecordConfig
+	ch   chan recordedRequest
+	done sync.WaitGroup
+}
+
+func newRecorder(cfg *RecordConfig) (*recorder, error) {
+	if cfg.File == "" {
+		cfg.File = "requests.recorded.jsonl"
+	}
+	if cfg.MaxBodyBytes == 0 {
+		cfg.MaxBodyBytes = 64 << 10
+	}
+	if cfg.BufferSize == 0 {
+		cfg.BufferSize = 1000
+	}
+
+	f, err := os.OpenFile(cfg.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	rec := &recorder{
+		cfg: cfg,
+		ch:  make(chan recordedRequest, cfg.BufferSize),
+	}
+
+	rec.done.Add(1)
+	go func() {
+		defer rec.done.Done()
+		defer f.Close()
+
+		w := bufio.NewWriter(f)
+		enc := json.NewEncoder(w)
+		for req := range rec.ch {
+			if err := enc.Encode(req); err != nil {
+				log.Printf("record: write failed: %v", err)
+			}
+			if len(rec.ch) == 0 {
+				w.Flush()
+			}
+		}
+		w.Flush()
+	}()
+
+	return rec, nil
+}
+
+func (rec *recorder) maybeRecord(r *http.Request, lr *LogRedactionConfig) {
+	if rand.Float64() >= rec.cfg.SampleRate {
+		return
+	}
+
+	req := recordedRequest{
+		Time:   time.Now(),
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Header: r.Header.Clone(),
+	}
+	for _, h := range sensitiveHeaders {
+		req.Header.Del(h)
+	}
+	req.Header = lr.header(req.Header)
+
+	body, err := peekRequestBody(r, rec.cfg.MaxBodyBytes+1)
+	if err != nil {
+		log.Printf("record: reading body: %v", err)
+	}
+	if int64(len(body)) > rec.cfg.MaxBodyBytes {
+		body = body[:rec.cfg.MaxBodyBytes]
+		req.Truncated = true
+	}
+	req.Body = lr.body(body)
+
+	select {
+	case rec.ch <- req:
+	default:
+	}
+}
+
+func (rec *recorder) close() {
+	close(rec.ch)
+	rec.done.Wait()
+}
+
+type headerFlags []string
+
+func (h *headerFlags) String() string     { return strings.Join(*h, ", ") }
+func (h *headerFlags) Set(v string) error { *h = append(*h, v); return nil }
+
+// runReplay implements the "replay" subcommand, feeding recorded requests
+// back through a gateway at a fixed rate.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	file := fs.String("file", "requests.recorded.jsonl", "recorded requests file")
+	target := fs.String("target", "http://localhost:8080", "gateway base URL")
+	rate := fs.Float64("rate", 10, "requests per second")
+	var headers headerFlags
+	fs.Var(&headers, "header", `extra header to send, e.g. "Authorization: Bearer token" (repeatable)`)
+	fs.Parse(args)
+	if !(*rate > 0) {
+		log.Printf("replay: -rate must be a positive number of requests per second")
+		return 2
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		log.Printf("replay: %v", err)
+		return 1
+	}
+	defer f.Close()
+
+	ticker := time.NewTicker(max(time.Duration(float64(time.Second) / *rate), 1))
+	defer ticker.Stop()
+
+	statuses := make(map[string]int)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 1<<20), 64<<20)
+	for scanner.Scan() {
+		var rr recordedRequest
+		if err := json.Unmarshal(scanner.Bytes(), &rr); err != nil {
+			log.Printf("replay: skipping malformed line: %v", err)
+			continue
+		}
+		// Only part of the body was recorded; sent as it is, it would make a
+		// different request
+		if rr.Truncated {
+			statuses["skipped (body truncated)"]++
+			log.Printf("replay: skipping %s %s: body truncated when recorded", rr.Method, rr.Path)
+			continue
+		}
+
+		req, err := http.NewRequest(rr.Method, strings.TrimSuffix(*target, "/")+rr.Path, bytes.NewReader(rr.Body))
+		if err != nil {
+			log.Printf("replay: %v", err)
+			continue
+		}
+		req.Header = rr.Header
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		for _, h := range headers {
+			if name, value, ok := strings.Cut(h, ":"); ok {
+				req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+			}
+		}
+
+		<-ticker.C
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			statuses["error"]++
+			log.Printf("replay: %s %s: %v", rr.Method, rr.Path, err)
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		statuses[fmt.Sprint(resp.StatusCode)]++
+	}
+	if err := scanner.Err(); err != nil {
+		log.Printf("replay: %v", err)
+		return 1
+	}
+
+	keys := make([]string, 0, len(statuses))
+	for k := range statuses {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Printf("%s: %d\n", k, statuses[k])
+	}
+	return 0
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestReplaySkipsTruncatedBodies(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK)
+	path := filepath.Join(t.TempDir(), "requests.recorded.jsonl")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc := json.NewEncoder(f)
+	for _, rr := range []recordedRequest{
+		{Method: http.MethodPost, Path: "/a", Body: []byte(`{"whole":true}`)},
+		{Method: http.MethodPost, Path: "/b", Body: []byte(`{"cut":`), Truncated: true},
+		{Method: http.MethodGet, Path: "/c"},
+	} {
+		if err := enc.Encode(rr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	if code := runReplay([]string{"-file", path, "-target", backend.URL, "-rate", "1000"}); code != 0 {
+		t.Fatalf("replay exited %d", code)
+	}
+	if hits := backend.hits.Load(); hits != 2 {
+		t.Fatalf("backend got %d requests, want 2", hits)
+	}
+}
+
+func TestReplayRejectsRate(t *testing.T) {
+	for _, rate := range []string{"0", "-5", "NaN"} {
+		if code := runReplay([]string{"-file", os.DevNull, "-rate", rate}); code == 0 {
+			t.Errorf("-rate %s accepted", rate)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// LogRedactionConfig masks sensitive data wherever a service's traffic is
+// logged: access logs, log_context, request recording, mirror diffs and the
+// debug tap. It adds to the credential headers that are always masked.
+type LogRedactionConfig struct {
+	JSONFields     []string `yaml:"json_fields,omitempty"`     // a key at any depth, or a dotted path from the root
+	HeaderPatterns []string `yaml:"header_patterns,omitempty"` // regular expressions matched against whole header names
+	headers        []*regexp.Regexp
+	names          map[string]bool
+	paths          [][]string
+	fallback       *regexp.Regexp // for bodies that don't parse, such as truncated ones
+}
+
+const redacted = "[redacted]"
+
+func (lr *LogRedactionConfig) compile() error {
+	for _, p := range lr.HeaderPatterns {
+		re, err := regexp.Compile("(?i)^(?:" + p + ")$")
+		if err != nil {
+			return fmt.Errorf("header_patterns: %w", err)
+		}
+		lr.headers = append(lr.headers, re)
+	}
+
+	lr.names = make(map[string]bool)
+	var leaves []string
+	for _, f := range lr.JSONFields {
+		if f == "" {
+			return fmt.Errorf("json_fields: empty field")
+		}
+		path := strings.Split(strings.ToLower(f), ".")
+		if len(path) == 1 {
+			lr.names[path[0]] = true
+		} else {
+			lr.paths = append(lr.paths, path)
+		}
+		leaves = append(leaves, regexp.QuoteMeta(path[len(path)-1]))
+	}
+	if len(leaves) > 0 {
+		// "field": value, with the value possibly cut off by truncation
+		lr.fallback = regexp.MustCompile(`(?i)("(?:` + strings.Join(leaves, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*(?:"|\\?$)|[^\s,}\]]+)`)
+	}
+	return nil
+}
+
+func (lr *LogRedactionConfig) matchesHeader(name string) bool {
+	if lr == nil {
+		return false
+	}
+	for _, re := range lr.headers {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// header returns h with the values of credential headers and matching
+// headers redacted, copying it first if anything needs to change. It works
+// on a nil config, so services without log_redaction still mask credentials.
+func (lr *LogRedactionConfig) header(h http.Header) http.Header {
+	copied := false
+	for name := range h {
+		sensitive := slices.ContainsFunc(sensitiveHeaders, func(s string) bool { return strings.EqualFold(s, name) })
+		if !sensitive && !lr.matchesHeader(name) {
+			continue
+		}
+		if !copied {
+			h, copied = h.Clone(), true
+		}
+		h[name] = []string{redacted}
+	}
+	return h
+}
+
+// body returns a JSON body with the values of json_fields redacted. Bodies
+// that aren't valid JSON, usually because they were truncated for logging,
+// are redacted by pattern instead, which only knows the fields' last names.
+func (lr *LogRedactionConfig) body(b []byte) []byte {
+	if lr == nil || lr.fallback == nil || len(b) == 0 {
+		return b
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err == nil && !dec.More() {
+		if out, err := json.Marshal(lr.redactValue(v, nil)); err == nil {
+			return out
+		}
+	}
+	return lr.fallback.ReplaceAll(b, []byte(`${1}"`+redacted+`"`))
+}
+
+func (lr *LogRedactionConfig) redactValue(v any, path []string) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, child := range v {
+			p := append(path[:len(path):len(path)], strings.ToLower(k))
+			if lr.names[p[len(p)-1]] || lr.matchesPath(p) {
+				v[k] = redacted
+			} else {
+				v[k] = lr.redactValue(child, p)
+			}
+		}
+	case []any:
+		// Array elements share their parent's path
+		for i, child := range v {
+			v[i] = lr.redactValue(child, path)
+		}
+	}
+	return v
+}
+
+func (lr *LogRedactionConfig) matchesPath(p []string) bool {
+	for _, want := range lr.paths {
+		if slices.Equal(want, p) {
+			return true
+		}
+	}
+	return false
+}
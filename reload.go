@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// gateway serves each request with the config current when it arrives and
+// swaps in a new config on reload. A request keeps the config it started
+// with until it ends, so streams open across a reload, such as server-sent
+// events and WebSockets, stay on the targets, timeouts and transport they
+// started with while new requests get the new settings.
+type gateway struct {
+	path    string
+	current atomic.Pointer[Config]
+
+	mu      sync.Mutex // serializes reloads; guards retired and served
+	retired []*Config  // replaced, but still serving requests
+	served  map[string]uint64
+}
+
+// How often a replaced config is checked for requests still running on it
+const retirePoll = 100 * time.Millisecond
+
+func newGateway(path string, cfg *Config) *gateway {
+	g := &gateway{path: path, served: make(map[string]uint64)}
+	cfg.gateway = g
+	cfg.serve = cfg.handler()
+	g.current.Store(cfg)
+	return g
+}
+
+// ServeHTTP counts the request against its config before doing anything
+// else, so a reload can't retire the config under it. A request that loaded
+// the config just as it was replaced moves to the new one: once counted, it
+// either sees the swap or is seen by retire.
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	cfg := g.current.Load()
+	cfg.active.Add(1)
+	for next := g.current.Load(); next != cfg; next = g.current.Load() {
+		cfg.active.Add(-1)
+		cfg = next
+		cfg.active.Add(1)
+	}
+	defer cfg.active.Add(-1)
+	cfg.serve(w, r)
+}
+
+// reload loads the config again from its source, fetching it again if it
+// is remote, and swaps it in for new requests. If it doesn't load, the
+// current config stays in effect.
+func (g *gateway) reload(reason string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	old := g.current.Load()
+	// The new config reads rate limit state files as it loads
+	old.saveLimiterState()
+	data, err := readConfigSource(g.path, false)
+	var cfg *Config
+	if err == nil {
+		cfg, err = parseConfig(g.path, data)
+	}
+	if err != nil {
+		log.Printf("[gateway] reload (%s) failed, keeping the current config: %v", reason, err)
+		return err
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 8080
+	}
+	for _, setting := range restartOnlyChanges(old, cfg) {
+		log.Printf("[gateway] reload: %s changed, restart to apply it", setting)
+	}
+
+	// The listener and exporters outlive a reload
+	cfg.recorder, cfg.statsd, cfg.otlp = old.recorder, old.statsd, old.otlp
+	cfg.draining.Store(old.draining.Load())
+	for name, svc := range cfg.Services {
+		if prev, ok := old.Services[name]; ok {
+			svc.inherit(prev)
+		}
+	}
+	cfg.gateway = g
+	cfg.serve = cfg.handler()
+	cfg.start()
+
+	g.current.Store(cfg)
+	g.retired = append(g.retired, old)
+	go g.retire(old)
+	log.Printf("[gateway] reloaded config (%s), %d requests still on the previous one", reason, old.active.Load())
+	return nil
+}
+
+// inherit carries balancing state over from the service as it was before a
+// reload: the health and ejections of targets it keeps, and its canary's
+// percentage and rollback.
+func (svc *Service) inherit(old *Service) {
+	for _, up := range svc.upstreams {
+		for _, prev := range old.upstreams {
+			if up.url.String() == prev.url.String() {
+				up.inherit(prev)
+				break
+			}
+		}
+	}
+	if svc.StartupProbe != nil {
+		var warming int32
+		for _, up := range svc.upstreams {
+			if up.warming {
+				warming++
+			}
+		}
+		svc.warming.Store(warming)
+	}
+
+	if svc.Canary != nil && old.Canary != nil {
+		if svc.Canary.Target == old.Canary.Target {
+			svc.Canary.upstream.inherit(old.Canary.upstream)
+		}
+		svc.Canary.inherit(old.Canary)
+	}
+}
+
+// retire stops a replaced config's background work and closes its idle
+// upstream connections once the last request it was serving has finished.
+func (g *gateway) retire(old *Config) {
+	ticker := time.NewTicker(retirePoll)
+	defer ticker.Stop()
+	for old.active.Load() > 0 {
+		<-ticker.C
+	}
+	old.stop()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.retired = slices.DeleteFunc(g.retired, func(c *Config) bool { return c == old })
+	for name, svc := range old.Services {
+		g.served[name] += svc.requests.Load()
+	}
+}
+
+// live returns the current config and any replaced ones still serving
+// requests.
+func (g *gateway) live() []*Config {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return append([]*Config{g.current.Load()}, g.retired...)
+}
+
+// servedByRetired counts each service's requests on configs that have been
+// replaced and retired.
+func (g *gateway) servedByRetired() map[string]uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return maps.Clone(g.served)
+}
+
+// liveConfigs is the gateway's live configs, or just c outside a gateway.
+func (c *Config) liveConfigs() []*Config {
+	if c.gateway == nil {
+		return []*Config{c}
+	}
+	return c.gateway.live()
+}
+
+// start runs the config's background work until stop: health checks,
+// outlier detection, canary percent polling and heap monitoring.
+func (c *Config) start() {
+	ctx, cancel := context.WithCancel(context.Background())
+	c.stopBackground = cancel
+
+	for _, svc := range c.Services {
+		if svc.HealthCheck != nil {
+			svc.runHealthChecks(ctx)
+		}
+		if svc.OutlierDetection != nil {
+			go svc.detectOutliers(ctx)
+		}
+		if svc.Canary != nil && svc.Canary.PercentSource != "" {
+			go svc.Canary.pollPercent(ctx, svc.name)
+		}
+	}
+
+	if c.OverloadProtection != nil {
+		go c.OverloadProtection.monitor(ctx)
+	}
+}
+
+// stop ends the background work start began and lets go of the config's
+// connections: the redis pool and idle connections to its upstreams.
+func (c *Config) stop() {
+	if c.stopBackground != nil {
+		c.stopBackground()
+	}
+	if c.redisLimiter != nil {
+		c.redisLimiter.close()
+	}
+	for _, svc := range c.Services {
+		if svc.transport != nil {
+			svc.transport.CloseIdleConnections()
+		}
+		if svc.Mirror != nil && svc.Mirror.client != nil {
+			svc.Mirror.client.CloseIdleConnections()
+		}
+	}
+}
+
+// restartOnlyChanges lists the settings that differ between two configs but
+// belong to the listener or the process-wide exporters, which only take
+// effect on restart.
+func restartOnlyChanges(old, cfg *Config) []string {
+	settings := func(c *Config) map[string]any {
+		s := map[string]any{
+			"port":       c.Port,
+			"listener":   c.Listener,
+			"tls":        c.TLS,
+			"mtls":       c.MTLS,
+			"record":     c.Record,
+			"statsd":     c.StatsD,
+			"access_log": c.AccessLog,
+		}
+		if c.Limits != nil {
+			s["limits.new_conns_per_sec"] = c.Limits.NewConnsPerSec
+			s["limits.new_conns_burst"] = c.Limits.NewConnsBurst
+			s["limits.on_conn_limit"] = c.Limits.OnConnLimit
+		}
+		return s
+	}
+	before, after := settings(old), settings(cfg)
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			after[name] = nil
+		}
+	}
+
+	var changed []string
+	for name, v := range after {
+		a, _ := yaml.Marshal(before[name])
+		b, _ := yaml.Marshal(v)
+		if !bytes.Equal(a, b) {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func (c *Config) reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if c.gateway == nil {
+		http.Error(w, "reload not available", http.StatusNotImplemented)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := c.gateway.reload("requested by " + remoteIP(r)); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string]any{"reloaded": false, "error": err.Error()})
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]any{"reloaded": true})
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const reloadConfig = `
+services:
+  events:
+    target: "{{target}}"
+    timeout: {{timeout}}
+`
+
+// streamBackend sends the start of a response straight away and the rest
+// once release is closed, like a server-sent event source.
+func streamBackend(t *testing.T, release chan struct{}) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: last\n\n")
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestReloadPinsInFlightStreams(t *testing.T) {
+	release := make(chan struct{})
+	oldBackend := streamBackend(t, release)
+	newBackend := newTestBackend(t, http.StatusOK)
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, reloadConfig, map[string]string{"target": oldBackend.URL, "timeout": "10s"})
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(path, cfg)
+	gw := httptest.NewServer(g)
+	defer gw.Close()
+
+	resp, err := http.Get(gw.URL + "/events/stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body := bufio.NewReader(resp.Body)
+	if line, _ := body.ReadString('\n'); line != "data: first\n" {
+		t.Fatalf("stream started with %q", line)
+	}
+
+	// The new config moves the service and gives it a timeout the open
+	// stream would already have run out of
+	writeTestConfig(t, path, reloadConfig, map[string]string{"target": newBackend.URL, "timeout": "50ms"})
+	if err := g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if live := len(g.live()); live != 2 {
+		t.Fatalf("%d live configs during the stream, want 2", live)
+	}
+
+	next, err := http.Get(gw.URL + "/events/poll")
+	if err != nil {
+		t.Fatal(err)
+	}
+	next.Body.Close()
+	if next.StatusCode != http.StatusOK || newBackend.hits.Load() != 1 {
+		t.Fatalf("request after reload: status %d, %d hits on the new target", next.StatusCode, newBackend.hits.Load())
+	}
+
+	time.Sleep(200 * time.Millisecond)
+	close(release)
+	rest, err := io.ReadAll(body)
+	if err != nil {
+		t.Fatalf("stream cut off after reload: %v", err)
+	}
+	if !strings.Contains(string(rest), "data: last") {
+		t.Fatalf("stream ended with %q", rest)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(g.live()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("previous config not retired after its stream ended")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if served := g.servedByRetired()["events"]; served != 1 {
+		t.Fatalf("retired config served %d requests, want 1", served)
+	}
+}
+
+func TestReloadKeepsConfigOnError(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK)
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, reloadConfig, map[string]string{"target": backend.URL, "timeout": "10s"})
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(path, cfg)
+
+	writeTestConfig(t, path, "services: [", nil)
+	if err := g.reload("test"); err == nil {
+		t.Fatal("reload of a broken config succeeded")
+	}
+	if g.current.Load() != cfg {
+		t.Fatal("broken config replaced the current one")
+	}
+
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events/", nil))
+	if w.Code != http.StatusOK || backend.hits.Load() != 1 {
+		t.Fatalf("after failed reload: status %d, %d hits", w.Code, backend.hits.Load())
+	}
+}
+
+func TestReloadKeepsTargetEjections(t *testing.T) {
+	a, b := newTestBackend(t, http.StatusOK), newTestBackend(t, http.StatusOK)
+	vars := map[string]string{"a": a.URL, "b": b.URL, "trip": "5"}
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, retryBreakerConfig, vars)
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(path, cfg)
+	up := upstreamFor(t, cfg.Services["api"], a.URL)
+	up.mu.Lock()
+	up.ejections, up.ejectedUntil = 1, time.Now().Add(time.Minute)
+	up.mu.Unlock()
+
+	if err := g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if upstreamFor(t, g.current.Load().Services["api"], a.URL).available(time.Now()) {
+		t.Fatal("reload put an ejected target back into rotation")
+	}
+	if !upstreamFor(t, g.current.Load().Services["api"], b.URL).available(time.Now()) {
+		t.Fatal("healthy target unavailable after reload")
+	}
+}
+
+func TestRetireClosesIdleUpstreamConnections(t *testing.T) {
+	closed := make(chan struct{}, 1)
+	oldBackend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	oldBackend.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			select {
+			case closed <- struct{}{}:
+			default:
+			}
+		}
+	}
+	oldBackend.Start()
+	defer oldBackend.Close()
+	newBackend := newTestBackend(t, http.StatusOK)
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, reloadConfig, map[string]string{"target": oldBackend.URL, "timeout": "10s"})
+	cfg, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(path, cfg)
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events/", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	writeTestConfig(t, path, reloadConfig, map[string]string{"target": newBackend.URL, "timeout": "10s"})
+	if err := g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle connection to the replaced config's upstream left open")
+	}
+}
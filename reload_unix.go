@@ -0,0 +1,11 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// SIGHUP reloads the config, like POST /admin/reload.
+var reloadSignals = []os.Signal{syscall.SIGHUP}
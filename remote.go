@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const remoteConfigAttempts = 3
+
+func isRemoteConfig(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// readConfigSource returns the raw config from a local file or, for http(s)
+// URLs, from the remote source. Failed fetches are retried before falling
+// back, if cached is set, to the last copy that loaded successfully. A
+// reload doesn't fall back: the cached copy is the config already running.
+func readConfigSource(path string, cached bool) ([]byte, error) {
+	if !isRemoteConfig(path) {
+		return os.ReadFile(path)
+	}
+
+	var err error
+	for attempt := 1; attempt <= remoteConfigAttempts; attempt++ {
+		var data []byte
+		data, err = fetchRemoteConfig(path)
+		if err == nil {
+			return data, nil
+		}
+		log.Printf("Fetching config from %s failed (attempt %d/%d): %v", path, attempt, remoteConfigAttempts, err)
+		if attempt < remoteConfigAttempts {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}
+
+	if !cached {
+		return nil, err
+	}
+	data, cacheErr := os.ReadFile(remoteConfigCachePath(path))
+	if cacheErr != nil {
+		return nil, err
+	}
+	log.Printf("Using cached copy of %s", path)
+	return data, nil
+}
+
+func fetchRemoteConfig(path string) ([]byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(path)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 10<<20))
+}
+
+// cacheRemoteConfig keeps the last-good remote config for startup when the
+// source is unreachable.
+func cacheRemoteConfig(path string, data []byte) {
+	if err := os.WriteFile(remoteConfigCachePath(path), data, 0o600); err != nil {
+		log.Printf("Failed to cache remote config: %v", err)
+	}
+}
+
+func remoteConfigCachePath(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return filepath.Join(os.TempDir(), "agent-api-gateway-"+hex.EncodeToString(sum[:8])+".yaml")
+}
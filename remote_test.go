@@ -0,0 +1,64 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestReloadRefetchesRemoteConfig(t *testing.T) {
+	// Keep the last-good copy out of the shared temp directory
+	t.Setenv("TMPDIR", t.TempDir())
+
+	first, second := newTestBackend(t, http.StatusOK), newTestBackend(t, http.StatusOK)
+	var config atomic.Value
+	var failing atomic.Bool
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(config.Load().(string)))
+	}))
+	defer source.Close()
+	target := func(b *testBackend) string {
+		return strings.NewReplacer("{{target}}", b.URL, "{{timeout}}", "10s").Replace(reloadConfig)
+	}
+
+	config.Store(target(first))
+	cfg, err := loadConfig(source.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g := newGateway(source.URL, cfg)
+	get := func() {
+		t.Helper()
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/events/", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+
+	config.Store(target(second))
+	if err := g.reload("test"); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	get()
+	if first.hits.Load() != 0 || second.hits.Load() != 1 {
+		t.Fatalf("hits after reload: %d on the old target, %d on the new one", first.hits.Load(), second.hits.Load())
+	}
+
+	// An unreachable source keeps the running config rather than the cached
+	// copy of it
+	failing.Store(true)
+	current := g.current.Load()
+	if err := g.reload("test"); err == nil {
+		t.Fatal("reload succeeded with the source down")
+	}
+	if g.current.Load() != current {
+		t.Fatal("config replaced while the source was down")
+	}
+}
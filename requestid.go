@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+type RequestIDConfig struct {
+	Header    string `yaml:"header"`
+	Validate  string `yaml:"validate,omitempty"`   // uuid, printable, or a regular expression
+	OnInvalid string `yaml:"on_invalid,omitempty"` // regenerate (default) or reject
+	pattern   *regexp.Regexp
+}
+
+// Client IDs accepted by validate: printable
+var printableRequestID = regexp.MustCompile(`^[\x21-\x7e]{1,200}$`)
+
+var uuidRequestID = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func (rc *RequestIDConfig) setDefaults() {
+	if rc.Header == "" {
+		rc.Header = "X-Request-ID"
+	}
+	if rc.OnInvalid == "" {
+		rc.OnInvalid = "regenerate"
+	}
+}
+
+func (rc *RequestIDConfig) compile() error {
+	switch rc.OnInvalid {
+	case "regenerate", "reject":
+	default:
+		return fmt.Errorf("on_invalid must be regenerate or reject, got %q", rc.OnInvalid)
+	}
+	switch rc.Validate {
+	case "":
+		if rc.OnInvalid == "reject" {
+			return fmt.Errorf("on_invalid: reject requires validate")
+		}
+	case "uuid":
+		rc.pattern = uuidRequestID
+	case "printable":
+		rc.pattern = printableRequestID
+	default:
+		re, err := regexp.Compile("^(?:" + rc.Validate + ")$")
+		if err != nil {
+			return fmt.Errorf("validate: %w", err)
+		}
+		rc.pattern = re
+	}
+	return nil
+}
+
+type requestIDKey struct{}
+
+func requestIDFrom(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// assign keeps the client's request ID or generates one, and passes it to
+// the upstream and back to the client. A client ID that fails validation is
+// replaced, or the request is rejected with the new ID so the client can
+// still quote it; ok is false if the caller should stop.
+func (rc *RequestIDConfig) assign(w http.ResponseWriter, r *http.Request) (_ *http.Request, ok bool) {
+	id := r.Header.Get(rc.Header)
+	ok = true
+	if id != "" && rc.pattern != nil && !rc.pattern.MatchString(id) {
+		// %q keeps a crafted ID from forging log lines of its own
+		log.Printf("[gateway] invalid %s %.64q from %s (on_invalid: %s)", rc.Header, id, remoteIP(r), rc.OnInvalid)
+		id, ok = "", rc.OnInvalid != "reject"
+	}
+	if id == "" {
+		id = newRequestID()
+	}
+	r.Header.Set(rc.Header, id)
+	w.Header().Set(rc.Header, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id)), ok
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+)
+
+const defaultMaxResponseHeaderSize = 256 << 10
+
+// checkResponseHeaderSize rejects upstream responses whose headers exceed the
+// service's limit, naming the largest header so the backend can be fixed.
+func (svc *Service) checkResponseHeaderSize(resp *http.Response) error {
+	limit := int(svc.MaxResponseHeaderSize)
+	if limit == 0 {
+		limit = defaultMaxResponseHeaderSize
+	}
+
+	var total, largestSize int
+	var largest string
+	for name, values := range resp.Header {
+		size := 0
+		for _, v := range values {
+			size += len(name) + len(v) + len(": \r\n")
+		}
+		total += size
+		if size > largestSize {
+			largest, largestSize = name, size
+		}
+	}
+	if total <= limit {
+		return nil
+	}
+
+	target := "upstream"
+	if up := upstreamFrom(resp.Request.Context()); up != nil {
+		target = up.url.String()
+	}
+	log.Printf("[%s] %s sent %d bytes of response headers (limit %d); largest is %s (%d bytes)%s",
+		svc.name, target, total, limit, largest, largestSize, logContextFrom(resp.Request.Context()))
+	return fmt.Errorf("response headers from %s too large", target)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type RetryConfig struct {
+	Attempts      int           `yaml:"attempts"`
+	RetryOnStatus []int         `yaml:"retry_on_status"`
+	Backoff       time.Duration `yaml:"backoff"`
+	MaxBodyBytes  int64         `yaml:"max_body_bytes"`
+}
+
+func (rc *RetryConfig) setDefaults() {
+	if rc.Attempts == 0 {
+		rc.Attempts = 3
+	}
+	if rc.Backoff == 0 {
+		rc.Backoff = 100 * time.Millisecond
+	}
+	if rc.MaxBodyBytes == 0 {
+		rc.MaxBodyBytes = 1 << 20
+	}
+}
+
+// retryable reports whether an attempt should be repeated: the upstream
+// answered with one of retry_on_status, or the connection could not be
+// established (so nothing was sent).
+func (rc *RetryConfig) retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		var opErr *net.OpError
+		return errors.As(err, &opErr) && opErr.Op == "dial"
+	}
+	for _, status := range rc.RetryOnStatus {
+		if resp.StatusCode == status {
+			return true
+		}
+	}
+	return false
+}
+
+// recordAttempt counts an attempt's result towards outlier detection and
+// canary rollback. Failures that aren't the target's doing, such as our own
+// connection cap or a client hanging up, are left out.
+func (svc *Service) recordAttempt(req *http.Request, resp *http.Response, err error) {
+	if err == nil {
+		if up := upstreamFrom(resp.Request.Context()); up != nil {
+			svc.recordResult(up, resp.StatusCode >= 500)
+		}
+		return
+	}
+	var tooLarge *http.MaxBytesError
+	if errors.Is(err, errUpstreamConnLimit) || errors.As(err, &tooLarge) || errors.Is(err, context.Canceled) {
+		return
+	}
+	if up := upstreamFrom(req.Context()); up != nil {
+		svc.recordResult(up, true)
+	}
+}
+
+// retryTransport repeats failed attempts against a freshly picked target.
+// Request bodies up to max_body_bytes are buffered so they can be replayed;
+// larger bodies, and those sent with Expect: 100-continue, are streamed and
+// never retried. It records the result of every attempt itself, in place of
+// the proxy, which only sees the last one.
+type retryTransport struct {
+	svc  *Service
+	base http.RoundTripper
+}
+
+func (rt *retryTransport) once(req *http.Request) (*http.Response, error) {
+	resp, err := rt.base.RoundTrip(req)
+	rt.svc.recordAttempt(req, resp, err)
+	return resp, err
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	rc := rt.svc.Retry
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		// Buffering would send the client its 100 Continue before the
+		// upstream has agreed to take the body
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			return rt.once(req)
+		}
+
+		var err error
+		body, err = peekRequestBody(req, rc.MaxBodyBytes+1)
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(body)) > rc.MaxBodyBytes {
+			return rt.once(req)
+		}
+		req.Body.Close()
+	}
+
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := rt.base.RoundTrip(req)
+		rt.svc.recordAttempt(req, resp, err)
+		if attempt >= rc.Attempts || !rc.retryable(resp, err) {
+			return resp, err
+		}
+		backoff := rc.Backoff * time.Duration(attempt)
+		if !budgetAllows(req.Context(), backoff) {
+			log.Printf("[%s] attempt %d/%d failed, not retrying: latency budget spent", rt.svc.name, attempt, rc.Attempts)
+			return resp, err
+		}
+
+		up := upstreamFrom(req.Context())
+		next := rt.svc.pickUpstreamExcept(up, req)
+		if !next.available(time.Now()) {
+			// Every target, this one included, is ejected or failing health
+			// checks: retrying would only add to the load on one
+			log.Printf("[%s] attempt %d/%d to %s failed, not retrying: no target available", rt.svc.name, attempt, rc.Attempts, up.url)
+			return resp, err
+		}
+
+		reason := ""
+		if err != nil {
+			reason = err.Error()
+		} else {
+			reason = resp.Status
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+			resp.Body.Close()
+		}
+
+		log.Printf("[%s] attempt %d/%d to %s failed (%s), retrying on %s", rt.svc.name, attempt, rc.Attempts, up.url, reason, next.url)
+
+		select {
+		case <-time.After(backoff):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+
+		req = rt.svc.retarget(req, next)
+	}
+}
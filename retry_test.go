@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const retryBreakerConfig = `
+port: 18080
+services:
+  api:
+    targets: ["{{a}}", "{{b}}"]
+    retry: {attempts: 3, retry_on_status: [502], backoff: 1ms}
+    outlier_detection: {consecutive_5xx: {{trip}}, max_ejection_percent: 100}
+`
+
+func TestRetryBreakerStates(t *testing.T) {
+	tests := []struct {
+		name           string
+		statusA        int
+		statusB        int
+		trip           string
+		ejected        []string // targets out of rotation before the request
+		wantStatus     int
+		wantHitsA      int64
+		wantHitsB      int64
+		wantEjectedAll bool
+	}{
+		{
+			name:    "retries on the other target",
+			statusA: 502, statusB: 200, trip: "10",
+			wantStatus: 200, wantHitsA: 1, wantHitsB: 1,
+		},
+		{
+			name:    "never retries on an ejected target",
+			statusA: 200, statusB: 502, trip: "10", ejected: []string{"a"},
+			wantStatus: 502, wantHitsA: 0, wantHitsB: 3,
+		},
+		{
+			name:    "fails fast with every target ejected",
+			statusA: 502, statusB: 502, trip: "10", ejected: []string{"a", "b"},
+			wantStatus: 502, wantHitsA: 1, wantHitsB: 0,
+		},
+		{
+			name:    "stops once retries have ejected every target",
+			statusA: 502, statusB: 502, trip: "1",
+			wantStatus: 502, wantHitsA: 1, wantHitsB: 1, wantEjectedAll: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := newTestBackend(t, tt.statusA), newTestBackend(t, tt.statusB)
+			cfg := loadTestConfig(t, retryBreakerConfig, map[string]string{"a": a.URL, "b": b.URL, "trip": tt.trip})
+			svc := cfg.Services["api"]
+			ups := map[string]*upstream{"a": upstreamFor(t, svc, a.URL), "b": upstreamFor(t, svc, b.URL)}
+			for _, name := range tt.ejected {
+				ups[name].ejectedUntil = time.Now().Add(time.Minute)
+			}
+			// Start round-robin on a; pickUpstream advances next first
+			for i, up := range svc.upstreams {
+				if up == ups["a"] {
+					svc.next = uint64(i + len(svc.upstreams) - 1)
+				}
+			}
+
+			w := serve(cfg, httptest.NewRequest(http.MethodGet, "/api/", nil))
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if got := a.hits.Load(); got != tt.wantHitsA {
+				t.Errorf("target a got %d requests, want %d", got, tt.wantHitsA)
+			}
+			if got := b.hits.Load(); got != tt.wantHitsB {
+				t.Errorf("target b got %d requests, want %d", got, tt.wantHitsB)
+			}
+			if tt.wantEjectedAll && (!ups["a"].ejected(time.Now()) || !ups["b"].ejected(time.Now())) {
+				t.Errorf("want both targets ejected")
+			}
+		})
+	}
+}
+
+// Each attempt counts once towards outlier detection, including the one
+// that stops retrying by ejecting the last target in rotation.
+func TestRetryRecordsEachAttemptOnce(t *testing.T) {
+	a, b := newTestBackend(t, 502), newTestBackend(t, 502)
+	cfg := loadTestConfig(t, retryBreakerConfig, map[string]string{"a": a.URL, "b": b.URL, "trip": "1"})
+	svc := cfg.Services["api"]
+
+	serve(cfg, httptest.NewRequest(http.MethodGet, "/api/", nil))
+
+	var requests, failures int
+	for _, up := range svc.upstreams {
+		requests += up.requests
+		failures += up.failures
+	}
+	if hits := a.hits.Load() + b.hits.Load(); int64(requests) != hits || int64(failures) != hits {
+		t.Errorf("recorded %d requests and %d failures for %d attempts", requests, failures, hits)
+	}
+	if hits := a.hits.Load() + b.hits.Load(); hits != 2 {
+		t.Errorf("%d attempts, want 2", hits)
+	}
+}
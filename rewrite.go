@@ -0,0 +1,33 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+)
+
+type RewriteURLsConfig struct {
+	From string `yaml:"from"`
+	To   string `yaml:"to"`
+}
+
+// rewriteURLs replaces the backend's base URL with the external one in JSON
+// bodies, including the "\/"-escaped form some encoders emit.
+func (svc *Service) rewriteURLs(resp *http.Response, ru *RewriteURLsConfig) error {
+	if !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+		return nil
+	}
+
+	body, ok, err := readResponseBody(resp, int64(svc.MaxBufferedResponse), svc.decompression)
+	if err != nil || !ok {
+		return err
+	}
+
+	body = bytes.ReplaceAll(body, []byte(ru.From), []byte(ru.To))
+	escapedFrom := strings.ReplaceAll(ru.From, "/", `\/`)
+	escapedTo := strings.ReplaceAll(ru.To, "/", `\/`)
+	body = bytes.ReplaceAll(body, []byte(escapedFrom), []byte(escapedTo))
+
+	setResponseBody(resp, body)
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+)
+
+type RootPathConfig struct {
+	Action      string `yaml:"action"` // reject (default), redirect, static, service
+	To          string `yaml:"to"`
+	Status      int    `yaml:"status"`
+	Body        string `yaml:"body"`
+	ContentType string `yaml:"content_type"`
+	Service     string `yaml:"service"`
+}
+
+func (rp *RootPathConfig) validate(services map[string]*Service) error {
+	switch rp.Action {
+	case "", "reject", "static":
+	case "redirect":
+		if rp.To == "" {
+			return fmt.Errorf("redirect requires to")
+		}
+	case "service":
+		if _, ok := services[rp.Service]; !ok {
+			return fmt.Errorf("unknown service %q", rp.Service)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", rp.Action)
+	}
+	return nil
+}
+
+// serveRoot handles a request for "/". It returns the service to route it
+// to, or ok=false if the response has already been written.
+func (c *Config) serveRoot(w http.ResponseWriter, r *http.Request) (service string, ok bool) {
+	rp := c.RootPath
+	if rp == nil {
+		rp = &RootPathConfig{}
+	}
+
+	switch rp.Action {
+	case "redirect":
+		status := rp.Status
+		if status == 0 {
+			status = http.StatusFound
+		}
+		http.Redirect(w, r, rp.To, status)
+	case "static":
+		if rp.ContentType != "" {
+			w.Header().Set("Content-Type", rp.ContentType)
+		}
+		status := rp.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		w.WriteHeader(status)
+		fmt.Fprint(w, rp.Body)
+	case "service":
+		return rp.Service, true
+	default:
+		c.errors.write(w, r, errServiceNotSpecified)
+	}
+	return "", false
+}
+
+// registerReserved adds a gateway-owned endpoint at an exact path.
+func (c *Config) registerReserved(path string, h http.Handler) {
+	if c.reserved == nil {
+		c.reserved = make(map[string]http.Handler)
+	}
+	c.reserved[path] = h
+}
+
+// reservedHandler returns the gateway endpoint for a path, if any. By
+// default these take precedence over services; with reserved_precedence:
+// services, a service whose name matches the first path segment wins.
+func (c *Config) reservedHandler(path, firstSegment string) (http.Handler, bool) {
+	h, ok := c.reserved[path]
+	if !ok {
+		return nil, false
+	}
+	if c.ReservedPrecedence == "services" {
+		if _, isService := c.Services[firstSegment]; isService {
+			return nil, false
+		}
+	}
+	return h, true
+}
+
+func (c *Config) gatewayHealthHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	// Load balancers take a draining replica out of rotation
+	if c.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "draining")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,559 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// SchemaConfig checks JSON bodies against JSON Schema documents. Requests
+// that don't conform are rejected; responses that don't are only logged.
+type SchemaConfig struct {
+	Request      string   `yaml:"request,omitempty"`
+	Response     string   `yaml:"response,omitempty"`
+	MaxBodyBytes byteSize `yaml:"max_body_bytes,omitempty"`
+	request      *jsonSchema
+	response     *jsonSchema
+}
+
+func (sc *SchemaConfig) setDefaults() {
+	if sc.MaxBodyBytes == 0 {
+		sc.MaxBodyBytes = 1 << 20
+	}
+}
+
+func (sc *SchemaConfig) compile() error {
+	var err error
+	if sc.Request != "" {
+		if sc.request, err = loadJSONSchema(sc.Request); err != nil {
+			return fmt.Errorf("request: %w", err)
+		}
+	}
+	if sc.Response != "" {
+		if sc.response, err = loadJSONSchema(sc.Response); err != nil {
+			return fmt.Errorf("response: %w", err)
+		}
+	}
+	return nil
+}
+
+// checkRequestSchema validates a request body against the request schema,
+// returning the error to answer with if it doesn't conform. A body over
+// max_body_bytes can't be checked, so is refused whether its length is
+// declared or not.
+func (svc *Service) checkRequestSchema(r *http.Request) *gatewayError {
+	sc := svc.Schema
+	if r.ContentLength > int64(sc.MaxBodyBytes) {
+		return errBodyTooLarge
+	}
+	if r.ContentLength == 0 {
+		return nil
+	}
+	body, err := peekRequestBody(r, int64(sc.MaxBodyBytes)+1)
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || int64(len(body)) > int64(sc.MaxBodyBytes) {
+		return errBodyTooLarge
+	}
+	if err != nil || len(body) == 0 {
+		return nil
+	}
+
+	e := *errSchemaViolation
+	doc, err := decodeJSONBody(body)
+	if err != nil {
+		e.message += ": body is not valid JSON"
+		return &e
+	}
+	if err := sc.request.validate(doc, ""); err != nil {
+		e.message += ": " + err.Error()
+		return &e
+	}
+	return nil
+}
+
+// checkResponseSchema logs responses that don't match the response schema.
+// Streamed, non-JSON and oversized responses are skipped.
+func (svc *Service) checkResponseSchema(resp *http.Response) error {
+	sc := svc.Schema
+	contentType := resp.Header.Get("Content-Type")
+	if !isJSONContentType(contentType) || resp.ContentLength > int64(sc.MaxBodyBytes) || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" {
+		return nil
+	}
+
+	raw, ok, err := bufferResponseBody(resp, min(int64(sc.MaxBodyBytes), int64(svc.MaxBufferedResponse)))
+	if err != nil || !ok {
+		return err
+	}
+	setResponseBody(resp, raw)
+	if int64(len(raw)) > int64(sc.MaxBodyBytes) {
+		return nil
+	}
+
+	body := raw
+	if encoding == "gzip" {
+		if body, err = svc.decompression.gunzip(raw, int64(sc.MaxBodyBytes)); err != nil {
+			if errors.Is(err, errDecompressionBomb) {
+				return err
+			}
+			return nil
+		}
+	}
+
+	violation := "body is not valid JSON"
+	if doc, err := decodeJSONBody(body); err == nil {
+		if err = sc.response.validate(doc, ""); err == nil {
+			return nil
+		}
+		violation = err.Error()
+	}
+	log.Printf("[%s] response schema violation: %s %s returned %d: %s%s", svc.name, resp.Request.Method, resp.Request.URL.Path, resp.StatusCode, violation, logContextFrom(resp.Request.Context()))
+	return nil
+}
+
+func isJSONContentType(contentType string) bool {
+	mediaType, _, _ := strings.Cut(strings.ToLower(contentType), ";")
+	mediaType = strings.TrimSpace(mediaType)
+	return mediaType == "application/json" || strings.HasSuffix(mediaType, "+json")
+}
+
+func decodeJSONBody(body []byte) (any, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var doc any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, fmt.Errorf("trailing data")
+	}
+	return doc, nil
+}
+
+// jsonSchema is a compiled JSON Schema. The common validation keywords are
+// supported; annotations such as format and description are ignored, and
+// $ref may only point within the same document.
+type jsonSchema struct {
+	always      *bool // the true and false schemas
+	types       []string
+	properties  map[string]*jsonSchema
+	required    []string
+	additional  *jsonSchema
+	items       *jsonSchema
+	enum        []any
+	hasConst    bool
+	constValue  any
+	minimum     *float64
+	maximum     *float64
+	exclMinimum *float64
+	exclMaximum *float64
+	multipleOf  *float64
+	minLength   *int
+	maxLength   *int
+	pattern     *regexp.Regexp
+	minItems    *int
+	maxItems    *int
+	unique      bool
+	minProps    *int
+	maxProps    *int
+	allOf       []*jsonSchema
+	anyOf       []*jsonSchema
+	oneOf       []*jsonSchema
+	not         *jsonSchema
+	ref         *jsonSchema
+}
+
+type schemaCompiler struct {
+	root any
+	refs map[string]*jsonSchema
+}
+
+func loadJSONSchema(path string) (*jsonSchema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	root, err := decodeJSONBody(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	sc := &schemaCompiler{root: root, refs: make(map[string]*jsonSchema)}
+	s, err := sc.compile(root)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+func (c *schemaCompiler) compile(node any) (*jsonSchema, error) {
+	if b, ok := node.(bool); ok {
+		return &jsonSchema{always: &b}, nil
+	}
+	m, ok := node.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("schema must be an object or boolean")
+	}
+
+	s := &jsonSchema{}
+	var err error
+	if ref, ok := m["$ref"].(string); ok {
+		if s.ref, err = c.resolve(ref); err != nil {
+			return nil, err
+		}
+	}
+
+	switch t := m["type"].(type) {
+	case string:
+		s.types = []string{t}
+	case []any:
+		for _, v := range t {
+			name, _ := v.(string)
+			s.types = append(s.types, name)
+		}
+	}
+
+	if props, ok := m["properties"].(map[string]any); ok {
+		s.properties = make(map[string]*jsonSchema, len(props))
+		for name, sub := range props {
+			if s.properties[name], err = c.compile(sub); err != nil {
+				return nil, fmt.Errorf("properties.%s: %w", name, err)
+			}
+		}
+	}
+	if req, ok := m["required"].([]any); ok {
+		for _, v := range req {
+			if name, ok := v.(string); ok {
+				s.required = append(s.required, name)
+			}
+		}
+	}
+	for key, dst := range map[string]**jsonSchema{"additionalProperties": &s.additional, "items": &s.items, "not": &s.not} {
+		if sub, ok := m[key]; ok {
+			if *dst, err = c.compile(sub); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+	for key, dst := range map[string]*[]*jsonSchema{"allOf": &s.allOf, "anyOf": &s.anyOf, "oneOf": &s.oneOf} {
+		subs, _ := m[key].([]any)
+		for i, sub := range subs {
+			compiled, err := c.compile(sub)
+			if err != nil {
+				return nil, fmt.Errorf("%s[%d]: %w", key, i, err)
+			}
+			*dst = append(*dst, compiled)
+		}
+	}
+
+	if enum, ok := m["enum"].([]any); ok {
+		for _, v := range enum {
+			s.enum = append(s.enum, normalizeJSON(v))
+		}
+	}
+	if v, ok := m["const"]; ok {
+		s.hasConst, s.constValue = true, normalizeJSON(v)
+	}
+
+	for key, dst := range map[string]**float64{"minimum": &s.minimum, "maximum": &s.maximum, "exclusiveMinimum": &s.exclMinimum, "exclusiveMaximum": &s.exclMaximum, "multipleOf": &s.multipleOf} {
+		if n, ok := m[key].(json.Number); ok {
+			f, err := n.Float64()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = &f
+		}
+	}
+	for key, dst := range map[string]**int{"minLength": &s.minLength, "maxLength": &s.maxLength, "minItems": &s.minItems, "maxItems": &s.maxItems, "minProperties": &s.minProps, "maxProperties": &s.maxProps} {
+		if n, ok := m[key].(json.Number); ok {
+			i, err := strconv.Atoi(n.String())
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+			*dst = &i
+		}
+	}
+	if p, ok := m["pattern"].(string); ok {
+		if s.pattern, err = regexp.Compile(p); err != nil {
+			return nil, fmt.Errorf("pattern: %w", err)
+		}
+	}
+	s.unique, _ = m["uniqueItems"].(bool)
+	return s, nil
+}
+
+// resolve compiles the schema a local $ref such as "#/$defs/user" points to.
+// Refs are compiled once, so recursive schemas work.
+func (c *schemaCompiler) resolve(ref string) (*jsonSchema, error) {
+	if s, ok := c.refs[ref]; ok {
+		return s, nil
+	}
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("$ref %q: only refs within the document are supported", ref)
+	}
+
+	node := c.root
+	for _, token := range strings.Split(strings.TrimPrefix(strings.TrimPrefix(ref, "#"), "/"), "/") {
+		if token == "" {
+			continue
+		}
+		token = strings.ReplaceAll(strings.ReplaceAll(token, "~1", "/"), "~0", "~")
+		switch n := node.(type) {
+		case map[string]any:
+			node = n[token]
+		case []any:
+			i, err := strconv.Atoi(token)
+			if err != nil || i < 0 || i >= len(n) {
+				return nil, fmt.Errorf("$ref %q not found", ref)
+			}
+			node = n[i]
+		default:
+			node = nil
+		}
+		if node == nil {
+			return nil, fmt.Errorf("$ref %q not found", ref)
+		}
+	}
+
+	s := &jsonSchema{}
+	c.refs[ref] = s
+	compiled, err := c.compile(node)
+	if err != nil {
+		return nil, fmt.Errorf("$ref %q: %w", ref, err)
+	}
+	*s = *compiled
+	return s, nil
+}
+
+// normalizeJSON turns json.Numbers into float64s so values compare equal
+// however they were written.
+func normalizeJSON(v any) any {
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		return f
+	case []any:
+		out := make([]any, len(v))
+		for i, e := range v {
+			out[i] = normalizeJSON(e)
+		}
+		return out
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for k, e := range v {
+			out[k] = normalizeJSON(e)
+		}
+		return out
+	}
+	return v
+}
+
+func jsonType(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := v.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	}
+	return "unknown"
+}
+
+// validate checks v, reporting the first violation found with its JSON
+// pointer, e.g. "/items/2/name: expected string, got number".
+func (s *jsonSchema) validate(v any, path string) error {
+	fail := func(format string, args ...any) error {
+		where := path
+		if where == "" {
+			where = "/"
+		}
+		return fmt.Errorf("%s: %s", where, fmt.Sprintf(format, args...))
+	}
+
+	if s.always != nil {
+		if !*s.always {
+			return fail("not allowed")
+		}
+		return nil
+	}
+	if s.ref != nil {
+		if err := s.ref.validate(v, path); err != nil {
+			return err
+		}
+	}
+
+	typ := jsonType(v)
+	if len(s.types) > 0 {
+		ok := false
+		for _, t := range s.types {
+			if t == typ || t == "number" && typ == "integer" {
+				ok = true
+			}
+		}
+		if !ok {
+			return fail("expected %s, got %s", strings.Join(s.types, " or "), typ)
+		}
+	}
+
+	if len(s.enum) > 0 {
+		nv, found := normalizeJSON(v), false
+		for _, e := range s.enum {
+			if reflect.DeepEqual(nv, e) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fail("value is not one of the allowed values")
+		}
+	}
+	if s.hasConst && !reflect.DeepEqual(normalizeJSON(v), s.constValue) {
+		return fail("value does not match const")
+	}
+
+	switch v := v.(type) {
+	case json.Number:
+		f, _ := v.Float64()
+		switch {
+		case s.minimum != nil && f < *s.minimum:
+			return fail("%s is less than minimum %g", v, *s.minimum)
+		case s.maximum != nil && f > *s.maximum:
+			return fail("%s is greater than maximum %g", v, *s.maximum)
+		case s.exclMinimum != nil && f <= *s.exclMinimum:
+			return fail("%s is not greater than %g", v, *s.exclMinimum)
+		case s.exclMaximum != nil && f >= *s.exclMaximum:
+			return fail("%s is not less than %g", v, *s.exclMaximum)
+		case s.multipleOf != nil && *s.multipleOf > 0 && math.Abs(math.Remainder(f, *s.multipleOf)) > 1e-9:
+			return fail("%s is not a multiple of %g", v, *s.multipleOf)
+		}
+
+	case string:
+		n := utf8.RuneCountInString(v)
+		switch {
+		case s.minLength != nil && n < *s.minLength:
+			return fail("string shorter than %d characters", *s.minLength)
+		case s.maxLength != nil && n > *s.maxLength:
+			return fail("string longer than %d characters", *s.maxLength)
+		case s.pattern != nil && !s.pattern.MatchString(v):
+			return fail("string does not match pattern %q", s.pattern)
+		}
+
+	case []any:
+		switch {
+		case s.minItems != nil && len(v) < *s.minItems:
+			return fail("fewer than %d items", *s.minItems)
+		case s.maxItems != nil && len(v) > *s.maxItems:
+			return fail("more than %d items", *s.maxItems)
+		}
+		if s.unique {
+			for i := range v {
+				for j := i + 1; j < len(v); j++ {
+					if reflect.DeepEqual(normalizeJSON(v[i]), normalizeJSON(v[j])) {
+						return fail("items %d and %d are equal", i, j)
+					}
+				}
+			}
+		}
+		if s.items != nil {
+			for i, item := range v {
+				if err := s.items.validate(item, path+"/"+strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		}
+
+	case map[string]any:
+		switch {
+		case s.minProps != nil && len(v) < *s.minProps:
+			return fail("fewer than %d properties", *s.minProps)
+		case s.maxProps != nil && len(v) > *s.maxProps:
+			return fail("more than %d properties", *s.maxProps)
+		}
+		for _, name := range s.required {
+			if _, ok := v[name]; !ok {
+				return fail("missing required property %q", name)
+			}
+		}
+		// Sorted, so the reported violation is stable
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			sub := path + "/" + strings.ReplaceAll(strings.ReplaceAll(name, "~", "~0"), "/", "~1")
+			if ps, ok := s.properties[name]; ok {
+				if err := ps.validate(v[name], sub); err != nil {
+					return err
+				}
+			} else if s.additional != nil {
+				if err := s.additional.validate(v[name], sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	for _, sub := range s.allOf {
+		if err := sub.validate(v, path); err != nil {
+			return err
+		}
+	}
+	if len(s.anyOf) > 0 {
+		var firstErr error
+		for _, sub := range s.anyOf {
+			err := sub.validate(v, path)
+			if err == nil {
+				firstErr = nil
+				break
+			}
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if firstErr != nil {
+			return fail("matches none of anyOf (%v)", firstErr)
+		}
+	}
+	if len(s.oneOf) > 0 {
+		matched := 0
+		for _, sub := range s.oneOf {
+			if sub.validate(v, path) == nil {
+				matched++
+			}
+		}
+		if matched != 1 {
+			return fail("matches %d of oneOf, want exactly 1", matched)
+		}
+	}
+	if s.not != nil && s.not.validate(v, path) == nil {
+		return fail("matches a schema it must not")
+	}
+	return nil
+}
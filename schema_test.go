@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const schemaConfig = `
+services:
+  api:
+    target: "{{target}}"
+    schema:
+      request: "{{schema}}"
+      max_body_bytes: 64
+`
+
+func TestRequestSchemaBodyLimit(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK)
+	schema := filepath.Join(t.TempDir(), "request.json")
+	if err := os.WriteFile(schema, []byte(`{"type": "object", "required": ["id"]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := loadTestConfig(t, schemaConfig, map[string]string{"target": backend.URL, "schema": schema})
+
+	large := `{"id": 1, "pad": "` + strings.Repeat("x", 64) + `"}`
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool
+		want    int
+	}{
+		{name: "valid", body: `{"id": 1}`, want: http.StatusOK},
+		{name: "violation", body: `{"name": "x"}`, want: http.StatusBadRequest},
+		{name: "not json", body: `{`, want: http.StatusBadRequest},
+		{name: "over the limit", body: large, want: http.StatusRequestEntityTooLarge},
+		{name: "chunked over the limit", body: large, chunked: true, want: http.StatusRequestEntityTooLarge},
+		{name: "chunked valid", body: `{"id": 1}`, chunked: true, want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/api/items", strings.NewReader(tt.body))
+			if tt.chunked {
+				// A reader of unknown length is sent chunked
+				r.Body, r.ContentLength = io.NopCloser(strings.NewReader(tt.body)), -1
+			}
+			if w := serve(cfg, r); w.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+const defaultDrainTimeout = 5 * time.Second
+
+type ShutdownConfig struct {
+	DrainTimeout time.Duration `yaml:"drain_timeout"`
+	RejectNew    bool          `yaml:"reject_new"` // 503 new requests as soon as shutdown begins
+}
+
+func (svc *Service) drainTimeout() time.Duration {
+	if svc.Shutdown != nil && svc.Shutdown.DrainTimeout > 0 {
+		return svc.Shutdown.DrainTimeout
+	}
+	return defaultDrainTimeout
+}
+
+// beginDrain marks the gateway as shutting down and schedules each service's
+// in-flight requests to be cancelled once its drain timeout has passed. It
+// returns the longest drain timeout, which bounds the server shutdown, and a
+// func that calls off the timeouts once the shutdown is over.
+func (c *Config) beginDrain() (time.Duration, func()) {
+	c.draining.Store(true)
+
+	var longest time.Duration
+	timers := make([]*time.Timer, 0, len(c.Services))
+	for name, svc := range c.Services {
+		timeout := svc.drainTimeout()
+		if timeout > longest {
+			longest = timeout
+		}
+		name, svc := name, svc
+		timers = append(timers, time.AfterFunc(timeout, func() {
+			log.Printf("[%s] drain timeout (%s) reached, cancelling in-flight requests", name, timeout)
+			if svc.concurrency.inFlight.Load() > 0 {
+				c.drainCut.Store(true)
+			}
+			svc.cancelDrain()
+		}))
+	}
+	if longest == 0 {
+		longest = defaultDrainTimeout
+	}
+	return longest, func() {
+		for _, t := range timers {
+			t.Stop()
+		}
+	}
+}
+
+// rejectDraining turns away new requests for services configured to stop
+// taking traffic as soon as shutdown starts.
+func (c *Config) rejectDraining(w http.ResponseWriter, r *http.Request, svc *Service) bool {
+	if svc.Shutdown == nil || !svc.Shutdown.RejectNew || !c.draining.Load() {
+		return false
+	}
+	w.Header().Set("Connection", "close")
+	c.errors.writeOverload(w, r, errShuttingDown, overload{reason: "shutting_down"})
+	return true
+}
+
+// withDrain ties a request's context to its service's drain deadline.
+func (svc *Service) withDrain(r *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(r.Context())
+	stop := context.AfterFunc(svc.drainCtx, cancel)
+	return r.WithContext(ctx), func() {
+		stop()
+		cancel()
+	}
+}
+
+// ShutdownReportConfig writes a summary of the gateway's run when it shuts
+// down, as a record that a rollout drained cleanly.
+type ShutdownReportConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	File    string `yaml:"file,omitempty"` // also written here; otherwise only logged
+}
+
+type shutdownReport struct {
+	Started       time.Time         `json:"shutdown_started"`
+	Finished      time.Time         `json:"shutdown_finished"`
+	Requests      uint64            `json:"requests_total"`
+	Services      map[string]uint64 `json:"services"`
+	InFlightStart int64             `json:"in_flight_at_start"`
+	InFlightEnd   int64             `json:"in_flight_at_end"`
+	Drain         string            `json:"drain"` // clean, timed_out
+	Error         string            `json:"error,omitempty"`
+}
+
+// startShutdownReport takes the in-flight count as shutdown begins, or
+// returns nil if no report is wanted.
+func (c *Config) startShutdownReport() *shutdownReport {
+	if c.ShutdownReport == nil || !c.ShutdownReport.Enabled {
+		return nil
+	}
+	report := &shutdownReport{Started: time.Now()}
+	for _, live := range c.liveConfigs() {
+		report.InFlightStart += live.inFlight.Load()
+	}
+	return report
+}
+
+// finishShutdownReport completes the report once the server has shut down,
+// or given up waiting, and logs it. The drain timed out if the server did,
+// or if a service had to cancel requests at its drain timeout. Requests are
+// counted from the moment they are routed to a service, whatever their
+// outcome, with tenant variants under their own names, and include those
+// served by configs since replaced by a reload.
+func (c *Config) finishShutdownReport(report *shutdownReport, shutdownErr error) {
+	if report == nil {
+		return
+	}
+	report.Finished = time.Now()
+	report.Services = make(map[string]uint64, len(c.Services))
+	if c.gateway != nil {
+		for name, n := range c.gateway.servedByRetired() {
+			report.Services[name] = n
+		}
+	}
+	report.Drain = "clean"
+	for _, live := range c.liveConfigs() {
+		report.InFlightEnd += live.inFlight.Load()
+		for name, svc := range live.Services {
+			report.Services[name] += svc.requests.Load()
+		}
+		if live.drainCut.Load() {
+			report.Drain = "timed_out"
+		}
+	}
+	for _, n := range report.Services {
+		report.Requests += n
+	}
+	if shutdownErr != nil {
+		report.Drain = "timed_out"
+		report.Error = shutdownErr.Error()
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		log.Printf("[gateway] shutdown report: %v", err)
+		return
+	}
+	log.Printf("[gateway] shutdown report: %s", data)
+	if path := c.ShutdownReport.File; path != "" {
+		if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+			log.Printf("[gateway] writing shutdown report to %s: %v", path, err)
+		}
+	}
+}
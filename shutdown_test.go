@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+const drainConfig = `
+services:
+  fast:
+    target: "{{target}}"
+    shutdown: {drain_timeout: 50ms}
+  slow:
+    target: "{{target}}"
+    shutdown: {drain_timeout: 100ms}
+`
+
+func TestBeginDrain(t *testing.T) {
+	backend := newTestBackend(t, http.StatusOK)
+
+	t.Run("clean drain calls off the timeouts", func(t *testing.T) {
+		cfg := loadTestConfig(t, drainConfig, map[string]string{"target": backend.URL})
+		timeout, end := cfg.beginDrain()
+		if timeout != 100*time.Millisecond {
+			t.Fatalf("drain bounded by %s, want the longest drain_timeout", timeout)
+		}
+		end()
+		time.Sleep(150 * time.Millisecond)
+		for name, svc := range cfg.Services {
+			if svc.drainCtx.Err() != nil {
+				t.Errorf("%s cancelled after a clean drain", name)
+			}
+		}
+		if cfg.drainCut.Load() {
+			t.Error("clean drain reported as cut")
+		}
+	})
+
+	t.Run("timeouts cancel what is still in flight", func(t *testing.T) {
+		cfg := loadTestConfig(t, drainConfig, map[string]string{"target": backend.URL})
+		cfg.Services["slow"].concurrency.inFlight.Add(1)
+		_, end := cfg.beginDrain()
+		defer end()
+		time.Sleep(150 * time.Millisecond)
+		for name, svc := range cfg.Services {
+			if svc.drainCtx.Err() == nil {
+				t.Errorf("%s not cancelled at its drain timeout", name)
+			}
+		}
+		if !cfg.drainCut.Load() {
+			t.Error("drain with a request cut off reported as clean")
+		}
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// Bytes read from the start of a body to detect its type, as net/http does
+const sniffLen = 512
+
+// detectContentType corrects the Content-Type of responses from backends
+// that leave it out or fall back to a generic one, such as JSON served as
+// text/plain. Only the first bytes are read; the body is then streamed on as
+// usual. Bodies without a Content-Length are treated as streams and left
+// alone, as are encoded ones.
+func (svc *Service) detectContentType(resp *http.Response) error {
+	if resp.ContentLength <= 0 || resp.Request.Method == http.MethodHead {
+		return nil
+	}
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		return nil
+	}
+	declared, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch declared {
+	case "", "text/plain", "application/octet-stream":
+	default:
+		return nil
+	}
+
+	head := make([]byte, min(resp.ContentLength, sniffLen))
+	n, err := io.ReadFull(resp.Body, head)
+	head = head[:n]
+	resp.Body = readCloser{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil {
+		// Let the proxy run into the same error while copying
+		return nil
+	}
+
+	detected := http.DetectContentType(head)
+	if looksLikeJSON(head, int64(n) == resp.ContentLength) {
+		detected = "application/json"
+	}
+	if t, _, _ := mime.ParseMediaType(detected); t != declared && !(declared == "" && t == "application/octet-stream") {
+		resp.Header.Set("Content-Type", detected)
+	}
+	return nil
+}
+
+// looksLikeJSON reports whether b holds a JSON object or array, or the start
+// of one if the body carries on past b.
+func looksLikeJSON(b []byte, complete bool) bool {
+	b = bytes.TrimLeft(b, " \t\r\n")
+	if len(b) == 0 || (b[0] != '{' && b[0] != '[') {
+		return false
+	}
+	if complete {
+		return json.Valid(b)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	for {
+		if _, err := dec.Token(); err != nil {
+			return err == io.EOF || err == io.ErrUnexpectedEOF
+		}
+	}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+type StatsDConfig struct {
+	Address       string        `yaml:"address"`
+	Prefix        string        `yaml:"prefix"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+}
+
+// Keep packets under a typical MTU so they aren't fragmented
+const statsdMaxPacket = 1432
+
+// statsdClient batches metric lines and ships them over UDP from a
+// background goroutine. Metrics are dropped if the buffer fills up. All
+// methods are no-ops on a nil client.
+type statsdClient struct {
+	prefix      string
+	ch          chan string
+	activeConns int64
+}
+
+func newStatsDClient(cfg *StatsDConfig) (*statsdClient, error) {
+	if cfg.Prefix == "" {
+		cfg.Prefix = "gateway"
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = 100 * time.Millisecond
+	}
+
+	conn, err := net.Dial("udp", cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &statsdClient{
+		prefix: strings.TrimSuffix(cfg.Prefix, ".") + ".",
+		ch:     make(chan string, 10000),
+	}
+	go c.run(conn, cfg.FlushInterval)
+	return c, nil
+}
+
+func (c *statsdClient) run(conn net.Conn, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	buf := make([]byte, 0, statsdMaxPacket)
+	flush := func() {
+		if len(buf) == 0 {
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			log.Printf("statsd: %v", err)
+		}
+		buf = buf[:0]
+	}
+
+	for {
+		select {
+		case line := <-c.ch:
+			if len(buf)+len(line)+1 > statsdMaxPacket {
+				flush()
+			}
+			if len(buf) > 0 {
+				buf = append(buf, '\n')
+			}
+			buf = append(buf, line...)
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (c *statsdClient) send(name, value, kind string) {
+	if c == nil {
+		return
+	}
+	select {
+	case c.ch <- c.prefix + name + ":" + value + "|" + kind:
+	default:
+	}
+}
+
+func (c *statsdClient) count(name string, n int64) {
+	c.send(name, fmt.Sprint(n), "c")
+}
+
+func (c *statsdClient) timing(name string, d time.Duration) {
+	c.send(name, fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond)), "ms")
+}
+
+func (c *statsdClient) gauge(name string, v int64) {
+	c.send(name, fmt.Sprint(v), "g")
+}
+
+func (c *statsdClient) requestDone(service string, status int, latency time.Duration) {
+	service = statsdName(service)
+	c.count(fmt.Sprintf("requests.%s.%d", service, status), 1)
+	c.timing("latency."+service, latency)
+}
+
+// connState is installed as the server's ConnState hook to track inbound
+// connections.
+func (c *statsdClient) connState(_ net.Conn, state http.ConnState) {
+	if c == nil {
+		return
+	}
+	switch state {
+	case http.StateNew:
+		c.count("connections.new", 1)
+		c.gauge("connections.active", atomic.AddInt64(&c.activeConns, 1))
+	case http.StateClosed, http.StateHijacked:
+		c.gauge("connections.active", atomic.AddInt64(&c.activeConns, -1))
+	}
+}
+
+// statsdName strips characters with special meaning in the StatsD protocol.
+func statsdName(s string) string {
+	return strings.NewReplacer(".", "_", ":", "_", "|", "_", "@", "_").Replace(s)
+}
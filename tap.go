@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Bounds on the debug tap, which runs against production traffic
+const (
+	maxTapSessions     = 4
+	maxTapDuration     = 10 * time.Minute
+	defaultTapDuration = time.Minute
+	tapBodyBytes       = 4 << 10
+	tapBuffer          = 256
+)
+
+// tapEvent is one sampled exchange, as streamed to a tap client.
+type tapEvent struct {
+	Time           time.Time   `json:"time"`
+	Service        string      `json:"service"`
+	Method         string      `json:"method"`
+	Path           string      `json:"path"`
+	ClientIP       string      `json:"client_ip"`
+	RequestID      string      `json:"request_id,omitempty"`
+	Target         string      `json:"target"`
+	Status         int         `json:"status"`
+	LatencyMS      float64     `json:"latency_ms"`
+	RequestHeader  http.Header `json:"request_header"`
+	ResponseHeader http.Header `json:"response_header"`
+	RequestBody    string      `json:"request_body,omitempty"`
+	ResponseBody   string      `json:"response_body,omitempty"`
+}
+
+type tapSession struct {
+	sample  float64
+	bodies  bool
+	ch      chan *tapEvent
+	dropped atomic.Uint64
+}
+
+// tapHub holds a service's open taps. Requests only pay for a lock when a
+// tap is open.
+type tapHub struct {
+	active   atomic.Int32
+	mu       sync.Mutex
+	sessions map[*tapSession]struct{}
+}
+
+var tapSessions atomic.Int32
+
+func (h *tapHub) add(s *tapSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.sessions == nil {
+		h.sessions = make(map[*tapSession]struct{})
+	}
+	h.sessions[s] = struct{}{}
+	h.active.Add(1)
+}
+
+func (h *tapHub) remove(s *tapSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.sessions, s)
+	h.active.Add(-1)
+}
+
+// sample picks the taps that want this request, and whether any of them
+// wants bodies.
+func (h *tapHub) sample() (taps []*tapSession, bodies bool) {
+	if h.active.Load() == 0 {
+		return nil, false
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.sessions {
+		if rand.Float64() < s.sample {
+			taps = append(taps, s)
+			bodies = bodies || s.bodies
+		}
+	}
+	return taps, bodies
+}
+
+func publishTap(taps []*tapSession, ev *tapEvent, reqBody, respBody []byte, lr *LogRedactionConfig) {
+	ev.RequestHeader = lr.header(redactHeaders(ev.RequestHeader))
+	ev.ResponseHeader = lr.header(redactHeaders(ev.ResponseHeader))
+	withBodies := *ev
+	withBodies.RequestBody = tapBody(lr.body(reqBody))
+	withBodies.ResponseBody = tapBody(lr.body(respBody))
+
+	for _, s := range taps {
+		e := ev
+		if s.bodies {
+			e = &withBodies
+		}
+		select {
+		case s.ch <- e:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+func redactHeaders(h http.Header) http.Header {
+	h = h.Clone()
+	for _, name := range append([]string{"Set-Cookie"}, sensitiveHeaders...) {
+		if _, ok := h[http.CanonicalHeaderKey(name)]; ok {
+			h.Set(name, "[redacted]")
+		}
+	}
+	return h
+}
+
+func tapBody(b []byte) string {
+	if !utf8.Valid(b) {
+		return fmt.Sprintf("[%d bytes of binary data]", len(b))
+	}
+	return string(b)
+}
+
+// tapHandler streams a sample of a service's traffic to an admin client as
+// server-sent events, e.g. GET /admin/tap?service=api&duration=60s&sample=0.1&bodies=true.
+func (c *Config) tapHandler(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	name := q.Get("service")
+	svc, ok := c.Services[name]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown service %q", name), http.StatusBadRequest)
+		return
+	}
+	duration := defaultTapDuration
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		duration = min(d, maxTapDuration)
+	}
+	session := &tapSession{sample: 1, bodies: q.Get("bodies") == "true", ch: make(chan *tapEvent, tapBuffer)}
+	if v := q.Get("sample"); v != "" {
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || f <= 0 || f > 1 {
+			http.Error(w, "sample must be in (0, 1]", http.StatusBadRequest)
+			return
+		}
+		session.sample = f
+	}
+
+	if tapSessions.Add(1) > maxTapSessions {
+		tapSessions.Add(-1)
+		http.Error(w, "too many taps open", http.StatusServiceUnavailable)
+		return
+	}
+	defer tapSessions.Add(-1)
+	svc.taps.add(session)
+	defer svc.taps.remove(session)
+	log.Printf("[%s] tap opened by %s for %s (sample %g, bodies %t)", name, remoteIP(r), duration, session.sample, session.bodies)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	rc := http.NewResponseController(w)
+	// The tap may outlive the server's write timeout
+	rc.SetWriteDeadline(time.Time{})
+	w.WriteHeader(http.StatusOK)
+	rc.Flush()
+
+	deadline := time.NewTimer(duration)
+	defer deadline.Stop()
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var sent, idle int
+loop:
+	for {
+		select {
+		case ev := <-session.ch:
+			data, _ := json.Marshal(ev)
+			if _, err := fmt.Fprintf(w, "event: request\ndata: %s\n\n", data); err != nil {
+				break loop
+			}
+			rc.Flush()
+			sent, idle = sent+1, 0
+		case <-ticker.C:
+			// Taps end when the gateway starts draining, so they never hold up shutdown
+			if c.draining.Load() {
+				break loop
+			}
+			if idle++; idle%15 == 0 {
+				fmt.Fprint(w, ": keepalive\n\n")
+				rc.Flush()
+			}
+		case <-deadline.C:
+			break loop
+		case <-r.Context().Done():
+			break loop
+		}
+	}
+
+	dropped := session.dropped.Load()
+	fmt.Fprintf(w, "event: end\ndata: {\"sent\":%d,\"dropped\":%d}\n\n", sent, dropped)
+	rc.Flush()
+	log.Printf("[%s] tap closed: %d events sent, %d dropped", name, sent, dropped)
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TenantConfig says where a service finds the tenant a request belongs to:
+// a header, the first label of the Host ("acme" in acme.api.example.com), or
+// a claim of the caller's authenticated JWT.
+type TenantConfig struct {
+	Header    string `yaml:"header,omitempty"`
+	Subdomain bool   `yaml:"subdomain,omitempty"`
+	Claim     string `yaml:"claim,omitempty"`
+}
+
+func (tc *TenantConfig) validate(svc *Service) error {
+	sources := 0
+	for _, set := range []bool{tc.Header != "", tc.Subdomain, tc.Claim != ""} {
+		if set {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return fmt.Errorf("exactly one of header, subdomain or claim is required")
+	}
+	// Claims are only trusted once the token itself has been verified
+	if tc.Claim != "" && (svc.Auth == nil || svc.Auth.Type == "apikey") {
+		return fmt.Errorf("claim requires bearer or introspection auth")
+	}
+	return nil
+}
+
+func (tc *TenantConfig) resolve(r *http.Request) string {
+	switch {
+	case tc.Header != "":
+		return r.Header.Get(tc.Header)
+	case tc.Subdomain:
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if label, _, ok := strings.Cut(host, "."); ok {
+			return strings.ToLower(label)
+		}
+		return ""
+	default:
+		claims := jwtClaims(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if v, ok := claims[tc.Claim]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+}
+
+// tenantFor returns the service variant for r's tenant, or svc itself for
+// requests without a known tenant.
+func (svc *Service) tenantFor(r *http.Request) *Service {
+	if t, ok := svc.tenants[svc.Tenant.resolve(r)]; ok {
+		return t
+	}
+	return svc
+}
+
+// expandTenants turns each entry under a service's tenants into a service
+// of its own, named "service@tenant": the parent's settings with the
+// tenant's block applied on top. Tenant services are set up like any other
+// (their own limiter, transport, health checks and metrics) but can only be
+// reached through the parent.
+func (c *Config) expandTenants() error {
+	variants := make(map[string]*Service)
+	for name, svc := range c.Services {
+		if len(svc.Tenants) == 0 {
+			continue
+		}
+		if svc.Tenant == nil {
+			return fmt.Errorf("tenants for %s requires tenant", name)
+		}
+		if err := svc.Tenant.validate(svc); err != nil {
+			return fmt.Errorf("invalid tenant for %s: %w", name, err)
+		}
+
+		svc.tenants = make(map[string]*Service, len(svc.Tenants))
+		for tenant, node := range svc.Tenants {
+			variant, err := svc.tenantVariant(node)
+			if err != nil {
+				return fmt.Errorf("invalid tenant %s for %s: %w", tenant, name, err)
+			}
+			variantName := name + "@" + tenant
+			if _, exists := c.Services[variantName]; exists {
+				return fmt.Errorf("tenant %s for %s: service %s already exists", tenant, name, variantName)
+			}
+			variant.tenantOf = name
+			svc.tenants[tenant] = variant
+			variants[variantName] = variant
+		}
+	}
+	for name, variant := range variants {
+		c.Services[name] = variant
+	}
+	return nil
+}
+
+func (svc *Service) tenantVariant(node yaml.Node) (*Service, error) {
+	variant := new(Service)
+	if err := svc.node.Decode(variant); err != nil {
+		return nil, err
+	}
+	variant.Tenant, variant.Tenants = nil, nil
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		switch node.Content[i].Value {
+		case "tenant", "tenants":
+			return nil, fmt.Errorf("tenants cannot be nested")
+		case "target", "targets":
+			// Either form replaces the parent's targets entirely
+			variant.Target, variant.Targets = "", nil
+		}
+	}
+	if err := node.Decode(variant); err != nil {
+		return nil, err
+	}
+	return variant, nil
+}
+
+// UnmarshalYAML keeps the service's node so tenant variants can be decoded
+// from it.
+func (svc *Service) UnmarshalYAML(node *yaml.Node) error {
+	type plain Service
+	if err := node.Decode((*plain)(svc)); err != nil {
+		return err
+	}
+	svc.node = node
+	return nil
+}
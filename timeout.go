@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TimeoutConfig bounds the phases of an upstream request. It can be written
+// as a single duration, which sets total.
+type TimeoutConfig struct {
+	// Connect limits establishing a connection to the upstream, TLS
+	// handshake excluded; 30s if unset
+	Connect time.Duration `yaml:"connect,omitempty"`
+	// ResponseHeader limits the wait for the upstream to start responding,
+	// after the request has been sent
+	ResponseHeader time.Duration `yaml:"response_header,omitempty"`
+	// Total limits the whole exchange, including streaming the response
+	// body; leave it unset for long-lived streams
+	Total time.Duration `yaml:"total,omitempty"`
+}
+
+func (tc *TimeoutConfig) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*tc = TimeoutConfig{}
+		return node.Decode(&tc.Total)
+	}
+	type plain TimeoutConfig
+	return node.Decode((*plain)(tc))
+}
+
+// merge fills the phases tc leaves unset from d.
+func (tc *TimeoutConfig) merge(d TimeoutConfig) {
+	if tc.Connect == 0 {
+		tc.Connect = d.Connect
+	}
+	if tc.ResponseHeader == 0 {
+		tc.ResponseHeader = d.ResponseHeader
+	}
+	if tc.Total == 0 {
+		tc.Total = d.Total
+	}
+}
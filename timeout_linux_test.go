@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// stalledListener returns the address of a socket that never accepts, with
+// its backlog full, so connecting to it hangs until the dialer gives up.
+func stalledListener(t *testing.T) string {
+	t.Helper()
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatal(err)
+	}
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", sa.(*syscall.SockaddrInet4).Port)
+
+	for i := 0; ; i++ {
+		conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond)
+		if err != nil {
+			return addr
+		}
+		t.Cleanup(func() { conn.Close() })
+		if i == 16 {
+			t.Skip("backlog never filled")
+		}
+	}
+}
+
+func TestTimeoutConnect(t *testing.T) {
+	addr := stalledListener(t)
+	cfg := loadTestConfig(t, phaseTimeoutConfig, map[string]string{
+		"target": "http://" + addr, "connect": "100ms", "header": "10s", "total": "10s",
+	})
+
+	start := time.Now()
+	w := serve(cfg, httptest.NewRequest(http.MethodGet, "/api/", nil))
+	if w.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status %d, want 504", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("connect gave up after %v, want about 100ms", elapsed)
+	}
+}
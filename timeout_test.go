@@ -0,0 +1,143 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const phaseTimeoutConfig = `
+services:
+  api:
+    target: "{{target}}"
+    timeout: {connect: {{connect}}, response_header: {{header}}, total: {{total}}}
+`
+
+// phaseBackend waits headerDelay before responding, then sends the body in
+// chunks over bodyTime.
+func phaseBackend(t *testing.T, headerDelay, bodyTime time.Duration) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(headerDelay)
+		w.WriteHeader(http.StatusOK)
+		for i := 0; i < 5; i++ {
+			io.WriteString(w, "chunk\n")
+			w.(http.Flusher).Flush()
+			time.Sleep(bodyTime / 5)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Each phase is limited by its own timeout alone: the others are set well
+// clear of the backend's timing.
+func TestTimeoutPhases(t *testing.T) {
+	tests := []struct {
+		name                  string
+		headerDelay, bodyTime time.Duration
+		connect, header       string
+		total                 string
+		wantStatus            int
+		wantBody              string // empty if the body is cut off
+		maxElapsed            time.Duration
+	}{
+		{
+			name:        "response_header fails a slow first byte",
+			headerDelay: 600 * time.Millisecond, connect: "5s", header: "100ms", total: "10s",
+			wantStatus: http.StatusGatewayTimeout, maxElapsed: 400 * time.Millisecond,
+		},
+		{
+			name:     "response_header doesn't limit the body",
+			bodyTime: 500 * time.Millisecond, connect: "5s", header: "100ms", total: "10s",
+			wantStatus: http.StatusOK, wantBody: "chunk\nchunk\nchunk\nchunk\nchunk\n",
+		},
+		{
+			name:        "total fails a response that hasn't started",
+			headerDelay: 600 * time.Millisecond, connect: "5s", header: "10s", total: "100ms",
+			wantStatus: http.StatusGatewayTimeout, maxElapsed: 400 * time.Millisecond,
+		},
+		{
+			name:     "total cuts off a streaming body",
+			bodyTime: time.Second, connect: "5s", header: "10s", total: "300ms",
+			wantStatus: http.StatusOK, maxElapsed: 900 * time.Millisecond,
+		},
+		{
+			name:     "without total a stream outlasts response_header",
+			bodyTime: 500 * time.Millisecond, connect: "5s", header: "100ms", total: "0s",
+			wantStatus: http.StatusOK, wantBody: "chunk\nchunk\nchunk\nchunk\nchunk\n",
+		},
+		{
+			name:        "short connect leaves slow responses alone",
+			headerDelay: 200 * time.Millisecond, bodyTime: 200 * time.Millisecond, connect: "50ms", header: "10s", total: "10s",
+			wantStatus: http.StatusOK, wantBody: "chunk\nchunk\nchunk\nchunk\nchunk\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := phaseBackend(t, tt.headerDelay, tt.bodyTime)
+			cfg := loadTestConfig(t, phaseTimeoutConfig, map[string]string{
+				"target": backend.URL, "connect": tt.connect, "header": tt.header, "total": tt.total,
+			})
+			gw := httptest.NewServer(cfg.handler())
+			defer gw.Close()
+
+			start := time.Now()
+			resp, err := http.Get(gw.URL + "/api/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, err := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			elapsed := time.Since(start)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if tt.wantBody == "" && err == nil && len(body) == 5*len("chunk\n") {
+					t.Fatal("body streamed in full past the total timeout")
+				}
+				if tt.wantBody != "" && (err != nil || string(body) != tt.wantBody) {
+					t.Fatalf("body %q (%v), want %q", body, err, tt.wantBody)
+				}
+			}
+			if tt.maxElapsed > 0 && elapsed > tt.maxElapsed {
+				t.Fatalf("took %v, want under %v", elapsed, tt.maxElapsed)
+			}
+		})
+	}
+}
+
+const timeoutYAMLConfig = `
+services:
+  api:
+    target: "http://localhost:5000"
+    timeout: {{timeout}}
+`
+
+func TestTimeoutConfigYAML(t *testing.T) {
+	tests := []struct {
+		yaml string
+		want TimeoutConfig
+	}{
+		{"30s", TimeoutConfig{Total: 30 * time.Second}},
+		{"{response_header: 5s, total: 120s}", TimeoutConfig{ResponseHeader: 5 * time.Second, Total: 120 * time.Second}},
+		{"{response_header: 5s}", TimeoutConfig{ResponseHeader: 5 * time.Second}},
+	}
+	for _, tt := range tests {
+		cfg := loadTestConfig(t, timeoutYAMLConfig, map[string]string{"timeout": tt.yaml})
+		if got := cfg.Services["api"].Timeout; got != tt.want {
+			t.Errorf("timeout: %s gave %+v, want %+v", tt.yaml, got, tt.want)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "gateway.yaml")
+	writeTestConfig(t, path, timeoutYAMLConfig, map[string]string{"timeout": "{response_header: soon}"})
+	if _, err := loadConfig(path); err == nil {
+		t.Error("invalid response_header accepted")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type TLSConfig struct {
+	CertFile     string   `yaml:"cert_file"`
+	KeyFile      string   `yaml:"key_file"`
+	MinVersion   string   `yaml:"min_version,omitempty"` // 1.2 (default), 1.3
+	CipherSuites []string `yaml:"cipher_suites,omitempty"`
+	minVersion   uint16
+	cipherSuites []uint16
+}
+
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// validate resolves the version and cipher suite names. Only suites Go
+// considers secure are accepted; TLS 1.3 suites are not configurable.
+func (tc *TLSConfig) validate() error {
+	tc.minVersion = tls.VersionTLS12
+	if tc.MinVersion != "" {
+		v, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return fmt.Errorf("unsupported min_version %q", tc.MinVersion)
+		}
+		tc.minVersion = v
+	}
+
+	secure := make(map[string]*tls.CipherSuite)
+	for _, cs := range tls.CipherSuites() {
+		secure[cs.Name] = cs
+	}
+	for _, name := range tc.CipherSuites {
+		cs, ok := secure[name]
+		if !ok {
+			return fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		if !slices.Contains(cs.SupportedVersions, tls.VersionTLS12) {
+			return fmt.Errorf("cipher suite %q is TLS 1.3 only and always enabled", name)
+		}
+		tc.cipherSuites = append(tc.cipherSuites, cs.ID)
+	}
+
+	if len(tc.cipherSuites) > 0 &&
+		!slices.Contains(tc.cipherSuites, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) &&
+		!slices.Contains(tc.cipherSuites, tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256) {
+		return fmt.Errorf("cipher_suites must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, which HTTP/2 requires")
+	}
+	return nil
+}
+
+func (tc *TLSConfig) build() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(tc.CertFile, tc.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tc.minVersion,
+		CipherSuites: tc.cipherSuites,
+	}, nil
+}
+
+func (c *Config) validateSNIRoutes() error {
+	routes := make(map[string]string, len(c.SNIRoutes))
+	for host, service := range c.SNIRoutes {
+		if _, ok := c.Services[service]; !ok {
+			return fmt.Errorf("sni_routes: %s: unknown service %q", host, service)
+		}
+		routes[strings.ToLower(host)] = service
+	}
+	c.SNIRoutes = routes
+	return nil
+}
+
+// sniRoute returns the service mapped to the TLS server name the client
+// asked for during the handshake, regardless of the Host header.
+func (c *Config) sniRoute(r *http.Request) (string, bool) {
+	if r.TLS == nil || r.TLS.ServerName == "" || len(c.SNIRoutes) == 0 {
+		return "", false
+	}
+	service, ok := c.SNIRoutes[strings.ToLower(r.TLS.ServerName)]
+	return service, ok
+}
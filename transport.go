@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var errUpstreamConnLimit = errors.New("upstream connection limit reached")
+
+const (
+	defaultTCPKeepalive   = 30 * time.Second
+	defaultConnectTimeout = 30 * time.Second
+)
+
+// TransportConfig tunes the connections a service keeps to its backends.
+type TransportConfig struct {
+	// TCPKeepalive is the interval between keep-alive probes on upstream
+	// connections, so that connections to a backend that went away are
+	// noticed while idle rather than on the next request. Negative disables
+	// probes.
+	TCPKeepalive time.Duration `yaml:"tcp_keepalive,omitempty"`
+}
+
+// newTransport builds the service's upstream transport, starting from the
+// same settings as http.DefaultTransport.
+func (svc *Service) newTransport() *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+
+	dialer := &net.Dialer{
+		Timeout:   defaultConnectTimeout,
+		KeepAlive: defaultTCPKeepalive,
+	}
+	if svc.Timeout.Connect > 0 {
+		dialer.Timeout = svc.Timeout.Connect
+	}
+	if svc.Transport != nil && svc.Transport.TCPKeepalive != 0 {
+		dialer.KeepAlive = svc.Transport.TCPKeepalive
+	}
+	t.DialContext = dialer.DialContext
+
+	t.ResponseHeaderTimeout = svc.Timeout.ResponseHeader
+
+	// With Expect: 100-continue, hold the body until the upstream accepts it
+	// or this much time passes
+	if svc.ExpectContinueTimeout > 0 {
+		t.ExpectContinueTimeout = svc.ExpectContinueTimeout
+	}
+
+	if n := svc.MaxUpstreamConnections; n > 0 {
+		// Keep up to the limit idle so capacity isn't lost to connection churn
+		t.MaxIdleConnsPerHost = n
+		t.DialContext = limitConnections(t.DialContext, n, svc.UpstreamConnectionWait)
+	}
+
+	return t
+}
+
+// limitConnections caps the number of open connections made through dial.
+// A dial beyond the cap waits up to wait for a connection to close, then
+// fails with errUpstreamConnLimit.
+func limitConnections(dial func(ctx context.Context, network, addr string) (net.Conn, error), n int, wait time.Duration) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	sem := make(chan struct{}, n)
+
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		select {
+		case sem <- struct{}{}:
+		default:
+			timer := time.NewTimer(wait)
+			defer timer.Stop()
+			select {
+			case sem <- struct{}{}:
+			case <-timer.C:
+				return nil, errUpstreamConnLimit
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			<-sem
+			return nil, err
+		}
+		return &limitedConn{Conn: conn, release: func() { <-sem }}, nil
+	}
+}
+
+// connLimitOverload describes a request failed with errUpstreamConnLimit:
+// every allowed connection was busy for the whole wait.
+func (svc *Service) connLimitOverload() overload {
+	n := int64(svc.MaxUpstreamConnections)
+	return overload{reason: "upstream_connections", retryAfter: svc.UpstreamConnectionWait, capacity: n, inFlight: n}
+}
+
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
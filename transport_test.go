@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const expectContinueConfig = `
+services:
+  api:
+    target: "{{target}}"
+    expect_continue_timeout: 100ms
+`
+
+const uploadSize = 1 << 20
+
+// uploadBackend rejects uploads to /reject without reading them, takes a
+// while to look at those to /slow, and accepts the rest straight away.
+func uploadBackend(t *testing.T, received *atomic.Int64) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/reject"):
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		case strings.HasSuffix(r.URL.Path, "/slow"):
+			time.Sleep(time.Second)
+		}
+		n, _ := io.Copy(io.Discard, r.Body)
+		received.Add(n)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// sendUploadHeaders starts an upload with Expect: 100-continue and returns
+// the first response the gateway sends back, before any of the body.
+func sendUploadHeaders(t *testing.T, addr, path string) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(conn, "POST %s HTTP/1.1\r\nHost: gateway\r\nContent-Length: %d\r\nExpect: 100-continue\r\n\r\n", path, uploadSize)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, br, resp
+}
+
+// sendBody sends the upload body after a 100 Continue and returns the final
+// response.
+func sendBody(t *testing.T, conn net.Conn, br *bufio.Reader) *http.Response {
+	t.Helper()
+	if _, err := conn.Write(make([]byte, uploadSize)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(br, nil)
+	// The backend's own 100 Continue is relayed when it comes late
+	for err == nil && resp.StatusCode == http.StatusContinue {
+		resp, err = http.ReadResponse(br, nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	return resp
+}
+
+func TestExpectContinueRejectedUpload(t *testing.T) {
+	var received atomic.Int64
+	backend := uploadBackend(t, &received)
+	gw := httptest.NewServer(loadTestConfig(t, expectContinueConfig, map[string]string{"target": backend.URL}).handler())
+	defer gw.Close()
+
+	_, _, resp := sendUploadHeaders(t, gw.Listener.Addr().String(), "/api/reject")
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("status %d before the body was sent, want 413", resp.StatusCode)
+	}
+	if n := received.Load(); n != 0 {
+		t.Fatalf("backend received %d bytes of a rejected upload", n)
+	}
+}
+
+func TestExpectContinueAcceptedUpload(t *testing.T) {
+	var received atomic.Int64
+	backend := uploadBackend(t, &received)
+	gw := httptest.NewServer(loadTestConfig(t, expectContinueConfig, map[string]string{"target": backend.URL}).handler())
+	defer gw.Close()
+
+	conn, br, resp := sendUploadHeaders(t, gw.Listener.Addr().String(), "/api/upload")
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("status %d, want 100 Continue", resp.StatusCode)
+	}
+	if resp := sendBody(t, conn, br); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d after the body, want 200", resp.StatusCode)
+	}
+	if n := received.Load(); n != uploadSize {
+		t.Fatalf("backend received %d bytes, want %d", n, uploadSize)
+	}
+}
+
+// A backend that neither accepts nor rejects within expect_continue_timeout
+// gets the body anyway.
+func TestExpectContinueTimeout(t *testing.T) {
+	var received atomic.Int64
+	backend := uploadBackend(t, &received)
+	gw := httptest.NewServer(loadTestConfig(t, expectContinueConfig, map[string]string{"target": backend.URL}).handler())
+	defer gw.Close()
+
+	start := time.Now()
+	conn, br, resp := sendUploadHeaders(t, gw.Listener.Addr().String(), "/api/slow")
+	if resp.StatusCode != http.StatusContinue {
+		t.Fatalf("status %d, want 100 Continue", resp.StatusCode)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("100 Continue after %v, want it once expect_continue_timeout ran out", elapsed)
+	}
+	if resp := sendBody(t, conn, br); resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d after the body, want 200", resp.StatusCode)
+	}
+	if n := received.Load(); n != uploadSize {
+		t.Fatalf("backend received %d bytes, want %d", n, uploadSize)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+)
+
+type WAFConfig struct {
+	Rules        []*WAFRule `yaml:"rules"`
+	MaxBodyBytes int64      `yaml:"max_body_bytes"`
+	inspectBody  bool
+}
+
+type WAFRule struct {
+	Name    string `yaml:"name"`
+	Match   string `yaml:"match"`  // path, query, header, body
+	Header  string `yaml:"header"` // for match: header; empty checks every header
+	Pattern string `yaml:"pattern"`
+	re      *regexp.Regexp
+}
+
+func (waf *WAFConfig) compile() error {
+	if waf.MaxBodyBytes == 0 {
+		waf.MaxBodyBytes = 64 << 10
+	}
+
+	for i, rule := range waf.Rules {
+		switch rule.Match {
+		case "path", "query", "header":
+		case "body":
+			waf.inspectBody = true
+		default:
+			return fmt.Errorf("rule %d: unknown match %q", i, rule.Match)
+		}
+
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return fmt.Errorf("rule %d: %w", i, err)
+		}
+		rule.re = re
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("%s:%s", rule.Match, rule.Pattern)
+		}
+	}
+	return nil
+}
+
+// check returns the first rule the request matches, or nil. Only the first
+// max_body_bytes of the body are inspected.
+func (waf *WAFConfig) check(r *http.Request) *WAFRule {
+	query := r.URL.RawQuery
+	if unescaped, err := url.QueryUnescape(query); err == nil {
+		query = unescaped
+	}
+
+	var body []byte
+	if waf.inspectBody {
+		var err error
+		body, err = peekRequestBody(r, waf.MaxBodyBytes)
+		if err != nil {
+			log.Printf("[waf] reading body: %v", err)
+		}
+	}
+
+	for _, rule := range waf.Rules {
+		switch rule.Match {
+		case "path":
+			if rule.re.MatchString(r.URL.Path) {
+				return rule
+			}
+		case "query":
+			if rule.re.MatchString(query) {
+				return rule
+			}
+		case "header":
+			for name, values := range r.Header {
+				if rule.Header != "" && http.CanonicalHeaderKey(rule.Header) != name {
+					continue
+				}
+				for _, v := range values {
+					if rule.re.MatchString(v) {
+						return rule
+					}
+				}
+			}
+		case "body":
+			if rule.re.Match(body) {
+				return rule
+			}
+		}
+	}
+	return nil
+}
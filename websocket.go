@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type WebSocketConfig struct {
+	IdleTimeout    time.Duration `yaml:"idle_timeout"`              // close after this long without data frames
+	PingInterval   time.Duration `yaml:"ping_interval"`             // ping the client; close if it stays silent a full interval
+	AllowedOrigins []string      `yaml:"allowed_origins,omitempty"` // e.g. https://app.example.com, https://*.example.com
+}
+
+func (ws *WebSocketConfig) compile() error {
+	for i, origin := range ws.AllowedOrigins {
+		origin = strings.TrimSuffix(strings.ToLower(origin), "/")
+		if origin != "null" && !strings.HasPrefix(origin, "http://") && !strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("allowed_origins: %q is not an http(s) origin", origin)
+		}
+		ws.AllowedOrigins[i] = origin
+	}
+	return nil
+}
+
+func isWebSocketUpgrade(r *http.Request) bool {
+	for _, v := range r.Header.Values("Upgrade") {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "websocket") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// originAllowed reports whether a WebSocket handshake's Origin is one of
+// allowed_origins. Browsers don't preflight WebSocket handshakes, so without
+// this check any page can open a connection carrying the user's cookies.
+// "https://*.example.com" matches any subdomain of example.com; a missing
+// Origin only passes when no origins are configured.
+func (ws *WebSocketConfig) originAllowed(origin string) bool {
+	if ws == nil || len(ws.AllowedOrigins) == 0 {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	if origin == "" {
+		return false
+	}
+
+	for _, pattern := range ws.AllowedOrigins {
+		if prefix, suffix, ok := strings.Cut(pattern, "*"); ok {
+			if strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+				len(origin) > len(prefix)+len(suffix) && !strings.ContainsAny(origin[len(prefix):len(origin)-len(suffix)], "/:@") {
+				return true
+			}
+		} else if origin == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// Unmasked, empty ping frame, as sent by a server
+var wsPingFrame = []byte{0x89, 0x00}
+
+// wrapWebSocket puts idle and liveness tracking around an upgraded
+// WebSocket connection. The reverse proxy copies between client and backend
+// through the returned body, so frames from the backend pass through Read
+// and frames from the client through Write.
+func (svc *Service) wrapWebSocket(resp *http.Response) {
+	if svc.WebSocket == nil || resp.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") {
+		return
+	}
+	backend, ok := resp.Body.(io.ReadWriteCloser)
+	if !ok {
+		return
+	}
+
+	c := &wsConn{
+		svc:     svc,
+		backend: backend,
+		chunks:  make(chan wsChunk),
+		ping:    make(chan struct{}, 1),
+		done:    make(chan struct{}),
+		atFrame: true,
+	}
+	c.touch()
+	go c.readLoop()
+	go c.monitor()
+	resp.Body = c
+}
+
+type wsChunk struct {
+	data    []byte
+	atFrame bool // the chunk ends on a frame boundary
+}
+
+type wsConn struct {
+	svc     *Service
+	backend io.ReadWriteCloser
+
+	chunks  chan wsChunk
+	readErr error
+	pending []byte
+	atFrame bool
+	ping    chan struct{}
+
+	fromBackend, fromClient wsFrameTracker
+
+	lastActivity atomic.Int64 // unix nanos of the last data frame either way
+	pingSent     atomic.Int64 // unix nanos of the oldest unanswered ping, or 0
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (c *wsConn) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
+
+func (c *wsConn) readLoop() {
+	buf := make([]byte, 32<<10)
+	for {
+		n, err := c.backend.Read(buf)
+		if n > 0 {
+			atFrame, data := c.fromBackend.feed(buf[:n])
+			if data {
+				c.touch()
+			}
+			select {
+			case c.chunks <- wsChunk{data: append([]byte(nil), buf[:n]...), atFrame: atFrame}:
+			case <-c.done:
+				return
+			}
+		}
+		if err != nil {
+			c.readErr = err
+			close(c.chunks)
+			return
+		}
+	}
+}
+
+// Read hands backend bytes to the client, slipping in a ping when one is
+// due and the stream is between frames.
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		ping := c.ping
+		if !c.atFrame {
+			ping = nil
+		}
+
+		select {
+		case chunk, ok := <-c.chunks:
+			if !ok {
+				return 0, c.readErr
+			}
+			c.pending, c.atFrame = chunk.data, chunk.atFrame
+		case <-ping:
+			c.pending = wsPingFrame
+			c.pingSent.CompareAndSwap(0, time.Now().UnixNano())
+		case <-c.done:
+			return 0, net.ErrClosed
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *wsConn) Write(p []byte) (int, error) {
+	// Anything from the client, including a pong, shows it is alive
+	c.pingSent.Store(0)
+	if _, data := c.fromClient.feed(p); data {
+		c.touch()
+	}
+	return c.backend.Write(p)
+}
+
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		err = c.backend.Close()
+	})
+	return err
+}
+
+func (c *wsConn) monitor() {
+	cfg := c.svc.WebSocket
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	var pings <-chan time.Time
+	if cfg.PingInterval > 0 {
+		pingTicker := time.NewTicker(cfg.PingInterval)
+		defer pingTicker.Stop()
+		pings = pingTicker.C
+	}
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-pings:
+			select {
+			case c.ping <- struct{}{}:
+			default:
+			}
+		case now := <-ticker.C:
+			if cfg.IdleTimeout > 0 && now.Sub(time.Unix(0, c.lastActivity.Load())) >= cfg.IdleTimeout {
+				log.Printf("[%s] closing idle websocket (no data for %s)", c.svc.name, cfg.IdleTimeout)
+				c.Close()
+				return
+			}
+			if sent := c.pingSent.Load(); sent != 0 && now.Sub(time.Unix(0, sent)) >= cfg.PingInterval {
+				log.Printf("[%s] closing websocket: no response to ping within %s", c.svc.name, cfg.PingInterval)
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// wsFrameTracker follows frame boundaries in one direction of a WebSocket
+// stream without buffering payloads.
+type wsFrameTracker struct {
+	header    []byte
+	remaining uint64
+	control   bool
+}
+
+// feed consumes the next bytes of the stream. It reports whether the stream
+// is now between frames, and whether p carried any part of a data
+// (non-control) frame.
+func (ft *wsFrameTracker) feed(p []byte) (atFrame, data bool) {
+	for len(p) > 0 {
+		if ft.remaining > 0 {
+			n := uint64(len(p))
+			if n > ft.remaining {
+				n = ft.remaining
+			}
+			ft.remaining -= n
+			p = p[n:]
+			data = data || !ft.control
+			continue
+		}
+
+		ft.header = append(ft.header, p[0])
+		p = p[1:]
+		if size := wsHeaderSize(ft.header); size == 0 || len(ft.header) < size {
+			continue
+		}
+
+		ft.control = ft.header[0]&0x08 != 0
+		ft.remaining = wsPayloadLength(ft.header)
+		ft.header = ft.header[:0]
+		data = data || !ft.control
+	}
+	return ft.remaining == 0 && len(ft.header) == 0, data
+}
+
+// wsHeaderSize returns the full header length once the first two bytes are
+// known, or 0 before that.
+func wsHeaderSize(h []byte) int {
+	if len(h) < 2 {
+		return 0
+	}
+	size := 2
+	switch h[1] & 0x7f {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if h[1]&0x80 != 0 {
+		size += 4 // masking key
+	}
+	return size
+}
+
+func wsPayloadLength(h []byte) uint64 {
+	switch n := h[1] & 0x7f; n {
+	case 126:
+		return uint64(binary.BigEndian.Uint16(h[2:4]))
+	case 127:
+		return binary.BigEndian.Uint64(h[2:10])
+	default:
+		return uint64(n)
+	}
+}